@@ -0,0 +1,172 @@
+package apikeys
+
+import (
+	"errors"
+	"time"
+
+	"github.com/udayRedI/go-starter-kit/lib"
+)
+
+// APIKeys lets operators issue, list and revoke API keys, every route needs Config.AuthToken.
+type APIKeys struct {
+	service *lib.Service
+}
+
+type IssueRequest struct {
+	Name          string   `json:"Name"`
+	UserId        string   `json:"UserId"`
+	Scopes        []string `json:"Scopes"`
+	RateLimit     int      `json:"RateLimit"`     // Requests per minute, 0 is unlimited
+	ExpiresInDays int      `json:"ExpiresInDays"` // 0 never expires
+}
+
+type IssueResponse struct {
+	Key    string  `json:"Key"` // Only returned once
+	APIKey KeyInfo `json:"APIKey"`
+}
+
+// KeyInfo is what responses show of a lib.APIKey, the hash stays in the store.
+type KeyInfo struct {
+	Id         string    `json:"Id"`
+	Name       string    `json:"Name"`
+	UserId     string    `json:"UserId"`
+	Scopes     []string  `json:"Scopes"`
+	RateLimit  int       `json:"RateLimit"`
+	ExpiresAt  time.Time `json:"ExpiresAt"`
+	CreatedAt  time.Time `json:"CreatedAt"`
+	LastUsedAt time.Time `json:"LastUsedAt"`
+	RevokedAt  time.Time `json:"RevokedAt"`
+}
+
+func keyInfo(key *lib.APIKey) KeyInfo {
+	return KeyInfo{
+		Id:         key.Id,
+		Name:       key.Name,
+		UserId:     key.UserId,
+		Scopes:     key.Scopes,
+		RateLimit:  key.RateLimit,
+		ExpiresAt:  key.ExpiresAt,
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+type RevokeRequest struct {
+	Id string `json:"Id"`
+}
+
+type ListQuery struct {
+	UserId string `query:"user_id"`
+}
+
+func New() *APIKeys {
+	return &APIKeys{}
+}
+
+func (apiKeys *APIKeys) Title() string {
+	return "api-keys"
+}
+
+func (apiKeys *APIKeys) Init(service *lib.Service) {
+	apiKeys.service = service
+	if !lib.StringLenGtZero(service.Config.AuthToken) {
+		errTxt := "AuthToken is required for the api keys admin app"
+		lib.CheckFatal(errors.New(errTxt), errTxt)
+	}
+}
+
+func (apiKeys *APIKeys) Routes() []lib.HttpAction {
+	admin := []lib.AuthValidatorCallback{lib.NewAuthTokenValidator()}
+	return []lib.HttpAction{
+		{
+			Handler:        apiKeys.Issue,
+			Method:         lib.POST,
+			Action:         "/issue",
+			Summary:        "Issues a key, the key is only shown in this response",
+			RequestType:    IssueRequest{},
+			ResponseType:   IssueResponse{},
+			AuthValidators: admin,
+		},
+		{
+			Handler:        apiKeys.List,
+			Method:         lib.GET,
+			Action:         "/list",
+			Summary:        "Lists keys, of one user when user_id is set",
+			QueryType:      ListQuery{},
+			ResponseType:   []KeyInfo{},
+			AuthValidators: admin,
+		},
+		{
+			Handler:        apiKeys.Revoke,
+			Method:         lib.POST,
+			Action:         "/revoke",
+			Summary:        "Revokes a key straight away",
+			RequestType:    RevokeRequest{},
+			AuthValidators: admin,
+		},
+	}
+}
+
+func (apiKeys *APIKeys) QueueHandlers() lib.QueueRoute {
+	return lib.QueueRoute{}
+}
+
+func (apiKeys *APIKeys) Issue(req *lib.Request) *lib.Response {
+	issueReq := IssueRequest{}
+	if err := req.GetDecodedBody(&issueReq); err != nil {
+		return lib.ClientErrorResponse(err)
+	}
+	if !lib.StringLenGtZero(issueReq.Name) {
+		return lib.ClientErrorResponse(errors.New("Name is required"))
+	}
+	if issueReq.RateLimit < 0 || issueReq.ExpiresInDays < 0 {
+		return lib.ClientErrorResponse(errors.New("RateLimit and ExpiresInDays can't be negative"))
+	}
+
+	template := &lib.APIKey{
+		Name:      issueReq.Name,
+		UserId:    issueReq.UserId,
+		Scopes:    issueReq.Scopes,
+		RateLimit: issueReq.RateLimit,
+	}
+	if issueReq.ExpiresInDays > 0 {
+		template.ExpiresAt = time.Now().UTC().AddDate(0, 0, issueReq.ExpiresInDays)
+	}
+
+	key, record, err := apiKeys.service.IssueAPIKey(req.Context(), template)
+	if err != nil {
+		return lib.ErrorResponse(err)
+	}
+	req.Log().Info("api key issued", "api_key_id", record.Id, "key_user_id", record.UserId)
+	return lib.CreatedResponse("", IssueResponse{Key: key, APIKey: keyInfo(record)})
+}
+
+func (apiKeys *APIKeys) List(req *lib.Request) *lib.Response {
+	keys, err := apiKeys.service.APIKeys().List(req.Context(), req.Query.Get("user_id"))
+	if err != nil {
+		return lib.ErrorResponse(err)
+	}
+	infos := make([]KeyInfo, 0, len(keys))
+	for _, key := range keys {
+		infos = append(infos, keyInfo(key))
+	}
+	return lib.SuccessResponse(infos)
+}
+
+func (apiKeys *APIKeys) Revoke(req *lib.Request) *lib.Response {
+	revokeReq := RevokeRequest{}
+	if err := req.GetDecodedBody(&revokeReq); err != nil {
+		return lib.ClientErrorResponse(err)
+	}
+
+	err := apiKeys.service.APIKeys().Revoke(req.Context(), revokeReq.Id, time.Now().UTC())
+	if errors.Is(err, lib.ErrAPIKeyNotFound) {
+		return lib.NotFoundResponseWithMessage("api key doesn't exist")
+	}
+	if err != nil {
+		return lib.ErrorResponse(err)
+	}
+	req.Log().Info("api key revoked", "api_key_id", revokeReq.Id)
+	return lib.NoContentResponse()
+}
@@ -1,6 +1,8 @@
 package health
 
 import (
+	"net/http"
+
 	"github.com/udayRedI/go-starter-kit/lib"
 )
 
@@ -27,6 +29,20 @@ func (health *Health) Routes() []lib.HttpAction {
 			Method:  lib.GET,
 			Action:  "/get",
 		},
+		{
+			Handler:      health.Live,
+			Method:       lib.GET,
+			Action:       "/live",
+			Summary:      "Liveness checks",
+			ResponseType: lib.HealthReport{},
+		},
+		{
+			Handler:      health.Ready,
+			Method:       lib.GET,
+			Action:       "/ready",
+			Summary:      "Readiness checks",
+			ResponseType: lib.HealthReport{},
+		},
 	}
 }
 
@@ -37,3 +53,23 @@ func (health *Health) QueueHandlers() lib.QueueRoute {
 func (health *Health) Get(req *lib.Request) *lib.Response {
 	return lib.SuccessResponse("OK!")
 }
+
+// Live tells the orchestrator whether the process should be restarted.
+func (health *Health) Live(req *lib.Request) *lib.Response {
+	return reportResponse(health.service.Health.Liveness(req.SentryContext))
+}
+
+// Ready tells the load balancer whether the instance can take traffic.
+func (health *Health) Ready(req *lib.Request) *lib.Response {
+	return reportResponse(health.service.Health.Readiness(req.SentryContext))
+}
+
+func reportResponse(report lib.HealthReport) *lib.Response {
+	if !report.IsHealthy() {
+		return &lib.Response{
+			Status: http.StatusServiceUnavailable,
+			Body:   report,
+		}
+	}
+	return lib.SuccessResponse(report)
+}
@@ -0,0 +1,168 @@
+package okta
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/udayRedI/go-starter-kit/lib"
+)
+
+const (
+	loginCookie   = "okta_login"
+	idTokenCookie = "okta_id_token" // Sent back as id_token_hint on logout
+	loginTTL      = 10 * time.Minute
+)
+
+// Okta logs browser users in with the authorization code + PKCE flow and keeps the access token in an HttpOnly cookie,
+// which lib.NewOktaValidator picks up when there's no Authorization header.
+type Okta struct {
+	service *lib.Service
+	client  *lib.OktaClient
+}
+
+func New() *Okta {
+	return &Okta{}
+}
+
+func (okta *Okta) Title() string {
+	return "okta"
+}
+
+func (okta *Okta) Init(service *lib.Service) {
+	okta.service = service
+	okta.client = service.Okta()
+	config := okta.client.Config()
+	if !lib.StringLenGtZero(config.ClientId) || !lib.StringLenGtZero(config.RedirectUrl) || !lib.StringLenGtZero(config.CookieSecret) {
+		errTxt := "OKTA_CLIENT_ID, OKTA_REDIRECT_URL and OKTA_COOKIE_SECRET are required for okta login"
+		lib.CheckFatal(errors.New(errTxt), errTxt)
+	}
+}
+
+func (okta *Okta) Routes() []lib.HttpAction {
+	return []lib.HttpAction{
+		{
+			Handler: okta.Login,
+			Method:  lib.GET,
+			Action:  "/login",
+			Summary: "Redirects to Okta sign in",
+		},
+		{
+			Handler: okta.Callback,
+			Method:  lib.GET,
+			Action:  "/callback",
+			Summary: "Completes Okta sign in",
+		},
+		{
+			Handler: okta.Logout,
+			Method:  lib.GET,
+			Action:  "/logout",
+			Summary: "Clears the login cookie and signs out of Okta",
+		},
+	}
+}
+
+func (okta *Okta) QueueHandlers() lib.QueueRoute {
+	return lib.QueueRoute{}
+}
+
+// Login redirects to the authorization endpoint, ?redirect=/path picks where the browser lands afterwards.
+func (okta *Okta) Login(req *lib.Request) *lib.Response {
+	state, nonce, verifier := lib.RandomToken(24), lib.RandomToken(24), lib.RandomToken(48)
+	authUrl, err := okta.client.AuthCodeURL(req.Context(), state, nonce, verifier)
+	if err != nil {
+		return lib.ErrorResponse(err)
+	}
+
+	redirect := base64.RawURLEncoding.EncodeToString([]byte(okta.landingPage(req.Query.Get("redirect"))))
+	value := lib.SignValue(okta.client.Config().CookieSecret, strings.Join([]string{state, nonce, verifier, redirect}, "."))
+	return lib.RedirectResponse(authUrl, 0).SetCookie(okta.cookie(loginCookie, value, loginTTL))
+}
+
+// Callback checks state against the login cookie, swaps the code for tokens and stores the access token.
+func (okta *Okta) Callback(req *lib.Request) *lib.Response {
+	if errCode := req.Query.Get("error"); lib.StringLenGtZero(errCode) {
+		req.Log().Info("okta sign in failed", "error", errCode, "description", req.Query.Get("error_description"))
+		return lib.AuthFailedResponse()
+	}
+
+	cookie, err := req.Cookie(loginCookie)
+	if err != nil {
+		return lib.ClientErrorResponse(errors.New("login expired, start again"))
+	}
+	value, valid := lib.VerifySignedValue(okta.client.Config().CookieSecret, cookie.Value)
+	parts := strings.Split(value, ".")
+	if !valid || len(parts) != 4 || parts[0] != req.Query.Get("state") {
+		return lib.ClientErrorResponse(errors.New("invalid login state"))
+	}
+	nonce, verifier := parts[1], parts[2]
+	redirect, _ := base64.RawURLEncoding.DecodeString(parts[3])
+
+	tokens, err := okta.client.Exchange(req.Context(), req.Query.Get("code"), verifier)
+	if err != nil {
+		req.Log().Error("okta code exchange failed", "error", err)
+		return lib.AuthFailedResponse()
+	}
+	if _, err := okta.client.VerifyIDToken(req.Context(), tokens.IdToken, nonce); err != nil {
+		req.Log().Error("okta id token rejected", "error", err)
+		return lib.AuthFailedResponse()
+	}
+
+	expiresIn := time.Duration(tokens.ExpiresIn) * time.Second
+	return lib.RedirectResponse(okta.landingPage(string(redirect)), 0).
+		SetCookie(okta.cookie(loginCookie, "", -1)).
+		SetCookie(okta.cookie(lib.OktaTokenCookie, tokens.AccessToken, expiresIn)).
+		SetCookie(okta.cookie(idTokenCookie, tokens.IdToken, expiresIn))
+}
+
+// Logout clears the token cookie and ends the Okta session when the issuer supports it.
+func (okta *Okta) Logout(req *lib.Request) *lib.Response {
+	location := okta.landingPage("")
+	discovery, err := okta.client.Discovery(req.Context())
+	if err == nil && lib.StringLenGtZero(discovery.EndSessionEndpoint) {
+		query := url.Values{"client_id": {okta.client.Config().ClientId}}
+		if idToken, err := req.Cookie(idTokenCookie); err == nil {
+			query.Set("id_token_hint", idToken.Value)
+		}
+		base, baseErr := url.Parse(okta.client.Config().RedirectUrl)
+		landing, landingErr := url.Parse(location)
+		if baseErr == nil && landingErr == nil {
+			query.Set("post_logout_redirect_uri", base.ResolveReference(landing).String())
+		}
+		location = discovery.EndSessionEndpoint + "?" + query.Encode()
+	}
+	return lib.RedirectResponse(location, 0).
+		SetCookie(okta.cookie(lib.OktaTokenCookie, "", -1)).
+		SetCookie(okta.cookie(idTokenCookie, "", -1))
+}
+
+// landingPage only allows local paths so ?redirect can't be used to bounce users to other sites.
+func (okta *Okta) landingPage(redirect string) string {
+	if lib.IsLocalRedirect(redirect) {
+		return redirect
+	}
+	if lib.StringLenGtZero(okta.client.Config().LoginRedirect) {
+		return okta.client.Config().LoginRedirect
+	}
+	return "/"
+}
+
+// cookie with maxAge < 0 deletes it.
+func (okta *Okta) cookie(name string, value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
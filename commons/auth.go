@@ -2,7 +2,6 @@ package commons
 
 import (
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 
@@ -27,6 +26,10 @@ func NewRouteHeaderValidator() lib.AuthValidatorCallback {
 	}
 }
 
+func (rv *RouteHeaderValidator) SecurityScheme() (string, lib.SecurityScheme) {
+	return "routeHeaderToken", lib.SecurityScheme{Type: "apiKey", In: "header", Name: "Token"}
+}
+
 func (rv *RouteHeaderValidator) Validate(req *lib.Request) lib.Auth {
 
 	token := req.GetHeaderVal("Token")
@@ -39,28 +42,28 @@ func (rv *RouteHeaderValidator) Validate(req *lib.Request) lib.Auth {
 	client := &http.Client{}
 	extReq, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		fmt.Println("Error creating request:", err)
+		req.Log().Error("error creating request", "error", err)
 		return lib.Auth{}
 	}
 	extReq.Header.Set("Authorization", *token)
 
 	resp, err := client.Do(extReq)
 	if err != nil {
-		fmt.Println("Error making request:", err)
+		req.Log().Error("error making request", "error", err)
 		return lib.Auth{}
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Println("Error reading response body:", err)
+		req.Log().Error("error reading response body", "error", err)
 		return lib.Auth{}
 	}
 
 	var user AuthPayload
 	err = json.Unmarshal(body, &user)
 	if err != nil {
-		fmt.Println("Error decoding JSON:", err)
+		req.Log().Error("error decoding JSON", "error", err)
 		return lib.Auth{}
 	}
 
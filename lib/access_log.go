@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type AccessLogConfig struct {
+	Enabled     bool               `json:"Enabled"`
+	File        string             `json:"File"`        // Separate sink for access logs, service logger is used when empty
+	SampleRates map[string]float64 `json:"SampleRates"` // Keyed on app or app/action, 0 drops everything and 1 logs everything
+}
+
+type accessLogger struct {
+	logger      *slog.Logger
+	sampleRates map[string]float64
+}
+
+// newAccessLogger writes to w(stdout when nil) unless AccessLog.File is set. Lines skip Log.Level and
+// Log.Levels, access logs are switched off with AccessLog.Enabled or sampled out with SampleRates.
+func newAccessLogger(config *Config, w io.Writer) *accessLogger {
+	if config.AccessLog == nil || !config.AccessLog.Enabled {
+		return nil
+	}
+
+	if StringLenGtZero(config.AccessLog.File) {
+		file, err := os.OpenFile(config.AccessLog.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		CheckFatal(err, fmt.Sprintf("unable to open access log file %s", config.AccessLog.File))
+		w = file
+	}
+
+	return &accessLogger{
+		logger:      slog.New(newLogHandler(config, w)).With("component", "access"),
+		sampleRates: config.AccessLog.SampleRates,
+	}
+}
+
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		CheckFatal(err, fmt.Sprintf("invalid trusted proxy %s", proxy))
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isTrustedProxy(trusted []*net.IPNet, ip net.IP) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns remote address unless it's a trusted proxy, in which case X-Forwarded-For
+// is walked right to left and the first untrusted hop is the client.
+func clientIP(httpReq *http.Request, trusted []*net.IPNet) string {
+	remote := httpReq.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	remoteIP := net.ParseIP(remote)
+	if remoteIP == nil || !isTrustedProxy(trusted, remoteIP) {
+		return remote
+	}
+
+	hops := splitStrings(httpReq.Header.Values("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break
+		}
+		if !isTrustedProxy(trusted, hopIP) {
+			return hop
+		}
+		remote = hop
+	}
+
+	return remote
+}
+
+func (al *accessLogger) sampled(app string, action string, status int) bool {
+	// Failures are never sampled out.
+	if status >= http.StatusInternalServerError {
+		return true
+	}
+	rate, found := al.sampleRates[app+"/"+action]
+	if !found {
+		rate, found = al.sampleRates[app]
+	}
+	if !found || rate >= 1 {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+func (al *accessLogger) log(httpReq *http.Request, req *Request, recorder *responseRecorder, start time.Time) {
+	status := recorder.StatusCode()
+
+	path := ""
+	if httpReq.URL != nil {
+		path = httpReq.URL.Path
+	}
+
+	attrs := []any{
+		"method", httpReq.Method,
+		"path", path,
+		"status", status,
+		"bytes", recorder.bytes,
+		"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+	}
+
+	app, action := "", ""
+	if req != nil {
+		app, action = req.AppTitle, req.Action
+		attrs = append(attrs, "client_ip", req.ClientIP, "app", app, "action", action, "request_id", req.ID, "user_id", req.Auth.UserId)
+	}
+
+	if !al.sampled(app, action, status) {
+		return
+	}
+
+	al.logger.Info("access", attrs...)
+}
+
+// responseRecorder keeps track of status and bytes written for access logs.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.status == 0 {
+		rec.status = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(data)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *responseRecorder) StatusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Hijack lets websocket upgrades through the recorder, status is recorded as 101 for access logs.
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
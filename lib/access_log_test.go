@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+
+	type input struct {
+		title      string
+		remoteAddr string
+		forwarded  string
+		exp        string
+	}
+
+	inputs := []input{
+		{title: "Direct client", remoteAddr: "1.2.3.4:5678", exp: "1.2.3.4"},
+		{title: "Untrusted proxy is ignored", remoteAddr: "1.2.3.4:5678", forwarded: "5.6.7.8", exp: "1.2.3.4"},
+		{title: "Trusted proxy", remoteAddr: "10.0.0.5:80", forwarded: "5.6.7.8", exp: "5.6.7.8"},
+		{title: "Chain of trusted proxies", remoteAddr: "10.0.0.5:80", forwarded: "9.9.9.9, 5.6.7.8, 192.168.1.1", exp: "5.6.7.8"},
+		{title: "Trusted proxy without header", remoteAddr: "10.0.0.5:80", exp: "10.0.0.5"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			httpReq := &http.Request{RemoteAddr: input.remoteAddr, Header: http.Header{}}
+			if input.forwarded != "" {
+				httpReq.Header.Set("X-Forwarded-For", input.forwarded)
+			}
+			if got := clientIP(httpReq, trusted); got != input.exp {
+				t.Errorf("expected %s got %s", input.exp, got)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := NewService(&Config{}, &[]App{&MockApp{}})
+	s.accessLog = &accessLogger{
+		logger:      NewLogger(&Config{}, buf),
+		sampleRates: map[string]float64{"mock-app/get": 0},
+	}
+
+	s.ServeHTTP(&MockResponseWriter{}, &http.Request{
+		Method:     "GET",
+		RemoteAddr: "1.2.3.4:5678",
+		URL:        &url.URL{Path: "mock-app/public-success-get"},
+	})
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected json access log got %s", buf.String())
+	}
+	for key, exp := range map[string]interface{}{
+		"method":    "GET",
+		"app":       "mock-app",
+		"action":    "public-success-get",
+		"status":    float64(200),
+		"client_ip": "1.2.3.4",
+	} {
+		if line[key] != exp {
+			t.Errorf("expected %s to be %v got %v", key, exp, line[key])
+		}
+	}
+
+	buf.Reset()
+	s.ServeHTTP(&MockResponseWriter{}, &http.Request{Method: "GET", URL: &url.URL{Path: "mock-app/get"}})
+	if buf.Len() != 0 {
+		t.Errorf("expected sampled out route to skip access log got %s", buf.String())
+	}
+
+	t.Run("Ignores log levels", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		config := &Config{
+			Log:       &LogConfig{Level: "WARN", Levels: map[string]string{"access": "ERROR", "mock-app": "ERROR"}},
+			AccessLog: &AccessLogConfig{Enabled: true},
+		}
+		s := NewService(config, &[]App{&MockApp{}})
+		s.accessLog = newAccessLogger(config, buf)
+
+		s.ServeHTTP(&MockResponseWriter{}, &http.Request{Method: "GET", URL: &url.URL{Path: "mock-app/public-success-get"}})
+		if !strings.Contains(buf.String(), `"path":"mock-app/public-success-get"`) {
+			t.Errorf("expected access log with level WARN got %s", buf.String())
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	ProblemJSONContentType = "application/problem+json"
+
+	internalErrorMsg = "something went wrong on our side"
+	authFailedMsg    = "Auth failed, please try again"
+	forbiddenMsg     = "You aren't allowed to do this"
+	rateLimitedMsg   = "Too many requests, slow down"
+)
+
+// APIError is the error envelope sent to clients, Err is the underlying cause and is never serialised.
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"Code"`
+	Message   string `json:"Msg"`
+	Details   any    `json:"Details,omitempty"`
+	RequestId string `json:"RequestId,omitempty"`
+	Err       error  `json:"-"`
+}
+
+func NewAPIError(status int, code string, message string) *APIError {
+	return &APIError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// WithDetails returns a copy with extra information for clients, like field level validation errors.
+func (e *APIError) WithDetails(details any) *APIError {
+	apiErr := *e
+	apiErr.Details = details
+	return &apiErr
+}
+
+// Wrap returns a copy carrying the cause, useful for logging while keeping the client message fixed.
+func (e *APIError) Wrap(err error) *APIError {
+	apiErr := *e
+	apiErr.Err = err
+	return &apiErr
+}
+
+func ErrBadRequest(message string) *APIError {
+	return NewAPIError(http.StatusBadRequest, "bad_request", message)
+}
+
+func ErrUnauthorized(message string) *APIError {
+	return NewAPIError(http.StatusUnauthorized, "auth_failed", message)
+}
+
+func ErrForbidden(message string) *APIError {
+	return NewAPIError(http.StatusForbidden, "forbidden", message)
+}
+
+func ErrTooManyRequests(message string) *APIError {
+	return NewAPIError(http.StatusTooManyRequests, "too_many_requests", message)
+}
+
+func ErrNotFound(message string) *APIError {
+	return NewAPIError(http.StatusNotFound, "not_found", message)
+}
+
+func ErrMethodNotAllowed(message string) *APIError {
+	return NewAPIError(http.StatusMethodNotAllowed, "method_not_allowed", message)
+}
+
+func ErrInternal(err error) *APIError {
+	return NewAPIError(http.StatusInternalServerError, "internal_error", internalErrorMsg).Wrap(err)
+}
+
+// ErrorToResponse maps any error to a response, errors without an APIError in their chain are treated as 500s.
+func ErrorToResponse(err error) *Response {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return ErrorResponse(err)
+	}
+	if apiErr.Status >= http.StatusInternalServerError {
+		CaptureSentryException(apiErr.Error())
+	}
+	return &Response{
+		Status: apiErr.Status,
+		Body:   apiErr,
+	}
+}
+
+// HandlerWithError adapts handlers which return errors, a non nil error always wins over the response.
+func HandlerWithError(handler func(*Request) (*Response, error)) func(*Request) *Response {
+	return func(req *Request) *Response {
+		resp, err := handler(req)
+		if err != nil {
+			return ErrorToResponse(err)
+		}
+		return resp
+	}
+}
+
+// problemDetails is the RFC 7807 representation of APIError.
+type problemDetails struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	Details   any    `json:"details,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
+}
+
+// marshalAPIError stamps request ID and serialises error either as the default envelope or problem+json.
+func (s *Service) marshalAPIError(err *APIError, req *Request) ([]byte, string, error) {
+	// Copy so errors declared as package level vars are never mutated.
+	apiErr := *err
+	if req != nil && !StringLenGtZero(apiErr.RequestId) {
+		apiErr.RequestId = req.ID
+	}
+
+	if !s.Config.ProblemJSON {
+		body, marshalErr := json.Marshal(apiErr)
+		return body, "application/json; charset=utf-8", marshalErr
+	}
+
+	problem := problemDetails{
+		Type:      "about:blank",
+		Title:     http.StatusText(apiErr.Status),
+		Status:    apiErr.Status,
+		Detail:    apiErr.Message,
+		Code:      apiErr.Code,
+		Details:   apiErr.Details,
+		RequestId: apiErr.RequestId,
+	}
+	if req != nil {
+		problem.Instance = req.Path
+	}
+	body, marshalErr := json.Marshal(problem)
+	return body, ProblemJSONContentType, marshalErr
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestErrorToResponse(t *testing.T) {
+	type input struct {
+		title     string
+		err       error
+		expStatus int
+		expCode   string
+	}
+
+	inputs := []input{
+		{title: "APIError keeps its status", err: ErrNotFound("user missing"), expStatus: http.StatusNotFound, expCode: "not_found"},
+		{title: "Wrapped APIError is found via errors.As", err: fmt.Errorf("lookup: %w", ErrBadRequest("bad id")), expStatus: http.StatusBadRequest, expCode: "bad_request"},
+		{title: "Plain error is a 500", err: errors.New("db down"), expStatus: http.StatusInternalServerError, expCode: "internal_error"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			resp := ErrorToResponse(input.err)
+			if resp.Status != input.expStatus {
+				t.Errorf("expected %d got %d", input.expStatus, resp.Status)
+			}
+			if apiErr, _ := resp.Body.(*APIError); apiErr == nil || apiErr.Code != input.expCode {
+				t.Errorf("expected code %s got %v", input.expCode, resp.Body)
+			}
+		})
+	}
+}
+
+func TestHandlerWithError(t *testing.T) {
+	handler := HandlerWithError(func(req *Request) (*Response, error) {
+		return nil, ErrBadRequest(`name "bob" is taken`).WithDetails(map[string]string{"name": "taken"})
+	})
+
+	s := NewService(&Config{}, &[]App{})
+	req := &Request{ID: "req-1", Path: "users/create"}
+	resp := handler(req)
+	body := s.prepareResp(&MockResponseWriter{}, resp, req)
+
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(*body, &envelope); err != nil {
+		t.Fatalf("expected valid json got %s", *body)
+	}
+	if envelope["Msg"] != `name "bob" is taken` || envelope["RequestId"] != "req-1" || envelope["Code"] != "bad_request" {
+		t.Errorf("unexpected envelope %s", *body)
+	}
+}
+
+func TestProblemJSON(t *testing.T) {
+	s := NewService(&Config{ProblemJSON: true}, &[]App{})
+	writer := &MockResponseWriter{}
+	req := &Request{ID: "req-1", Path: "users/1"}
+	body := s.prepareResp(writer, NotFoundResponse(), req)
+
+	if writer.Header().Get("Content-Type") != ProblemJSONContentType {
+		t.Errorf("expected problem+json content type got %s", writer.Header().Get("Content-Type"))
+	}
+	var problem map[string]interface{}
+	if err := json.Unmarshal(*body, &problem); err != nil {
+		t.Fatalf("expected valid json got %s", *body)
+	}
+	if problem["status"] != float64(404) || problem["title"] != "Not Found" || problem["instance"] != "users/1" || problem["request_id"] != "req-1" {
+		t.Errorf("unexpected problem %s", *body)
+	}
+}
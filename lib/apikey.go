@@ -0,0 +1,326 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAPIKeyPrefix = "sk"
+	defaultAPIKeyHeader = "X-Api-Key"
+	apiKeyIdBytes       = 6
+	apiKeySecretBytes   = 32
+	apiKeyTouchInterval = time.Minute
+
+	MemoryAPIKeyStore   = "memory"
+	PostgresAPIKeyStore = "postgres"
+	RedisAPIKeyStore    = "redis"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+type APIKeyConfig struct {
+	Store  string    `json:"Store"`  // memory(default), postgres or redis
+	Prefix string    `json:"Prefix"` // Start of issued keys so they're easy to spot in leaks, defaults to sk
+	Header string    `json:"Header"` // Defaults to X-Api-Key
+	Keys   []*APIKey `json:"Keys"`   // Seed the memory store, Hash is the hex SHA-256 of the key
+}
+
+// APIKey is what's stored for an issued key, the key itself is only known to the client.
+// Keys look like sk_<Id>_<secret> so the record is found by Id and the secret checked against Hash.
+type APIKey struct {
+	Id         string    `json:"Id"`
+	Hash       string    `json:"Hash"` // Hex SHA-256 of the full key
+	Name       string    `json:"Name"`
+	UserId     string    `json:"UserId"`
+	Scopes     []string  `json:"Scopes"`
+	RateLimit  int       `json:"RateLimit"` // Requests per minute, 0 is unlimited
+	ExpiresAt  time.Time `json:"ExpiresAt"` // Zero never expires
+	CreatedAt  time.Time `json:"CreatedAt"`
+	LastUsedAt time.Time `json:"LastUsedAt"`
+	RevokedAt  time.Time `json:"RevokedAt"`
+}
+
+func (key *APIKey) Principal() *Principal {
+	return &Principal{Scopes: key.Scopes}
+}
+
+func (key *APIKey) active(now time.Time) bool {
+	return key.RevokedAt.IsZero() && (key.ExpiresAt.IsZero() || now.Before(key.ExpiresAt))
+}
+
+// APIKeyStore keeps key records, Find returns ErrAPIKeyNotFound for unknown ids.
+type APIKeyStore interface {
+	Find(ctx context.Context, id string) (*APIKey, error)
+	List(ctx context.Context, userId string) ([]*APIKey, error) // Every key when userId is empty
+	Save(ctx context.Context, key *APIKey) error
+	Revoke(ctx context.Context, id string, at time.Time) error
+	Touch(ctx context.Context, id string, at time.Time) error // Records LastUsedAt
+}
+
+// APIKeys returns the store picked by Config.APIKeys.Store, set up by Init.
+func (s *Service) APIKeys() APIKeyStore {
+	return s.apiKeyStore
+}
+
+// initAPIKeys creates the store for Config.APIKeys.Store once redis and db are set up,
+// a store set with SetAPIKeyStore is kept.
+func (s *Service) initAPIKeys() {
+	if s.apiKeyStore != nil {
+		return
+	}
+	config := s.apiKeyConfig()
+	switch config.Store {
+	case "", MemoryAPIKeyStore:
+		s.apiKeyStore = NewMemoryAPIKeyStore(config.Keys)
+	case PostgresAPIKeyStore:
+		if s.DbPool == nil {
+			errTxt := "DbUrl is required for the postgres api key store"
+			CheckFatal(errors.New(errTxt), errTxt)
+		}
+		s.apiKeyStore = NewPostgresAPIKeyStore(s.DbPool)
+	case RedisAPIKeyStore:
+		if s.RedisClient == nil {
+			errTxt := "Redis is required for the redis api key store"
+			CheckFatal(errors.New(errTxt), errTxt)
+		}
+		s.apiKeyStore = NewRedisAPIKeyStore(s.RedisClient)
+	default:
+		errTxt := fmt.Sprintf("unknown api key store %s", config.Store)
+		CheckFatal(errors.New(errTxt), errTxt)
+	}
+}
+
+// SetAPIKeyStore swaps the configured store for a custom one, call it before serving.
+func (s *Service) SetAPIKeyStore(store APIKeyStore) {
+	s.apiKeyStore = store
+}
+
+func (s *Service) apiKeyConfig() *APIKeyConfig {
+	config := APIKeyConfig{}
+	if s.Config.APIKeys != nil {
+		config = *s.Config.APIKeys
+	}
+	if !StringLenGtZero(config.Prefix) {
+		config.Prefix = defaultAPIKeyPrefix
+	}
+	if !StringLenGtZero(config.Header) {
+		config.Header = defaultAPIKeyHeader
+	}
+	return &config
+}
+
+// IssueAPIKey fills in Id, Hash and CreatedAt of template, saves it and returns the key.
+// The key can't be recovered later, hand it to the client straight away.
+func (s *Service) IssueAPIKey(ctx context.Context, template *APIKey) (string, *APIKey, error) {
+	idBytes := make([]byte, apiKeyIdBytes)
+	secretBytes := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", nil, err
+	}
+
+	record := *template
+	record.Id = s.apiKeyConfig().Prefix + "_" + hex.EncodeToString(idBytes)
+	key := record.Id + "_" + hex.EncodeToString(secretBytes)
+	record.Hash = HashAPIKey(key)
+	record.CreatedAt = time.Now().UTC()
+	record.LastUsedAt = time.Time{}
+	record.RevokedAt = time.Time{}
+
+	if err := s.APIKeys().Save(ctx, &record); err != nil {
+		return "", nil, err
+	}
+	return key, &record, nil
+}
+
+// HashAPIKey is how keys are stored, keys are random enough that a fast hash is fine.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyId returns the record id part of key, keys are <prefix>_<id hex>_<secret hex>.
+func apiKeyId(key string) (string, bool) {
+	idx := strings.LastIndex(key, "_")
+	if idx <= 0 || len(key)-idx-1 != hex.EncodedLen(apiKeySecretBytes) {
+		return "", false
+	}
+	return key[:idx], true
+}
+
+type APIKeyValidator struct {
+	service   *Service
+	header    string
+	touchMu   sync.Mutex
+	touchedAt map[string]time.Time
+}
+
+// NewAPIKeyValidator authenticates keys sent in Config.APIKeys.Header, Auth.Payload is the *APIKey.
+// Keys over their RateLimit are answered with 429.
+func NewAPIKeyValidator() AuthValidatorCallback {
+	var mu sync.Mutex
+	validators := make(map[*Service]*APIKeyValidator)
+	return func(service *Service) AuthValidator {
+		mu.Lock()
+		defer mu.Unlock()
+		validator, found := validators[service]
+		if !found {
+			validator = &APIKeyValidator{
+				service:   service,
+				header:    service.apiKeyConfig().Header,
+				touchedAt: make(map[string]time.Time),
+			}
+			validators[service] = validator
+		}
+		return validator
+	}
+}
+
+func (v *APIKeyValidator) SecurityScheme() (string, SecurityScheme) {
+	return "apiKey", SecurityScheme{Type: "apiKey", In: "header", Name: v.header}
+}
+
+func (v *APIKeyValidator) Validate(req *Request) Auth {
+	val := req.GetHeaderVal(v.header)
+	if val == nil {
+		return Auth{}
+	}
+	key := strings.TrimSpace(*val)
+
+	id, valid := apiKeyId(key)
+	if !valid {
+		return Auth{Reason: "malformed api key"}
+	}
+	record, err := v.service.APIKeys().Find(req.Context(), id)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return Auth{Reason: "unknown api key"}
+	}
+	if err != nil {
+		req.Log().Error("api key lookup failed", "error", err)
+		return Auth{}
+	}
+	if subtle.ConstantTimeCompare([]byte(HashAPIKey(key)), []byte(record.Hash)) != 1 {
+		return Auth{Reason: "unknown api key"}
+	}
+	now := time.Now()
+	if !record.active(now) {
+		return Auth{Reason: "api key is revoked or expired"}
+	}
+
+	if record.RateLimit > 0 {
+		// Shared with route limits so the quota holds across replicas when the redis store is used.
+		if result := v.service.allowRequest(req, "api_key_quota:"+record.Id, record.RateLimit, time.Minute); !result.Allowed {
+			req.Log().Info("api key over its rate limit", "api_key_id", record.Id)
+			return Auth{UserId: record.UserId, Reason: "rate limit exceeded", RetryAfter: result.RetryAfter}
+		}
+	}
+
+	v.touch(req, record.Id, now)
+
+	userId := record.UserId
+	if !StringLenGtZero(userId) {
+		userId = record.Id
+	}
+	return Auth{
+		IsAuthenticated: true,
+		UserId:          userId,
+		Payload:         record,
+	}
+}
+
+// touch records LastUsedAt in the background, at most once a minute per key.
+func (v *APIKeyValidator) touch(req *Request, id string, now time.Time) {
+	v.touchMu.Lock()
+	if now.Sub(v.touchedAt[id]) < apiKeyTouchInterval {
+		v.touchMu.Unlock()
+		return
+	}
+	v.touchedAt[id] = now
+	v.touchMu.Unlock()
+
+	logger := req.Log()
+	GoFuncWrapper("api key last used", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := v.service.APIKeys().Touch(ctx, id, now.UTC()); err != nil {
+			logger.Error("recording api key use failed", "api_key_id", id, "error", err)
+		}
+	})
+}
+
+// MemoryAPIKeyStore keeps keys in process, seeded from config. Issued and revoked keys are lost on restart.
+type memoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+func NewMemoryAPIKeyStore(seed []*APIKey) APIKeyStore {
+	store := &memoryAPIKeyStore{keys: make(map[string]APIKey)}
+	for _, key := range seed {
+		store.keys[key.Id] = *key
+	}
+	return store
+}
+
+func (store *memoryAPIKeyStore) Find(ctx context.Context, id string) (*APIKey, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	key, found := store.keys[id]
+	if !found {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
+
+func (store *memoryAPIKeyStore) List(ctx context.Context, userId string) ([]*APIKey, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	keys := []*APIKey{}
+	for _, key := range store.keys {
+		if !StringLenGtZero(userId) || key.UserId == userId {
+			key := key
+			keys = append(keys, &key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (store *memoryAPIKeyStore) Save(ctx context.Context, key *APIKey) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.keys[key.Id] = *key
+	return nil
+}
+
+func (store *memoryAPIKeyStore) Revoke(ctx context.Context, id string, at time.Time) error {
+	return store.update(id, func(key *APIKey) { key.RevokedAt = at })
+}
+
+func (store *memoryAPIKeyStore) Touch(ctx context.Context, id string, at time.Time) error {
+	return store.update(id, func(key *APIKey) { key.LastUsedAt = at })
+}
+
+func (store *memoryAPIKeyStore) update(id string, change func(*APIKey)) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	key, found := store.keys[id]
+	if !found {
+		return ErrAPIKeyNotFound
+	}
+	change(&key)
+	store.keys[id] = key
+	return nil
+}
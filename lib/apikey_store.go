@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// APIKeysTableSQL creates the table used by the postgres store, run it with your migrations.
+const APIKeysTableSQL = `CREATE TABLE IF NOT EXISTS api_keys (
+	id           TEXT PRIMARY KEY,
+	hash         TEXT NOT NULL,
+	name         TEXT NOT NULL DEFAULT '',
+	user_id      TEXT NOT NULL DEFAULT '',
+	scopes       TEXT[] NOT NULL DEFAULT '{}',
+	rate_limit   INTEGER NOT NULL DEFAULT 0,
+	expires_at   TIMESTAMPTZ,
+	created_at   TIMESTAMPTZ NOT NULL,
+	last_used_at TIMESTAMPTZ,
+	revoked_at   TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_id ON api_keys (user_id);`
+
+const apiKeyColumns = "id, hash, name, user_id, scopes, rate_limit, expires_at, created_at, last_used_at, revoked_at"
+
+type postgresAPIKeyStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresAPIKeyStore(pool *pgxpool.Pool) APIKeyStore {
+	return &postgresAPIKeyStore{pool: pool}
+}
+
+func (store *postgresAPIKeyStore) Find(ctx context.Context, id string) (*APIKey, error) {
+	key, err := scanAPIKey(store.pool.QueryRow(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (store *postgresAPIKeyStore) List(ctx context.Context, userId string) ([]*APIKey, error) {
+	rows, err := store.pool.Query(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE $1 = '' OR user_id = $1 ORDER BY created_at", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (store *postgresAPIKeyStore) Save(ctx context.Context, key *APIKey) error {
+	_, err := store.pool.Exec(ctx, `INSERT INTO api_keys (`+apiKeyColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET hash = $2, name = $3, user_id = $4, scopes = $5, rate_limit = $6, expires_at = $7, last_used_at = $9, revoked_at = $10`,
+		key.Id, key.Hash, key.Name, key.UserId, nonNil(key.Scopes), key.RateLimit,
+		nullTime(key.ExpiresAt), key.CreatedAt, nullTime(key.LastUsedAt), nullTime(key.RevokedAt))
+	return err
+}
+
+func (store *postgresAPIKeyStore) Revoke(ctx context.Context, id string, at time.Time) error {
+	return store.update(ctx, "UPDATE api_keys SET revoked_at = $2 WHERE id = $1", id, at)
+}
+
+func (store *postgresAPIKeyStore) Touch(ctx context.Context, id string, at time.Time) error {
+	return store.update(ctx, "UPDATE api_keys SET last_used_at = $2 WHERE id = $1", id, at)
+}
+
+func (store *postgresAPIKeyStore) update(ctx context.Context, sql string, id string, at time.Time) error {
+	tag, err := store.pool.Exec(ctx, sql, id, at)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func scanAPIKey(row pgx.Row) (*APIKey, error) {
+	key := &APIKey{}
+	var expiresAt, lastUsedAt, revokedAt *time.Time
+	err := row.Scan(&key.Id, &key.Hash, &key.Name, &key.UserId, &key.Scopes, &key.RateLimit, &expiresAt, &key.CreatedAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range []struct {
+		from *time.Time
+		to   *time.Time
+	}{{expiresAt, &key.ExpiresAt}, {lastUsedAt, &key.LastUsedAt}, {revokedAt, &key.RevokedAt}} {
+		if value.from != nil {
+			*value.to = *value.from
+		}
+	}
+	return key, nil
+}
+
+func nullTime(value time.Time) *time.Time {
+	if value.IsZero() {
+		return nil
+	}
+	return &value
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// redisAPIKeyStore keeps each record as JSON under api-key:<id>, with sets of ids for listing.
+type redisAPIKeyStore struct {
+	client *redis.Client
+}
+
+func NewRedisAPIKeyStore(client *redis.Client) APIKeyStore {
+	return &redisAPIKeyStore{client: client}
+}
+
+func redisAPIKey(id string) string {
+	return "api-key:" + id
+}
+
+func redisAPIKeyIndex(userId string) string {
+	if !StringLenGtZero(userId) {
+		return "api-keys"
+	}
+	return "api-keys:user:" + userId
+}
+
+func (store *redisAPIKeyStore) Find(ctx context.Context, id string) (*APIKey, error) {
+	data, err := store.client.WithContext(ctx).Get(redisAPIKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := &APIKey{}
+	return key, json.Unmarshal(data, key)
+}
+
+func (store *redisAPIKeyStore) List(ctx context.Context, userId string) ([]*APIKey, error) {
+	client := store.client.WithContext(ctx)
+	ids, err := client.SMembers(redisAPIKeyIndex(userId)).Result()
+	if err != nil || len(ids) == 0 {
+		return []*APIKey{}, err
+	}
+
+	redisKeys := make([]string, len(ids))
+	for idx, id := range ids {
+		redisKeys[idx] = redisAPIKey(id)
+	}
+	values, err := client.MGet(redisKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*APIKey{}
+	for _, value := range values {
+		data, isStr := value.(string)
+		if !isStr {
+			continue // Deleted since SMembers
+		}
+		key := &APIKey{}
+		if err := json.Unmarshal([]byte(data), key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (store *redisAPIKeyStore) Save(ctx context.Context, key *APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = store.client.WithContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(redisAPIKey(key.Id), data, 0)
+		pipe.SAdd(redisAPIKeyIndex(""), key.Id)
+		if StringLenGtZero(key.UserId) {
+			pipe.SAdd(redisAPIKeyIndex(key.UserId), key.Id)
+		}
+		return nil
+	})
+	return err
+}
+
+func (store *redisAPIKeyStore) Revoke(ctx context.Context, id string, at time.Time) error {
+	return store.update(ctx, id, func(key *APIKey) { key.RevokedAt = at })
+}
+
+func (store *redisAPIKeyStore) Touch(ctx context.Context, id string, at time.Time) error {
+	return store.update(ctx, id, func(key *APIKey) { key.LastUsedAt = at })
+}
+
+// update is read-modify-write under WATCH, so a touch racing a revoke can't undo it. Conflicts are retried.
+func (store *redisAPIKeyStore) update(ctx context.Context, id string, change func(*APIKey)) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = store.updateOnce(ctx, id, change); err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+func (store *redisAPIKeyStore) updateOnce(ctx context.Context, id string, change func(*APIKey)) error {
+	client := store.client.WithContext(ctx)
+	return client.Watch(func(tx *redis.Tx) error {
+		data, err := tx.Get(redisAPIKey(id)).Bytes()
+		if err == redis.Nil {
+			return ErrAPIKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		key := &APIKey{}
+		if err := json.Unmarshal(data, key); err != nil {
+			return err
+		}
+		change(key)
+		if data, err = json.Marshal(key); err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(redisAPIKey(id), data, 0)
+			return nil
+		})
+		return err
+	}, redisAPIKey(id))
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type APIKeyApp struct {
+	MockApp
+}
+
+func (app *APIKeyApp) Title() string {
+	return "key-app"
+}
+
+func (app *APIKeyApp) Routes() []HttpAction {
+	handler := func(r *Request) *Response { return SuccessResponse(r.UserId) }
+	return []HttpAction{
+		{Action: "read", Handler: handler, AuthValidators: []AuthValidatorCallback{NewAPIKeyValidator()}},
+		{Action: "write", Handler: handler, Scopes: []string{"write"}, AuthValidators: []AuthValidatorCallback{NewAPIKeyValidator()}},
+		{Action: "admin", Handler: handler, AuthValidators: []AuthValidatorCallback{NewAuthTokenValidator()}},
+	}
+}
+
+func TestAPIKeyValidator(t *testing.T) {
+	s := NewService(&Config{AuthToken: "admin-token", APIKeys: &APIKeyConfig{Prefix: "test"}}, &[]App{&APIKeyApp{}})
+	s.initAPIKeys()
+	ctx := context.Background()
+
+	issue := func(template *APIKey) (string, *APIKey) {
+		key, record, err := s.IssueAPIKey(ctx, template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, record
+	}
+	reader, readerRecord := issue(&APIKey{Name: "reader", UserId: "user-1", Scopes: []string{"read"}})
+	writer, _ := issue(&APIKey{Name: "writer", Scopes: []string{"read", "write"}})
+	revoked, revokedRecord := issue(&APIKey{Name: "revoked"})
+	expired, _ := issue(&APIKey{Name: "expired", ExpiresAt: time.Now().Add(-time.Minute)})
+	limited, _ := issue(&APIKey{Name: "limited", RateLimit: 2})
+	s.APIKeys().Revoke(ctx, revokedRecord.Id, time.Now())
+
+	if !strings.HasPrefix(reader, readerRecord.Id+"_") || !strings.HasPrefix(reader, "test_") || readerRecord.Hash == reader {
+		t.Fatalf("unexpected key %s for record %+v", reader, readerRecord)
+	}
+
+	type input struct {
+		title     string
+		path      string
+		header    http.Header
+		expStatus int16
+		expBody   string
+	}
+
+	inputs := []input{
+		{title: "Valid key", path: "/key-app/read", header: http.Header{"X-Api-Key": {reader}}, expStatus: 200, expBody: "user-1"},
+		{title: "Key without user", path: "/key-app/read", header: http.Header{"X-Api-Key": {writer}}, expStatus: 200},
+		{title: "Scope granted", path: "/key-app/write", header: http.Header{"X-Api-Key": {writer}}, expStatus: 200},
+		{title: "Scope missing", path: "/key-app/write", header: http.Header{"X-Api-Key": {reader}}, expStatus: 403},
+		{title: "Wrong secret", path: "/key-app/read", header: http.Header{"X-Api-Key": {readerRecord.Id + "_" + strings.Repeat("0", 64)}}, expStatus: 401, expBody: "unknown api key"},
+		{title: "Unknown id", path: "/key-app/read", header: http.Header{"X-Api-Key": {"test_000000000000_" + strings.Repeat("0", 64)}}, expStatus: 401, expBody: "unknown api key"},
+		{title: "Malformed", path: "/key-app/read", header: http.Header{"X-Api-Key": {"nope"}}, expStatus: 401, expBody: "malformed api key"},
+		{title: "Revoked", path: "/key-app/read", header: http.Header{"X-Api-Key": {revoked}}, expStatus: 401, expBody: "revoked or expired"},
+		{title: "Expired", path: "/key-app/read", header: http.Header{"X-Api-Key": {expired}}, expStatus: 401, expBody: "revoked or expired"},
+		{title: "Missing", path: "/key-app/read", header: http.Header{}, expStatus: 401},
+		{title: "Admin token", path: "/key-app/admin", header: http.Header{"Authorization": {"Bearer admin-token"}}, expStatus: 200},
+		{title: "Wrong admin token", path: "/key-app/admin", header: http.Header{"Authorization": {"Bearer nope"}}, expStatus: 401},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: input.path}, Header: input.header})
+			if w.statusCode != input.expStatus {
+				t.Fatalf("expected %d got %d %s", input.expStatus, w.statusCode, w.dataWritten)
+			}
+			if !strings.Contains(w.dataWritten, input.expBody) {
+				t.Errorf("expected %s in %s", input.expBody, w.dataWritten)
+			}
+		})
+	}
+
+	t.Run("Rate limit", func(t *testing.T) {
+		statuses := []int16{}
+		var retryAfter string
+		for i := 0; i < 3; i++ {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: "/key-app/read"}, Header: http.Header{"X-Api-Key": {limited}}})
+			statuses = append(statuses, w.statusCode)
+			retryAfter = w.Header().Get("Retry-After")
+		}
+		if statuses[0] != 200 || statuses[1] != 200 || statuses[2] != 429 || retryAfter != "30" {
+			t.Errorf("expected 200, 200, 429 with Retry-After 30 got %v %s", statuses, retryAfter)
+		}
+	})
+
+	t.Run("Rate limit uses the service limiter", func(t *testing.T) {
+		limiter := &recordingLimiter{}
+		s := NewService(&Config{APIKeys: &APIKeyConfig{Prefix: "test"}}, &[]App{&APIKeyApp{}})
+		s.SetRateLimiter(limiter)
+		s.initAPIKeys()
+		key, record, _ := s.IssueAPIKey(ctx, &APIKey{Name: "limited", RateLimit: 2})
+
+		w := &MockResponseWriter{}
+		s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: "/key-app/read"}, Header: http.Header{"X-Api-Key": {key}}})
+		if w.statusCode != 200 || len(limiter.keys) != 1 || limiter.keys[0] != "api_key_quota:"+record.Id {
+			t.Errorf("expected the key's quota to be counted by the service limiter got %d %v", w.statusCode, limiter.keys)
+		}
+	})
+
+	t.Run("Init keeps a custom store", func(t *testing.T) {
+		store := NewMemoryAPIKeyStore(nil)
+		s := NewService(&Config{APIKeys: &APIKeyConfig{Store: RedisAPIKeyStore}}, &[]App{})
+		s.SetAPIKeyStore(store)
+		s.initAPIKeys()
+		if s.APIKeys() != store {
+			t.Error("expected the custom store to be kept")
+		}
+	})
+
+	t.Run("Last used", func(t *testing.T) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if record, _ := s.APIKeys().Find(ctx, readerRecord.Id); !record.LastUsedAt.IsZero() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("expected LastUsedAt to be recorded")
+	})
+
+	t.Run("List", func(t *testing.T) {
+		keys, _ := s.APIKeys().List(ctx, "user-1")
+		all, _ := s.APIKeys().List(ctx, "")
+		if len(keys) != 1 || keys[0].Name != "reader" || len(all) != 5 {
+			t.Errorf("unexpected keys %d %d", len(keys), len(all))
+		}
+	})
+}
+
+func TestAPIKeyValidatorPerService(t *testing.T) {
+	callback := NewAPIKeyValidator()
+	first := NewService(&Config{APIKeys: &APIKeyConfig{Prefix: "first"}}, &[]App{})
+	second := NewService(&Config{APIKeys: &APIKeyConfig{Prefix: "second", Header: "X-Second-Key"}}, &[]App{})
+	second.initAPIKeys()
+	key, _, err := second.IssueAPIKey(context.Background(), &APIKey{Name: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callback(first)
+	if !callback(second).Validate(&Request{Header: http.Header{"X-Second-Key": {key}}}).IsAuthenticated {
+		t.Error("expected second service to use its own header and store")
+	}
+	if callback(first) != callback(first) {
+		t.Error("expected the validator to be built once per service")
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	limiter := newMemoryLimiter()
+	for i := 0; i < 3; i++ {
+		if result := limiter.allow("key", 3, time.Second); !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("expected request %d to be allowed got %+v", i, result)
+		}
+	}
+	result := limiter.allow("key", 3, time.Second)
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > time.Second/3 {
+		t.Fatalf("expected limit with retry after a third of a second got %+v", result)
+	}
+	if !limiter.allow("other", 3, time.Second).Allowed {
+		t.Error("expected keys to have their own buckets")
+	}
+
+	time.Sleep(time.Second / 3)
+	if !limiter.allow("key", 3, time.Second).Allowed {
+		t.Error("expected bucket to refill")
+	}
+}
+
+// recordingLimiter allows everything and remembers the keys it counted.
+type recordingLimiter struct {
+	keys []string
+}
+
+func (limiter *recordingLimiter) Allow(ctx context.Context, key string, limit int, period time.Duration) (RateLimitResult, error) {
+	limiter.keys = append(limiter.keys, key)
+	return RateLimitResult{Allowed: true, Limit: limit, Remaining: limit - 1}, nil
+}
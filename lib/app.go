@@ -1,6 +1,9 @@
 package lib
 
-import "strings"
+import (
+	"sort"
+	"strings"
+)
 
 type QueueAction func(string, string, string) (func(string), error)
 type QueueRoute map[string]QueueAction
@@ -8,19 +11,37 @@ type QueueRoute map[string]QueueAction
 type HttpMethod string
 
 const (
-	GET    HttpMethod = "GET"
-	HEAD   HttpMethod = "HEAD"
-	POST   HttpMethod = "POST"
-	PUT    HttpMethod = "PUT"
-	PATCH  HttpMethod = "PATCH"
-	DELETE HttpMethod = "DELETE"
+	GET     HttpMethod = "GET"
+	HEAD    HttpMethod = "HEAD"
+	POST    HttpMethod = "POST"
+	PUT     HttpMethod = "PUT"
+	PATCH   HttpMethod = "PATCH"
+	DELETE  HttpMethod = "DELETE"
+	OPTIONS HttpMethod = "OPTIONS"
 )
 
 type HttpAction struct {
 	Action         string
 	Method         HttpMethod
+	Version        int // 0 serves every version, otherwise requests for this version onwards until a newer one is registered
 	Handler        func(*Request) *Response
+	SSEHandler     SSEHandler       // Serves text/event-stream instead of Handler when set
+	WSHandler      WebSocketHandler // Upgrades to websocket instead of Handler when set
 	AuthValidators []AuthValidatorCallback
+
+	// Checked after auth passes, failing any of them is a 403. See Principal.
+	Roles       []string         // Caller needs one of these
+	Scopes      []string         // Caller needs all of these
+	Permissions []string         // Caller needs all of these
+	Policies    []ResourcePolicy // Run last, for checks which depend on the request
+
+	RateLimit *RateLimit // Config.RateLimit rules for the app or action win over it
+
+	// Only used to document the route in the OpenAPI spec.
+	Summary      string
+	RequestType  any // Zero value of the JSON body handler decodes
+	QueryType    any // Struct whose fields are query params, `query` tag wins over `json`
+	ResponseType any // Zero value of the body returned on success
 }
 
 func (httpAction *HttpAction) Validate() {
@@ -32,9 +53,26 @@ func (httpAction *HttpAction) Validate() {
 	httpAction.Action = strings.TrimPrefix(httpAction.Action, "/")
 }
 
+// allowedMethods lists what a route answers to, HEAD comes with GET and OPTIONS is always served.
+func allowedMethods(methodMap map[HttpMethod]HttpAction) []string {
+	methods := []string{string(OPTIONS)}
+	for method := range methodMap {
+		if method != OPTIONS {
+			methods = append(methods, string(method))
+		}
+	}
+	if _, hasGet := methodMap[GET]; hasGet {
+		if _, hasHead := methodMap[HEAD]; !hasHead {
+			methods = append(methods, string(HEAD))
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
 // type MethodRoute map[HttpMethod]HttpAction
 
-type HttpRoute map[string]map[HttpMethod]HttpAction
+type HttpRoute map[string]map[HttpMethod]versionedActions
 
 type App interface {
 	Title() string
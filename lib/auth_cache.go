@@ -0,0 +1,391 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	defaultAuthCacheTTL      = 5 * time.Minute
+	defaultAuthCacheLocalTTL = 10 * time.Second
+)
+
+// authPayloadTypes are the payloads of validators in lib, read back from redis as their own type
+// so ClaimsFromAuth and principals keep working on cached results.
+var authPayloadTypes = map[string]func() any{
+	"*lib.JWTClaims":         func() any { return &JWTClaims{} },
+	"*lib.OktaAuth":          func() any { return &OktaAuth{} },
+	"*lib.APIKey":            func() any { return &APIKey{} },
+	"*lib.Session":           func() any { return &Session{} },
+	"*lib.ClientCertificate": func() any { return &ClientCertificate{} },
+}
+
+type AuthCacheOptions struct {
+	Name        string        // Namespace of cached results, defaults to the SecurityScheme name of the validator
+	TTL         time.Duration // Defaults to 5 minutes, never past the token's expiry
+	NegativeTTL time.Duration // How long rejections(Auth.Reason set) are cached, 0 doesn't cache them
+
+	// Redis shares results between replicas so InvalidateAuth works everywhere.
+	// LocalTTL also keeps a copy in process, invalidation on other replicas then lags by up to LocalTTL.
+	// Defaults to 10 seconds, negative reads redis on every request.
+	Redis    bool
+	LocalTTL time.Duration
+
+	// Credential picks what's hashed into the key, defaults to the header or cookie named by the SecurityScheme.
+	// An auth scheme in front("Bearer <token>") is dropped. Requests without a credential aren't cached.
+	Credential func(*Request) string
+	// Expiry caps TTL, defaults to JWT exp and APIKey.ExpiresAt.
+	Expiry func(Auth) time.Time
+	// DecodePayload turns the JSON of Auth.Payload back into its type when read from redis.
+	// Payloads of lib validators are decoded without it, others are json.RawMessage.
+	DecodePayload func([]byte) (any, error)
+}
+
+// cachedAuth is Auth as stored in redis.
+type cachedAuth struct {
+	IsAuthenticated bool            `json:"IsAuthenticated"`
+	UserId          string          `json:"UserId"`
+	Payload         json.RawMessage `json:"Payload"`
+	PayloadType     string          `json:"PayloadType"` // Go type of Payload, e.g. *lib.JWTClaims
+	Reason          string          `json:"Reason"`
+	Forbidden       bool            `json:"Forbidden"`
+}
+
+type authCacheEntry struct {
+	auth      Auth
+	expiresAt time.Time
+}
+
+// authCache holds results of every cached validator of a service, keyed auth-cache:<name>:<sha256 of credential>.
+type authCache struct {
+	mu        sync.Mutex
+	entries   map[string]authCacheEntry
+	names     map[string]bool
+	lastSweep time.Time
+}
+
+func (s *Service) authResults() *authCache {
+	s.authCacheOnce.Do(func() {
+		s.authCache = &authCache{entries: make(map[string]authCacheEntry), names: make(map[string]bool)}
+	})
+	return s.authCache
+}
+
+// authCredential drops the auth scheme so "Bearer <token>" and "<token>" are the same credential.
+func authCredential(credential string) string {
+	credential = strings.TrimSpace(credential)
+	if idx := strings.IndexByte(credential, ' '); idx >= 0 {
+		return strings.TrimSpace(credential[idx+1:])
+	}
+	return credential
+}
+
+func authCacheKey(name string, credential string) string {
+	sum := sha256.Sum256([]byte(authCredential(credential)))
+	return "auth-cache:" + name + ":" + hex.EncodeToString(sum[:])
+}
+
+func (cache *authCache) register(name string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.names[name] = true
+}
+
+func (cache *authCache) get(key string) (Auth, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, found := cache.entries[key]
+	if !found || time.Now().After(entry.expiresAt) {
+		return Auth{}, false
+	}
+	return entry.auth, true
+}
+
+func (cache *authCache) set(key string, auth Auth, ttl time.Duration) {
+	now := time.Now()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if now.Sub(cache.lastSweep) > limiterSweepInterval {
+		cache.lastSweep = now
+		for entryKey, entry := range cache.entries {
+			if now.After(entry.expiresAt) {
+				delete(cache.entries, entryKey)
+			}
+		}
+	}
+	cache.entries[key] = authCacheEntry{auth: auth, expiresAt: now.Add(ttl)}
+}
+
+// InvalidateAuth drops cached results for credential(e.g. a token on logout) from every cached validator,
+// with or without its auth scheme.
+func (s *Service) InvalidateAuth(ctx context.Context, credential string) error {
+	cache := s.authResults()
+	cache.mu.Lock()
+	keys := []string{}
+	for name := range cache.names {
+		key := authCacheKey(name, credential)
+		delete(cache.entries, key)
+		keys = append(keys, key)
+	}
+	cache.mu.Unlock()
+
+	if s.RedisClient == nil || len(keys) == 0 {
+		return nil
+	}
+	return s.RedisClient.WithContext(ctx).Del(keys...).Err()
+}
+
+type CachedAuthValidator struct {
+	service *Service
+	next    AuthValidatorCallback
+	options AuthCacheOptions
+	cache   *authCache
+}
+
+// NewCachedAuthValidator remembers what next returned for a credential, for validators that are slow
+// or call another service on every request. Rate limited and replay protected validators shouldn't be wrapped,
+// their checks would be skipped for cached credentials.
+func NewCachedAuthValidator(next AuthValidatorCallback, options AuthCacheOptions) AuthValidatorCallback {
+	var mu sync.Mutex
+	validators := make(map[*Service]*CachedAuthValidator)
+	return func(service *Service) AuthValidator {
+		mu.Lock()
+		defer mu.Unlock()
+		validator, found := validators[service]
+		if !found {
+			validator = service.newCachedAuthValidator(next, options)
+			validators[service] = validator
+		}
+		return validator
+	}
+}
+
+func (s *Service) newCachedAuthValidator(next AuthValidatorCallback, options AuthCacheOptions) *CachedAuthValidator {
+	validator := &CachedAuthValidator{service: s, next: next, options: options, cache: s.authResults()}
+	inner := next(s)
+	if !StringLenGtZero(validator.options.Name) {
+		validator.options.Name = reflect.TypeOf(inner).String()
+		if documented, isDocumented := inner.(DocumentedAuthValidator); isDocumented {
+			validator.options.Name, _ = documented.SecurityScheme()
+		}
+	}
+	if validator.options.TTL <= 0 {
+		validator.options.TTL = defaultAuthCacheTTL
+	}
+	if validator.options.LocalTTL == 0 {
+		validator.options.LocalTTL = defaultAuthCacheLocalTTL
+	}
+	if validator.options.Credential == nil {
+		validator.options.Credential = credentialOf(inner)
+	}
+	if validator.options.Expiry == nil {
+		validator.options.Expiry = authExpiry
+	}
+	validator.cache.register(validator.options.Name)
+	return validator
+}
+
+// Unwrap returns the cached validator, used for failure details and the OpenAPI spec.
+func (v *CachedAuthValidator) Unwrap() AuthValidator {
+	return v.next(v.service)
+}
+
+func (v *CachedAuthValidator) Validate(req *Request) Auth {
+	credential := authCredential(v.options.Credential(req))
+	if !StringLenGtZero(credential) {
+		return v.Unwrap().Validate(req)
+	}
+	key := authCacheKey(v.options.Name, credential)
+
+	if auth, found := v.load(req, key); found {
+		return auth
+	}
+
+	auth := v.Unwrap().Validate(req)
+	if ttl := v.ttl(auth); ttl > 0 {
+		v.store(req, key, auth, ttl)
+	}
+	return auth
+}
+
+// ttl is 0 for results that shouldn't be cached, failures without a reason may be transient(e.g. lookup errors).
+func (v *CachedAuthValidator) ttl(auth Auth) time.Duration {
+	if !auth.IsAuthenticated {
+		if auth.RetryAfter > 0 || !StringLenGtZero(auth.Reason) {
+			return 0
+		}
+		return v.options.NegativeTTL
+	}
+	ttl := v.options.TTL
+	if expiry := v.options.Expiry(auth); !expiry.IsZero() && time.Until(expiry) < ttl {
+		ttl = time.Until(expiry)
+	}
+	return ttl
+}
+
+func (v *CachedAuthValidator) localTTL(ttl time.Duration) time.Duration {
+	if !v.options.Redis {
+		return ttl
+	}
+	if v.options.LocalTTL < ttl {
+		return v.options.LocalTTL
+	}
+	return ttl
+}
+
+func (v *CachedAuthValidator) load(req *Request, key string) (Auth, bool) {
+	if auth, found := v.cache.get(key); found {
+		return auth, true
+	}
+	client := v.redis()
+	if client == nil {
+		return Auth{}, false
+	}
+
+	data, err := client.WithContext(req.Context()).Get(key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			req.Log().Error("reading auth cache failed", "error", err)
+		}
+		return Auth{}, false
+	}
+	auth, err := decodeCachedAuth(data, v.options.DecodePayload)
+	if err != nil {
+		req.Log().Error("decoding auth cache failed", "error", err)
+		return Auth{}, false
+	}
+
+	if ttl, err := client.WithContext(req.Context()).PTTL(key).Result(); err == nil && ttl > 0 {
+		if localTTL := v.localTTL(ttl); localTTL > 0 {
+			v.cache.set(key, auth, localTTL)
+		}
+	}
+	return auth, true
+}
+
+func (v *CachedAuthValidator) store(req *Request, key string, auth Auth, ttl time.Duration) {
+	if localTTL := v.localTTL(ttl); localTTL > 0 {
+		v.cache.set(key, auth, localTTL)
+	}
+	client := v.redis()
+	if client == nil {
+		return
+	}
+
+	data, err := encodeCachedAuth(auth)
+	if err != nil {
+		req.Log().Error("encoding auth cache failed", "error", err)
+		return
+	}
+	if err := client.WithContext(req.Context()).Set(key, data, ttl).Err(); err != nil {
+		req.Log().Error("writing auth cache failed", "error", err)
+	}
+}
+
+func encodeCachedAuth(auth Auth) ([]byte, error) {
+	payload, err := json.Marshal(auth.Payload)
+	if err != nil {
+		return nil, err
+	}
+	stored := cachedAuth{
+		IsAuthenticated: auth.IsAuthenticated,
+		UserId:          auth.UserId,
+		Payload:         payload,
+		Reason:          auth.Reason,
+		Forbidden:       auth.Forbidden,
+	}
+	if auth.Payload != nil {
+		stored.PayloadType = reflect.TypeOf(auth.Payload).String()
+	}
+	return json.Marshal(stored)
+}
+
+// decodeCachedAuth restores lib payloads to their type, others go through decode when set.
+func decodeCachedAuth(data []byte, decode func([]byte) (any, error)) (Auth, error) {
+	stored := cachedAuth{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return Auth{}, err
+	}
+	auth := Auth{IsAuthenticated: stored.IsAuthenticated, UserId: stored.UserId, Reason: stored.Reason, Forbidden: stored.Forbidden}
+	if len(stored.Payload) == 0 || string(stored.Payload) == "null" {
+		return auth, nil
+	}
+
+	if newPayload, isBuiltin := authPayloadTypes[stored.PayloadType]; isBuiltin {
+		payload := newPayload()
+		if err := json.Unmarshal(stored.Payload, payload); err != nil {
+			return Auth{}, err
+		}
+		auth.Payload = payload
+		return auth, nil
+	}
+	if decode == nil {
+		auth.Payload = stored.Payload
+		return auth, nil
+	}
+	payload, err := decode(stored.Payload)
+	if err != nil {
+		return Auth{}, err
+	}
+	auth.Payload = payload
+	return auth, nil
+}
+
+func (v *CachedAuthValidator) redis() *redis.Client {
+	if !v.options.Redis {
+		return nil
+	}
+	return v.service.RedisClient
+}
+
+// credentialOf reads the credential where validator's SecurityScheme says it's sent, Authorization otherwise.
+func credentialOf(validator AuthValidator) func(*Request) string {
+	fromHeader := func(name string) func(*Request) string {
+		return func(req *Request) string {
+			if val := req.GetHeaderVal(name); val != nil {
+				return *val
+			}
+			return ""
+		}
+	}
+
+	documented, isDocumented := validator.(DocumentedAuthValidator)
+	if !isDocumented {
+		return fromHeader("Authorization")
+	}
+	_, scheme := documented.SecurityScheme()
+	if scheme.Type != "apiKey" {
+		return fromHeader("Authorization")
+	}
+	switch scheme.In {
+	case "cookie":
+		return func(req *Request) string {
+			if cookie, err := req.Cookie(scheme.Name); err == nil {
+				return cookie.Value
+			}
+			return ""
+		}
+	case "query":
+		return func(req *Request) string { return req.Query.Get(scheme.Name) }
+	}
+	return fromHeader(scheme.Name)
+}
+
+// authExpiry is when a successful Auth stops being valid, zero when unknown.
+func authExpiry(auth Auth) time.Time {
+	if claims := ClaimsFromAuth(auth); claims != nil {
+		return claims.ExpiresAt
+	}
+	if key, isAPIKey := auth.Payload.(*APIKey); isAPIKey {
+		return key.ExpiresAt
+	}
+	return time.Time{}
+}
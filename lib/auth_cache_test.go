@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestCachedAuthValidator(t *testing.T) {
+	request := func(token string) *Request {
+		return &Request{Header: http.Header{"Authorization": {"Bearer " + token}}}
+	}
+
+	type input struct {
+		title    string
+		auth     Auth
+		options  AuthCacheOptions
+		requests []string // Tokens sent in order
+		wait     time.Duration
+		expCalls int
+	}
+
+	inputs := []input{
+		{title: "Success is cached per credential", auth: Auth{IsAuthenticated: true, UserId: "u"}, requests: []string{"a", "a", "b", "a"}, expCalls: 2},
+		{title: "Rejection isn't cached by default", auth: Auth{Reason: "invalid token"}, requests: []string{"a", "a"}, expCalls: 2},
+		{title: "Negative caching", auth: Auth{Reason: "invalid token"}, options: AuthCacheOptions{NegativeTTL: time.Minute}, requests: []string{"a", "a"}, expCalls: 1},
+		{title: "Failure without reason isn't cached", auth: Auth{}, options: AuthCacheOptions{NegativeTTL: time.Minute}, requests: []string{"a", "a"}, expCalls: 2},
+		{title: "Rate limited isn't cached", auth: Auth{Reason: "slow down", RetryAfter: time.Second}, options: AuthCacheOptions{NegativeTTL: time.Minute}, requests: []string{"a", "a"}, expCalls: 2},
+		{title: "No credential isn't cached", auth: Auth{IsAuthenticated: true}, requests: []string{"", ""}, expCalls: 2},
+		{title: "TTL expires", auth: Auth{IsAuthenticated: true}, options: AuthCacheOptions{TTL: 20 * time.Millisecond}, requests: []string{"a", "a"}, wait: 30 * time.Millisecond, expCalls: 2},
+		{
+			title:    "TTL bounded by token expiry",
+			auth:     Auth{IsAuthenticated: true, Payload: &JWTClaims{ExpiresAt: time.Now().Add(20 * time.Millisecond)}},
+			requests: []string{"a", "a"},
+			wait:     30 * time.Millisecond,
+			expCalls: 2,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			s := NewService(&Config{}, &[]App{})
+			counting := &countingValidator{auth: input.auth, scheme: "bearer"}
+			validator := NewCachedAuthValidator(counting.callback(), input.options)(s)
+
+			for idx, token := range input.requests {
+				if idx > 0 {
+					time.Sleep(input.wait)
+				}
+				req := request(token)
+				if token == "" {
+					req.Header = http.Header{}
+				}
+				if auth := validator.Validate(req); auth.IsAuthenticated != input.auth.IsAuthenticated || auth.Reason != input.auth.Reason {
+					t.Fatalf("expected %+v got %+v", input.auth, auth)
+				}
+			}
+			if counting.calls != input.expCalls {
+				t.Errorf("expected %d calls got %d", input.expCalls, counting.calls)
+			}
+		})
+	}
+
+	t.Run("Invalidate", func(t *testing.T) {
+		for _, credential := range []string{"a", "Bearer a"} {
+			s := NewService(&Config{}, &[]App{})
+			counting := &countingValidator{auth: Auth{IsAuthenticated: true}, scheme: "bearer"}
+			validator := NewCachedAuthValidator(counting.callback(), AuthCacheOptions{})(s)
+
+			validator.Validate(request("a"))
+			validator.Validate(request("b"))
+			if err := s.InvalidateAuth(context.Background(), credential); err != nil {
+				t.Fatal(err)
+			}
+			validator.Validate(request("a"))
+			validator.Validate(request("b"))
+			if counting.calls != 3 {
+				t.Errorf("expected only the invalidated token(%s) to be validated again, got %d calls", credential, counting.calls)
+			}
+		}
+	})
+
+	t.Run("Payloads from redis keep their type", func(t *testing.T) {
+		claims := &JWTClaims{Subject: "u", Scopes: []string{"orders:read"}, ExpiresAt: time.Now().UTC().Truncate(time.Second)}
+		payloads := []any{claims, &OktaAuth{JWTClaims: claims, Groups: []string{"admins"}}, &APIKey{Id: "k", Scopes: []string{"orders:read"}}, &Session{Id: "s", Roles: []string{"admin"}}, &ClientCertificate{CommonName: "orders"}}
+		for _, payload := range payloads {
+			data, err := encodeCachedAuth(Auth{IsAuthenticated: true, UserId: "u", Payload: payload})
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth, err := decodeCachedAuth(data, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(auth.Payload, payload) {
+				t.Errorf("expected %#v got %#v", payload, auth.Payload)
+			}
+		}
+
+		data, _ := encodeCachedAuth(Auth{IsAuthenticated: true, Payload: map[string]string{"team": "core"}})
+		if auth, _ := decodeCachedAuth(data, nil); string(auth.Payload.(json.RawMessage)) != `{"team":"core"}` {
+			t.Errorf("expected other payloads to stay raw got %#v", auth.Payload)
+		}
+	})
+
+	t.Run("Failure details come from the wrapped validator", func(t *testing.T) {
+		s := NewService(&Config{}, &[]App{})
+		counting := &countingValidator{auth: Auth{Reason: "invalid token"}, scheme: "bearer"}
+		_, failures := (&authPolicy{service: s, validators: []AuthValidatorCallback{NewCachedAuthValidator(counting.callback(), AuthCacheOptions{})}}).check(request("a"))
+		if len(failures) != 1 || failures[0].Scheme != "bearer" || failures[0].challenge == "" {
+			t.Errorf("unexpected failures %+v", failures)
+		}
+	})
+}
+
+func TestCachedAuthValidatorPerService(t *testing.T) {
+	callback := NewCachedAuthValidator(NewJWTValidator(nil), AuthCacheOptions{})
+	first := NewService(&Config{JWT: &JWTConfig{HMACSecret: "first"}}, &[]App{})
+	second := NewService(&Config{JWT: &JWTConfig{HMACSecret: "second"}}, &[]App{})
+	claims := jwt.MapClaims{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if !callback(first).Validate(bearerReq(signJWT(t, jwt.SigningMethodHS256, "", []byte("first"), claims))).IsAuthenticated {
+		t.Error("expected first service to use its own validator")
+	}
+	if !callback(second).Validate(bearerReq(signJWT(t, jwt.SigningMethodHS256, "", []byte("second"), claims))).IsAuthenticated {
+		t.Error("expected second service to use its own validator")
+	}
+	if callback(first) != callback(first) {
+		t.Error("expected the validator to be built once per service")
+	}
+}
@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// AuthFailure says which scheme rejected the request and why, sent to clients as details of 401/403 responses.
+type AuthFailure struct {
+	Scheme string `json:"Scheme,omitempty"`
+	Reason string `json:"Reason,omitempty"`
+
+	challenge string
+}
+
+// AuthChallenger lets validators pick their own WWW-Authenticate challenge,
+// otherwise it's derived from the SecurityScheme of DocumentedAuthValidator.
+type AuthChallenger interface {
+	Challenge(auth Auth) string
+}
+
+// wrappedAuthValidator is implemented by validators that decorate another one, e.g. CachedAuthValidator.
+// Failure details and the OpenAPI spec describe the wrapped validator.
+type wrappedAuthValidator interface {
+	Unwrap() AuthValidator
+}
+
+func unwrapValidator(validator AuthValidator) AuthValidator {
+	for {
+		wrapped, isWrapped := validator.(wrappedAuthValidator)
+		if !isWrapped {
+			return validator
+		}
+		validator = wrapped.Unwrap()
+	}
+}
+
+type authPolicy struct {
+	all        bool
+	service    *Service
+	validators []AuthValidatorCallback
+}
+
+// AnyOf passes when one of validators does, stopping at the first success so expensive validators go last.
+// HttpAction.AuthValidators is an AnyOf.
+func AnyOf(validators ...AuthValidatorCallback) AuthValidatorCallback {
+	return func(service *Service) AuthValidator {
+		return &authPolicy{service: service, validators: validators}
+	}
+}
+
+// AllOf passes when every validator does, stopping at the first failure.
+// Auth(user id, payload) comes from the first validator, the rest only gate the request.
+func AllOf(validators ...AuthValidatorCallback) AuthValidatorCallback {
+	return func(service *Service) AuthValidator {
+		return &authPolicy{all: true, service: service, validators: validators}
+	}
+}
+
+func (policy *authPolicy) Validate(req *Request) Auth {
+	auth, _ := policy.check(req)
+	return auth
+}
+
+// check returns failures of the validators it ran, empty when auth passed.
+func (policy *authPolicy) check(req *Request) (Auth, []AuthFailure) {
+	failures := []AuthFailure{}
+	result := Auth{}
+
+	for idx, callback := range policy.validators {
+		validator := callback(policy.service)
+
+		var auth Auth
+		var validatorFailures []AuthFailure
+		if nested, isPolicy := validator.(*authPolicy); isPolicy {
+			auth, validatorFailures = nested.check(req)
+		} else {
+			auth = validator.Validate(req)
+			if !auth.IsAuthenticated {
+				validatorFailures = []AuthFailure{authFailure(validator, auth)}
+			}
+		}
+
+		if policy.all {
+			if !auth.IsAuthenticated {
+				return auth, validatorFailures
+			}
+			if idx == 0 {
+				result = auth
+			}
+			continue
+		}
+
+		if auth.IsAuthenticated {
+			return auth, nil
+		}
+		failures = append(failures, validatorFailures...)
+		// Someone who was identified but not allowed stays forbidden even when other schemes fail with 401.
+		result.Forbidden = result.Forbidden || auth.Forbidden
+		if auth.RetryAfter > result.RetryAfter {
+			result.RetryAfter = auth.RetryAfter
+		}
+	}
+
+	if policy.all && len(policy.validators) > 0 {
+		return result, nil
+	}
+	return result, failures
+}
+
+func authFailure(validator AuthValidator, auth Auth) AuthFailure {
+	failure := AuthFailure{Reason: auth.Reason}
+	validator = unwrapValidator(validator)
+
+	documented, isDocumented := validator.(DocumentedAuthValidator)
+	if isDocumented {
+		name, scheme := documented.SecurityScheme()
+		failure.Scheme = name
+		failure.challenge = challengeFor(scheme)
+	}
+	if challenger, isChallenger := validator.(AuthChallenger); isChallenger {
+		failure.challenge = challenger.Challenge(auth)
+		if !isDocumented {
+			failure.Scheme = reflect.TypeOf(validator).String()
+		}
+	}
+	if StringLenGtZero(failure.challenge) && StringLenGtZero(auth.Reason) {
+		separator := " "
+		if strings.Contains(failure.challenge, " ") {
+			separator = ", "
+		}
+		failure.challenge += separator + fmt.Sprintf(`error="invalid_token", error_description=%q`, auth.Reason)
+	}
+	return failure
+}
+
+// challengeFor maps OpenAPI schemes to WWW-Authenticate auth schemes, apiKey has no standard one.
+func challengeFor(scheme SecurityScheme) string {
+	switch scheme.Type {
+	case "http":
+		if len(scheme.Scheme) == 0 {
+			return ""
+		}
+		return strings.ToUpper(scheme.Scheme[:1]) + scheme.Scheme[1:]
+	case "oauth2", "openIdConnect":
+		return "Bearer"
+	}
+	return ""
+}
+
+// authFailedResponse is 429 when a validator identified the caller but they're over a limit,
+// 403 when it identified them but didn't allow them and 401 with challenges otherwise.
+func authFailedResponse(auth Auth, failures []AuthFailure) *Response {
+	if auth.RetryAfter > 0 {
+		return TooManyRequestsResponse(auth.RetryAfter)
+	}
+	resp := AuthFailedResponse()
+	if auth.Forbidden {
+		resp = ForbiddenResponse()
+	}
+
+	details := []AuthFailure{}
+	for _, failure := range failures {
+		if StringLenGtZero(failure.Scheme) || StringLenGtZero(failure.Reason) {
+			details = append(details, failure)
+		}
+	}
+	if len(details) > 0 {
+		resp.WithDetails(details)
+	}
+	if auth.Forbidden {
+		return resp
+	}
+	for _, failure := range failures {
+		if !StringLenGtZero(failure.challenge) {
+			continue
+		}
+		if resp.Header == nil {
+			resp.Header = make(http.Header)
+		}
+		resp.Header.Add("WWW-Authenticate", failure.challenge)
+	}
+	return resp
+}
@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+type countingValidator struct {
+	auth   Auth
+	scheme string
+	calls  int
+}
+
+func (v *countingValidator) Validate(req *Request) Auth {
+	v.calls++
+	return v.auth
+}
+
+func (v *countingValidator) SecurityScheme() (string, SecurityScheme) {
+	return v.scheme, SecurityScheme{Type: "http", Scheme: "bearer"}
+}
+
+func (v *countingValidator) callback() AuthValidatorCallback {
+	return func(s *Service) AuthValidator { return v }
+}
+
+func TestAuthPolicies(t *testing.T) {
+	s := NewService(&Config{}, &[]App{})
+
+	type input struct {
+		title        string
+		policy       func(pass, fail, forbid *countingValidator) AuthValidatorCallback
+		expAuth      bool
+		expUser      string
+		expForbidden bool
+		expFailures  []AuthFailure
+		expCalls     [3]int // pass, fail, forbid
+	}
+
+	inputs := []input{
+		{
+			title: "AnyOf stops at first success",
+			policy: func(pass, fail, forbid *countingValidator) AuthValidatorCallback {
+				return AnyOf(pass.callback(), fail.callback())
+			},
+			expAuth:  true,
+			expUser:  "pass",
+			expCalls: [3]int{1, 0, 0},
+		},
+		{
+			title: "AnyOf tries the rest",
+			policy: func(pass, fail, forbid *countingValidator) AuthValidatorCallback {
+				return AnyOf(fail.callback(), pass.callback())
+			},
+			expAuth:  true,
+			expUser:  "pass",
+			expCalls: [3]int{1, 1, 0},
+		},
+		{
+			title: "AnyOf collects failures",
+			policy: func(pass, fail, forbid *countingValidator) AuthValidatorCallback {
+				return AnyOf(fail.callback(), forbid.callback())
+			},
+			expForbidden: true,
+			expFailures:  []AuthFailure{{Scheme: "fail", Reason: "expired"}, {Scheme: "forbid", Reason: "wrong group"}},
+			expCalls:     [3]int{0, 1, 1},
+		},
+		{
+			title: "AllOf stops at first failure",
+			policy: func(pass, fail, forbid *countingValidator) AuthValidatorCallback {
+				return AllOf(fail.callback(), pass.callback())
+			},
+			expFailures: []AuthFailure{{Scheme: "fail", Reason: "expired"}},
+			expCalls:    [3]int{0, 1, 0},
+		},
+		{
+			title: "AllOf keeps auth of the first validator",
+			policy: func(pass, fail, forbid *countingValidator) AuthValidatorCallback {
+				other := &countingValidator{auth: Auth{IsAuthenticated: true, UserId: "other"}}
+				return AllOf(pass.callback(), other.callback())
+			},
+			expAuth:  true,
+			expUser:  "pass",
+			expCalls: [3]int{1, 0, 0},
+		},
+		{
+			title: "Nested",
+			policy: func(pass, fail, forbid *countingValidator) AuthValidatorCallback {
+				return AnyOf(AllOf(pass.callback(), fail.callback()), AllOf(pass.callback(), pass.callback()))
+			},
+			expAuth:  true,
+			expUser:  "pass",
+			expCalls: [3]int{3, 1, 0},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			pass := &countingValidator{scheme: "pass", auth: Auth{IsAuthenticated: true, UserId: "pass"}}
+			fail := &countingValidator{scheme: "fail", auth: Auth{Reason: "expired"}}
+			forbid := &countingValidator{scheme: "forbid", auth: Auth{Forbidden: true, Reason: "wrong group"}}
+
+			auth, failures := input.policy(pass, fail, forbid)(s).(*authPolicy).check(&Request{})
+			if auth.IsAuthenticated != input.expAuth || auth.UserId != input.expUser || auth.Forbidden != input.expForbidden {
+				t.Errorf("unexpected auth %+v", auth)
+			}
+			for idx := range failures {
+				failures[idx].challenge = ""
+			}
+			if len(failures) != len(input.expFailures) || (len(failures) > 0 && !reflect.DeepEqual(failures, input.expFailures)) {
+				t.Errorf("expected failures %+v got %+v", input.expFailures, failures)
+			}
+			if got := [3]int{pass.calls, fail.calls, forbid.calls}; got != input.expCalls {
+				t.Errorf("expected calls %v got %v", input.expCalls, got)
+			}
+		})
+	}
+}
+
+type PolicyApp struct {
+	MockApp
+}
+
+func (app *PolicyApp) Title() string {
+	return "policy-app"
+}
+
+func (app *PolicyApp) Routes() []HttpAction {
+	handler := func(r *Request) *Response { return SuccessResponse("OK") }
+	expired := &countingValidator{scheme: "bearerAuth", auth: Auth{Reason: "expired"}}
+	forbidden := &countingValidator{scheme: "bearerAuth", auth: Auth{Forbidden: true, Reason: "wrong group"}}
+	return []HttpAction{
+		{Action: "expired", Handler: handler, AuthValidators: []AuthValidatorCallback{expired.callback(), NewMockAuthValidator(Auth{})}},
+		{Action: "forbidden", Handler: handler, AuthValidators: []AuthValidatorCallback{forbidden.callback()}},
+	}
+}
+
+func TestAuthFailedResponses(t *testing.T) {
+	s := NewService(&Config{}, &[]App{&PolicyApp{}})
+
+	type input struct {
+		title        string
+		path         string
+		expStatus    int16
+		expCode      string
+		expChallenge []string
+	}
+
+	inputs := []input{
+		{
+			title:        "Unauthorized with challenge",
+			path:         "/policy-app/expired",
+			expStatus:    401,
+			expCode:      "auth_failed",
+			expChallenge: []string{`Bearer error="invalid_token", error_description="expired"`},
+		},
+		{
+			title:     "Forbidden",
+			path:      "/policy-app/forbidden",
+			expStatus: 403,
+			expCode:   "forbidden",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: input.path}, Header: http.Header{}})
+			if w.statusCode != input.expStatus {
+				t.Fatalf("expected %d got %d", input.expStatus, w.statusCode)
+			}
+			if got := w.Header().Values("WWW-Authenticate"); !reflect.DeepEqual(got, input.expChallenge) {
+				t.Errorf("expected challenge %v got %v", input.expChallenge, got)
+			}
+			var body struct {
+				Code    string
+				Details []AuthFailure
+			}
+			json.Unmarshal([]byte(w.dataWritten), &body)
+			if body.Code != input.expCode || len(body.Details) != 1 || body.Details[0].Scheme != "bearerAuth" {
+				t.Errorf("unexpected body %s", w.dataWritten)
+			}
+		})
+	}
+}
+
+func TestAuthPolicySecurityRequirements(t *testing.T) {
+	s := NewService(&Config{}, &[]App{})
+	doc := &openAPIDoc{Components: openAPIComponents{SecuritySchemes: map[string]SecurityScheme{}}}
+	operation := &openAPIOperation{}
+
+	jwt := &countingValidator{scheme: "jwt"}
+	apiKey := &countingValidator{scheme: "apiKey"}
+	mtls := &countingValidator{scheme: "mtls"}
+	policy := AnyOf(AllOf(jwt.callback(), mtls.callback()), apiKey.callback(), NewMockAuthValidator(Auth{}))
+
+	got := s.securityRequirements(doc, operation, policy(s))
+	exp := []map[string][]string{{"jwt": {}, "mtls": {}}, {"apiKey": {}}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v got %v", exp, got)
+	}
+	if !reflect.DeepEqual(operation.XAuthValidators, []string{"*lib.MockAuthValidator"}) {
+		t.Errorf("expected undocumented validator got %v", operation.XAuthValidators)
+	}
+}
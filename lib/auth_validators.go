@@ -1,8 +1,19 @@
 package lib
 
+import (
+	"crypto/subtle"
+	"time"
+)
+
 type Auth struct {
 	IsAuthenticated bool
+	UserId          string // Identity of the caller, used for logging and auditing
 	Payload         any
+
+	Reason    string // Why validation failed, sent back to the client so keep it generic e.g. "token expired"
+	Forbidden bool   // Caller was identified but isn't allowed in, answered with 403 instead of 401
+	// Caller was identified but is over a rate limit, answered with 429 and Retry-After
+	RetryAfter time.Duration
 }
 
 type AuthValidator interface {
@@ -26,3 +37,30 @@ func NewMockAuthValidator(auth Auth) AuthValidatorCallback {
 		}
 	}
 }
+
+// AuthTokenValidator accepts Config.AuthToken as a bearer token, meant for internal and admin routes.
+// Nothing gets through when AuthToken isn't set.
+type AuthTokenValidator struct {
+	token string
+}
+
+func NewAuthTokenValidator() AuthValidatorCallback {
+	return func(service *Service) AuthValidator {
+		return &AuthTokenValidator{token: service.Config.AuthToken}
+	}
+}
+
+func (v *AuthTokenValidator) SecurityScheme() (string, SecurityScheme) {
+	return "authToken", SecurityScheme{Type: "http", Scheme: "bearer", Description: "Config.AuthToken"}
+}
+
+func (v *AuthTokenValidator) Validate(req *Request) Auth {
+	token := bearerToken(req)
+	if !StringLenGtZero(token) || !StringLenGtZero(v.token) {
+		return Auth{}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(v.token)) != 1 {
+		return Auth{Reason: "invalid token"}
+	}
+	return Auth{IsAuthenticated: true, UserId: "auth-token"}
+}
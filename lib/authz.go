@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Principal is what the caller is allowed to do, resolved from Auth once per request.
+type Principal struct {
+	Roles       []string
+	Scopes      []string
+	Permissions []string
+}
+
+// PrincipalPayload lets custom Auth.Payload types describe themselves to the default resolver.
+type PrincipalPayload interface {
+	Principal() *Principal
+}
+
+// PrincipalResolver turns Auth into a Principal, errors answer 500. Set with Service.SetPrincipalResolver.
+type PrincipalResolver func(req *Request) (*Principal, error)
+
+// ResourcePolicy runs after role, scope and permission checks, e.g. only owners can edit an order.
+// Return false to answer 403.
+type ResourcePolicy func(req *Request, principal *Principal) bool
+
+// AuthzFailure lists what the caller was missing, sent as details of 403 responses.
+type AuthzFailure struct {
+	Roles       []string `json:"Roles,omitempty"` // Any one of these would have done
+	Scopes      []string `json:"Scopes,omitempty"`
+	Permissions []string `json:"Permissions,omitempty"`
+}
+
+func (principal *Principal) HasRole(roles ...string) bool {
+	return hasCommon(principal.Roles, roles)
+}
+
+func (principal *Principal) HasScopes(scopes ...string) bool {
+	return len(missing(principal.Scopes, scopes)) == 0
+}
+
+func (principal *Principal) HasPermissions(permissions ...string) bool {
+	return len(missing(principal.Permissions, permissions)) == 0
+}
+
+// SetPrincipalResolver replaces DefaultPrincipalResolver, e.g. to load permissions of a role from the database.
+func (s *Service) SetPrincipalResolver(resolver PrincipalResolver) {
+	s.principalResolver = resolver
+}
+
+// DefaultPrincipalResolver reads JWT claims(roles or groups, scope or scp, permissions), Okta groups as roles
+// and payloads implementing PrincipalPayload.
+func DefaultPrincipalResolver(req *Request) (*Principal, error) {
+	switch payload := req.Auth.Payload.(type) {
+	case PrincipalPayload:
+		return payload.Principal(), nil
+	case *OktaAuth:
+		principal := claimsPrincipal(payload.JWTClaims)
+		principal.Roles = append(principal.Roles, payload.Groups...)
+		return principal, nil
+	case *JWTClaims:
+		return claimsPrincipal(payload), nil
+	}
+	return &Principal{}, nil
+}
+
+func claimsPrincipal(claims *JWTClaims) *Principal {
+	principal := &Principal{Scopes: claims.Scopes}
+	for _, claim := range []string{"roles", "groups"} {
+		if roles, err := stringOrList(claims.Raw[claim]); err == nil {
+			principal.Roles = append(principal.Roles, roles...)
+		}
+	}
+	principal.Permissions, _ = stringOrList(claims.Raw["permissions"])
+	return principal
+}
+
+// Principal resolves and caches the caller's roles, scopes and permissions on req.
+// Handlers use it for checks which need the resource loaded first.
+func (s *Service) Principal(req *Request) (*Principal, error) {
+	if req.Principal != nil {
+		return req.Principal, nil
+	}
+	if !req.Auth.IsAuthenticated {
+		return &Principal{}, nil
+	}
+
+	resolver := s.principalResolver
+	if resolver == nil {
+		resolver = DefaultPrincipalResolver
+	}
+	principal, err := resolver(req)
+	if err != nil {
+		return nil, err
+	}
+	req.Principal = principal
+	return principal, nil
+}
+
+// authorize checks HttpAction requirements once auth passed, nil means the handler can run.
+func (s *Service) authorize(req *Request, httpAction *HttpAction) *Response {
+	requiresGrants := len(httpAction.Roles) > 0 || len(httpAction.Scopes) > 0 || len(httpAction.Permissions) > 0
+	if !requiresGrants && len(httpAction.Policies) == 0 {
+		return nil
+	}
+	if requiresGrants && !req.Auth.IsAuthenticated {
+		// Requirements without validators, nobody is identified so nobody qualifies.
+		return AuthFailedResponse()
+	}
+
+	principal, err := s.Principal(req)
+	if err != nil {
+		return ErrorResponse(fmt.Errorf("resolving principal: %w", err))
+	}
+
+	failure := AuthzFailure{
+		Scopes:      missing(principal.Scopes, httpAction.Scopes),
+		Permissions: missing(principal.Permissions, httpAction.Permissions),
+	}
+	if len(httpAction.Roles) > 0 && !principal.HasRole(httpAction.Roles...) {
+		failure.Roles = httpAction.Roles
+	}
+	if len(failure.Roles) > 0 || len(failure.Scopes) > 0 || len(failure.Permissions) > 0 {
+		req.Log().Info("authorization failed", "missing_roles", failure.Roles, "missing_scopes", failure.Scopes, "missing_permissions", failure.Permissions)
+		resp := ForbiddenResponse().WithDetails(failure)
+		if len(failure.Scopes) > 0 {
+			// RFC 6750, tells OAuth clients which scopes to ask for.
+			resp.SetHeader("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(httpAction.Scopes, " ")))
+		}
+		return resp
+	}
+
+	for _, policy := range httpAction.Policies {
+		if !policy(req, principal) {
+			req.Log().Info("resource policy denied access")
+			return ForbiddenResponse()
+		}
+	}
+	return nil
+}
+
+// missing returns required values not in granted.
+func missing(granted []string, required []string) []string {
+	result := []string{}
+	for _, value := range required {
+		if !hasCommon(granted, []string{value}) {
+			result = append(result, value)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
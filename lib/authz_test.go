@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+type staffPayload struct {
+	team string
+}
+
+func (payload *staffPayload) Principal() *Principal {
+	return &Principal{Roles: []string{"staff"}, Permissions: []string{"orders.read"}}
+}
+
+type AuthzApp struct {
+	MockApp
+}
+
+func (app *AuthzApp) Title() string {
+	return "authz-app"
+}
+
+func (app *AuthzApp) Routes() []HttpAction {
+	handler := func(r *Request) *Response { return SuccessResponse("OK") }
+	jwtAuth := NewMockAuthValidator(Auth{IsAuthenticated: true, Payload: &JWTClaims{
+		Scopes: []string{"orders.read"},
+		Raw:    map[string]any{"roles": []any{"admin"}, "permissions": []any{"orders.delete"}},
+	}})
+	staffAuth := NewMockAuthValidator(Auth{IsAuthenticated: true, Payload: &staffPayload{team: "east"}})
+	ownTeam := func(req *Request, principal *Principal) bool {
+		return req.Query.Get("team") == req.Auth.Payload.(*staffPayload).team
+	}
+
+	return []HttpAction{
+		{Action: "admin", Handler: handler, Roles: []string{"support", "admin"}, AuthValidators: []AuthValidatorCallback{jwtAuth}},
+		{Action: "superuser", Handler: handler, Roles: []string{"superuser"}, AuthValidators: []AuthValidatorCallback{jwtAuth}},
+		{Action: "write", Handler: handler, Scopes: []string{"orders.read", "orders.write"}, AuthValidators: []AuthValidatorCallback{jwtAuth}},
+		{Action: "delete", Handler: handler, Permissions: []string{"orders.delete"}, AuthValidators: []AuthValidatorCallback{jwtAuth}},
+		{Action: "staff", Handler: handler, Roles: []string{"staff"}, Permissions: []string{"orders.read"}, AuthValidators: []AuthValidatorCallback{staffAuth}},
+		{Action: "team", Handler: handler, Policies: []ResourcePolicy{ownTeam}, AuthValidators: []AuthValidatorCallback{staffAuth}},
+		{Action: "anonymous", Handler: handler, Roles: []string{"admin"}},
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	s := NewService(&Config{}, &[]App{&AuthzApp{}})
+
+	type input struct {
+		title        string
+		path         string
+		query        string
+		expStatus    int16
+		expDetails   *AuthzFailure
+		expChallenge string
+	}
+
+	inputs := []input{
+		{title: "Has one of the roles", path: "/authz-app/admin", expStatus: 200},
+		{title: "Missing role", path: "/authz-app/superuser", expStatus: 403, expDetails: &AuthzFailure{Roles: []string{"superuser"}}},
+		{
+			title:        "Missing scope",
+			path:         "/authz-app/write",
+			expStatus:    403,
+			expDetails:   &AuthzFailure{Scopes: []string{"orders.write"}},
+			expChallenge: `Bearer error="insufficient_scope", scope="orders.read orders.write"`,
+		},
+		{title: "Permission from claims", path: "/authz-app/delete", expStatus: 200},
+		{title: "Principal payload", path: "/authz-app/staff", expStatus: 200},
+		{title: "Policy allows", path: "/authz-app/team", query: "team=east", expStatus: 200},
+		{title: "Policy denies", path: "/authz-app/team", query: "team=west", expStatus: 403},
+		{title: "Requirements without auth", path: "/authz-app/anonymous", expStatus: 401},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: input.path, RawQuery: input.query}, Header: http.Header{}})
+			if w.statusCode != input.expStatus {
+				t.Fatalf("expected %d got %d %s", input.expStatus, w.statusCode, w.dataWritten)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != input.expChallenge {
+				t.Errorf("expected challenge %q got %q", input.expChallenge, got)
+			}
+			if input.expDetails == nil {
+				return
+			}
+			var body struct {
+				Code    string
+				Details *AuthzFailure
+			}
+			json.Unmarshal([]byte(w.dataWritten), &body)
+			if body.Code != "forbidden" || !reflect.DeepEqual(body.Details, input.expDetails) {
+				t.Errorf("unexpected body %s", w.dataWritten)
+			}
+		})
+	}
+}
+
+func TestPrincipalResolver(t *testing.T) {
+	s := NewService(&Config{}, &[]App{&AuthzApp{}})
+	resolved := 0
+	s.SetPrincipalResolver(func(req *Request) (*Principal, error) {
+		resolved++
+		if req.Auth.Payload == nil {
+			return nil, errors.New("db down")
+		}
+		return &Principal{Roles: []string{"superuser"}}, nil
+	})
+
+	w := &MockResponseWriter{}
+	s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: "/authz-app/superuser"}, Header: http.Header{}})
+	if w.statusCode != 200 || resolved != 1 {
+		t.Errorf("expected custom resolver to grant access got %d after %d calls", w.statusCode, resolved)
+	}
+
+	req := &Request{Auth: Auth{IsAuthenticated: true}}
+	if _, err := s.Principal(req); err == nil {
+		t.Error("expected resolver error")
+	}
+	req = &Request{Auth: Auth{IsAuthenticated: true, Payload: "user"}}
+	s.Principal(req)
+	s.Principal(req)
+	if resolved != 3 {
+		t.Errorf("expected principal to be cached on the request, resolved %d times", resolved)
+	}
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var defaultCORSHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Access-Control-Allow-Headers", "Access-Control-Allow-Methods", "Access-Control-Allow-Origin", "Access-Control-Max-Age", "Access-Control-Request-Headers", "Access-Control-Request-Method", "Authorization", "Origin", "Cache-Control", "Connection", "Content-Type", "Content-Encoding", "Content-Length", "Sec-Fetch-Dest", "Sec-Fetch-Mode", "Sec-Fetch-Site", "X-Requested-With"}
+
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"AllowedOrigins"`   // Exact origins, "*" or patterns like "https://*.example.com"
+	AllowedHeaders   []string `json:"AllowedHeaders"`   // Request headers allowed on preflight, defaults to the common browser set
+	ExposedHeaders   []string `json:"ExposedHeaders"`   // Response headers readable by browser scripts
+	AllowCredentials bool     `json:"AllowCredentials"` // Needs explicit origins or patterns, "*" is refused
+	MaxAgeSeconds    int      `json:"MaxAgeSeconds"`    // How long browsers may cache preflight answers
+}
+
+// defaultCORS is used when neither Config nor App define a policy, allows every origin like before policies existed.
+var defaultCORS = &CORSConfig{AllowedOrigins: []string{"*"}}
+
+// CORSApp is implemented by apps which need a policy other than Config.CORS, returning nil falls back to it.
+type CORSApp interface {
+	CORS() *CORSConfig
+}
+
+func (s *Service) corsPolicy(appName string) *CORSConfig {
+	if corsApp, implemented := s.apps[appName].(CORSApp); implemented {
+		if policy := corsApp.CORS(); policy != nil {
+			return policy
+		}
+	}
+	if s.Config.CORS != nil {
+		return s.Config.CORS
+	}
+	return defaultCORS
+}
+
+// validate refuses credentials with "*", echoing any origin would let every site make authenticated calls.
+func (policy *CORSConfig) validate() error {
+	if !policy.AllowCredentials {
+		return nil
+	}
+	for _, allowed := range policy.AllowedOrigins {
+		if allowed == "*" {
+			return errors.New("CORS AllowCredentials needs explicit AllowedOrigins, \"*\" isn't allowed")
+		}
+	}
+	return nil
+}
+
+// checkCORSPolicies fails at boot on invalid Config.CORS or app policies.
+func (s *Service) checkCORSPolicies() {
+	policies := map[string]*CORSConfig{"config": s.Config.CORS}
+	for appName, app := range s.apps {
+		if corsApp, implemented := app.(CORSApp); implemented {
+			policies[appName] = corsApp.CORS()
+		}
+	}
+	for name, policy := range policies {
+		if policy == nil {
+			continue
+		}
+		if err := policy.validate(); err != nil {
+			errTxt := fmt.Sprintf("invalid CORS policy of %s: %s", name, err)
+			CheckFatal(err, errTxt)
+		}
+	}
+}
+
+// allowOrigin returns value for Access-Control-Allow-Origin, empty when origin isn't allowed.
+func (policy *CORSConfig) allowOrigin(origin string) string {
+	for _, allowed := range policy.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if !StringLenGtZero(origin) {
+			continue
+		}
+		if allowed == origin {
+			return origin
+		}
+		if matched, err := path.Match(allowed, origin); err == nil && matched {
+			return origin
+		}
+	}
+	return ""
+}
+
+// applyCORS sets headers shared by actual and preflight requests, returns false when origin isn't allowed.
+func (policy *CORSConfig) applyCORS(w http.ResponseWriter, httpReq *http.Request) bool {
+	allowedOrigin := policy.allowOrigin(httpReq.Header.Get("Origin"))
+	if !StringLenGtZero(allowedOrigin) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+	// Browsers ignore credentials with "*" anyway, checkCORSPolicies refuses such policies.
+	if policy.AllowCredentials && allowedOrigin != "*" {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(policy.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+	}
+	return true
+}
+
+// writePreflight answers OPTIONS with methods actually registered for the route, origin must already be allowed.
+func (policy *CORSConfig) writePreflight(w http.ResponseWriter, methodMap map[HttpMethod]HttpAction) {
+	allowedHeaders := policy.AllowedHeaders
+	if len(allowedHeaders) == 0 {
+		allowedHeaders = defaultCORSHeaders
+	}
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowedMethods(methodMap), ", "))
+	if policy.MaxAgeSeconds > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAgeSeconds))
+	}
+}
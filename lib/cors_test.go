@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+type CORSTestApp struct {
+	MockApp
+}
+
+func (app *CORSTestApp) Title() string {
+	return "cors-app"
+}
+
+func (app *CORSTestApp) Routes() []HttpAction {
+	return []HttpAction{
+		{
+			Method:  DELETE,
+			Action:  "items",
+			Handler: func(r *Request) *Response { return NoContentResponse() },
+		},
+	}
+}
+
+func (app *CORSTestApp) CORS() *CORSConfig {
+	return &CORSConfig{
+		AllowedOrigins:   []string{"https://admin.example.com"},
+		AllowCredentials: true,
+	}
+}
+
+func TestCORS(t *testing.T) {
+	config := &Config{
+		CORS: &CORSConfig{
+			AllowedOrigins: []string{"https://app.example.com", "https://*.preview.example.com"},
+			AllowedHeaders: []string{"Authorization", "Content-Type"},
+			ExposedHeaders: []string{"X-Request-Id"},
+			MaxAgeSeconds:  600,
+		},
+	}
+	s := NewService(config, &[]App{&MockApp{}, &CORSTestApp{}})
+
+	type input struct {
+		title     string
+		method    string
+		path      string
+		origin    string
+		expHeader map[string]string
+	}
+
+	inputs := []input{
+		{
+			title:  "Allowed origin is echoed",
+			method: "GET",
+			path:   "mock-app/public-success-get",
+			origin: "https://app.example.com",
+			expHeader: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Expose-Headers":    "X-Request-Id",
+				"Access-Control-Allow-Credentials": "",
+			},
+		},
+		{
+			title:  "Pattern origin",
+			method: "GET",
+			path:   "mock-app/public-success-get",
+			origin: "https://pr-42.preview.example.com",
+			expHeader: map[string]string{
+				"Access-Control-Allow-Origin": "https://pr-42.preview.example.com",
+			},
+		},
+		{
+			title:  "Unknown origin gets no CORS headers",
+			method: "GET",
+			path:   "mock-app/public-success-get",
+			origin: "https://evil.example.com",
+			expHeader: map[string]string{
+				"Access-Control-Allow-Origin":   "",
+				"Access-Control-Expose-Headers": "",
+			},
+		},
+		{
+			title:  "Preflight lists methods registered for the route",
+			method: "OPTIONS",
+			path:   "mock-app/models",
+			origin: "https://app.example.com",
+			expHeader: map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS, POST",
+				"Access-Control-Allow-Headers": "Authorization, Content-Type",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{
+			title:  "Preflight for disallowed origin",
+			method: "OPTIONS",
+			path:   "mock-app/models",
+			origin: "https://evil.example.com",
+			expHeader: map[string]string{
+				"Access-Control-Allow-Origin":  "",
+				"Access-Control-Allow-Methods": "",
+			},
+		},
+		{
+			title:  "App policy overrides config",
+			method: "OPTIONS",
+			path:   "cors-app/items",
+			origin: "https://admin.example.com",
+			expHeader: map[string]string{
+				"Access-Control-Allow-Origin":      "https://admin.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "DELETE, OPTIONS",
+				"Access-Control-Max-Age":           "",
+			},
+		},
+		{
+			title:  "App policy rejects config origins",
+			method: "DELETE",
+			path:   "cors-app/items",
+			origin: "https://app.example.com",
+			expHeader: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{
+				Method: input.method,
+				URL:    &url.URL{Path: input.path},
+				Header: http.Header{"Origin": []string{input.origin}},
+			})
+			for key, exp := range input.expHeader {
+				if got := w.Header().Get(key); got != exp {
+					t.Errorf("expected header %s to be %q got %q", key, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultCORS(t *testing.T) {
+	policy := defaultCORS
+
+	if got := policy.allowOrigin(""); got != "*" {
+		t.Errorf("expected * without origin got %s", got)
+	}
+	if got := policy.allowOrigin("https://anything.com"); got != "*" {
+		t.Errorf("expected * got %s", got)
+	}
+
+}
+
+func TestCORSPolicyValidation(t *testing.T) {
+	inputs := map[string]struct {
+		policy *CORSConfig
+		expErr bool
+	}{
+		"Any origin":                  {policy: &CORSConfig{AllowedOrigins: []string{"*"}}},
+		"Credentials with origins":    {policy: &CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.com"}, AllowCredentials: true}},
+		"Credentials with any origin": {policy: &CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true}, expErr: true},
+	}
+	for title, input := range inputs {
+		t.Run(title, func(t *testing.T) {
+			if err := input.policy.validate(); (err != nil) != input.expErr {
+				t.Errorf("expected error %t got %v", input.expErr, err)
+			}
+		})
+	}
+}
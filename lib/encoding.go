@@ -0,0 +1,344 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	JSONContentType    = "application/json"
+	MsgPackContentType = "application/msgpack"
+	CSVContentType     = "text/csv"
+	XMLContentType     = "application/xml"
+)
+
+// ErrUnsupportedBody is returned by encoders which can't represent the body, negotiation moves on to the next type.
+var ErrUnsupportedBody = errors.New("body can't be encoded in this format")
+
+// defaultCodecs decodes bodies of requests built outside of Service, mostly in tests.
+var defaultCodecs = NewCodecs()
+
+type Encoder func(w io.Writer, v any) error
+type Decoder func(r io.Reader, v any) error
+
+// Codecs maps media types to encoders for responses and decoders for request bodies.
+type Codecs struct {
+	mu       sync.RWMutex
+	encoders map[string]Encoder
+	decoders map[string]Decoder
+}
+
+func NewCodecs() *Codecs {
+	codecs := &Codecs{
+		encoders: make(map[string]Encoder),
+		decoders: make(map[string]Decoder),
+	}
+
+	codecs.Register(JSONContentType, jsonEncoder, jsonDecoder)
+	codecs.Register(MsgPackContentType, msgPackEncoder, msgPackDecoder)
+	codecs.Register("application/x-msgpack", msgPackEncoder, msgPackDecoder)
+	codecs.Register(CSVContentType, csvEncoder, csvDecoder)
+	codecs.Register(XMLContentType, xmlEncoder, xmlDecoder)
+	codecs.Register("text/xml", xmlEncoder, xmlDecoder)
+
+	return codecs
+}
+
+// Register adds or replaces encoder and decoder for mediaType, either can be nil.
+func (codecs *Codecs) Register(mediaType string, encoder Encoder, decoder Decoder) {
+	codecs.mu.Lock()
+	defer codecs.mu.Unlock()
+	mediaType = strings.ToLower(mediaType)
+	if encoder != nil {
+		codecs.encoders[mediaType] = encoder
+	}
+	if decoder != nil {
+		codecs.decoders[mediaType] = decoder
+	}
+}
+
+// RegisterCodec lets apps add formats during Init.
+func (s *Service) RegisterCodec(mediaType string, encoder Encoder, decoder Decoder) {
+	s.Codecs.Register(mediaType, encoder, decoder)
+}
+
+func (codecs *Codecs) encoder(mediaType string) (Encoder, bool) {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+	encoder, found := codecs.encoders[mediaType]
+	return encoder, found
+}
+
+// Decoder returns decoder for contentType, bodies without a registered type are treated as JSON.
+func (codecs *Codecs) Decoder(contentType string) Decoder {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		codecs.mu.RLock()
+		decoder, found := codecs.decoders[strings.ToLower(mediaType)]
+		codecs.mu.RUnlock()
+		if found {
+			return decoder
+		}
+	}
+	return jsonDecoder
+}
+
+// Encode picks the best encoder for accept and falls back to JSON when nothing acceptable can encode v.
+func (codecs *Codecs) Encode(accept string, v any) ([]byte, string, error) {
+	for _, mediaType := range parseAccept(accept) {
+		if mediaType == "*/*" || mediaType == "application/*" {
+			break
+		}
+		encoder, found := codecs.encoder(mediaType)
+		if !found {
+			continue
+		}
+		var buf bytes.Buffer
+		err := encoder(&buf, v)
+		if errors.Is(err, ErrUnsupportedBody) {
+			continue
+		}
+		return buf.Bytes(), mediaType, err
+	}
+
+	body, err := json.Marshal(v)
+	return body, JSONContentType, err
+}
+
+// parseAccept returns media types ordered by quality, types with q=0 are dropped.
+func parseAccept(accept string) []string {
+	type weighted struct {
+		mediaType string
+		quality   float64
+		index     int
+	}
+
+	candidates := []weighted{}
+	for index, value := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, found := params["q"]; found {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		candidates = append(candidates, weighted{mediaType: strings.ToLower(mediaType), quality: quality, index: index})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+
+	mediaTypes := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		mediaTypes[i] = candidate.mediaType
+	}
+	return mediaTypes
+}
+
+func jsonEncoder(w io.Writer, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func jsonDecoder(r io.Reader, v any) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// MessagePack reuses json tags so field names match the JSON responses.
+func msgPackEncoder(w io.Writer, v any) error {
+	encoder := msgpack.NewEncoder(w)
+	encoder.SetCustomStructTag("json")
+	return encoder.Encode(v)
+}
+
+func msgPackDecoder(r io.Reader, v any) error {
+	decoder := msgpack.NewDecoder(r)
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+func xmlEncoder(w io.Writer, v any) error {
+	// Maps and anonymous values have no XML representation.
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if !value.IsValid() || value.Kind() == reflect.Map {
+		return ErrUnsupportedBody
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		var unsupported *xml.UnsupportedTypeError
+		if errors.As(err, &unsupported) {
+			return ErrUnsupportedBody
+		}
+		return err
+	}
+	return nil
+}
+
+func xmlDecoder(r io.Reader, v any) error {
+	return xml.NewDecoder(r).Decode(v)
+}
+
+// csvColumns returns header and field indexes for struct type, `csv:"name"` tag wins over field name and "-" skips.
+func csvColumns(structType reflect.Type) ([]string, []int) {
+	header, indexes := []string{}, []int{}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("csv"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+		header = append(header, name)
+		indexes = append(indexes, i)
+	}
+	return header, indexes
+}
+
+// csvEncoder only supports slices of structs(or pointers to them), one row per item.
+func csvEncoder(w io.Writer, v any) error {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if !value.IsValid() || (value.Kind() != reflect.Slice && value.Kind() != reflect.Array) {
+		return ErrUnsupportedBody
+	}
+	itemType := value.Type().Elem()
+	if itemType.Kind() == reflect.Pointer {
+		itemType = itemType.Elem()
+	}
+	if itemType.Kind() != reflect.Struct {
+		return ErrUnsupportedBody
+	}
+
+	header, indexes := csvColumns(itemType)
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(header); err != nil {
+		return err
+	}
+	for i := 0; i < value.Len(); i++ {
+		item := reflect.Indirect(value.Index(i))
+		record := make([]string, len(indexes))
+		if item.IsValid() {
+			for col, fieldIndex := range indexes {
+				record[col] = fmt.Sprint(item.Field(fieldIndex).Interface())
+			}
+		}
+		if err := csvWriter.Write(record); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// csvDecoder fills a pointer to a slice of structs, columns are matched on header names.
+func csvDecoder(r io.Reader, v any) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.Elem().Kind() != reflect.Slice {
+		return errors.New("csv can only be decoded into a pointer to a slice of structs")
+	}
+	slice := target.Elem()
+	itemType := slice.Type().Elem()
+	isPtr := itemType.Kind() == reflect.Pointer
+	if isPtr {
+		itemType = itemType.Elem()
+	}
+	if itemType.Kind() != reflect.Struct {
+		return errors.New("csv can only be decoded into a pointer to a slice of structs")
+	}
+
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	header, indexes := csvColumns(itemType)
+	fieldByColumn := make(map[string]int)
+	for i, name := range header {
+		fieldByColumn[name] = indexes[i]
+	}
+
+	for _, record := range records[1:] {
+		item := reflect.New(itemType).Elem()
+		for col, name := range records[0] {
+			fieldIndex, found := fieldByColumn[name]
+			if !found || col >= len(record) {
+				continue
+			}
+			if err := setCSVField(item.Field(fieldIndex), record[col]); err != nil {
+				return fmt.Errorf("column %s: %w", name, err)
+			}
+		}
+		if isPtr {
+			item = item.Addr()
+		}
+		slice.Set(reflect.Append(slice, item))
+	}
+	return nil
+}
+
+func setCSVField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(parsed)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type encodingRow struct {
+	ID     int    `json:"ID" xml:"ID" csv:"id"`
+	Name   string `json:"Name" xml:"Name" csv:"name"`
+	Secret string `json:"-" xml:"-" csv:"-"`
+}
+
+func TestParseAccept(t *testing.T) {
+	type input struct {
+		title  string
+		accept string
+		exp    []string
+	}
+
+	inputs := []input{
+		{
+			title:  "Empty accept",
+			accept: "",
+			exp:    []string{},
+		},
+		{
+			title:  "Ordered by quality, ties keep header order",
+			accept: "text/csv;q=0.5, application/xml, application/msgpack;q=0.9, text/xml",
+			exp:    []string{"application/xml", "text/xml", "application/msgpack", "text/csv"},
+		},
+		{
+			title:  "Zero quality is dropped",
+			accept: "text/csv;q=0, application/json",
+			exp:    []string{"application/json"},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			if got := parseAccept(input.accept); !reflect.DeepEqual(got, input.exp) {
+				t.Errorf("expected %v got %v", input.exp, got)
+			}
+		})
+	}
+}
+
+func TestReturnRespNegotiation(t *testing.T) {
+	s := NewService(&Config{}, &[]App{})
+	rows := []encodingRow{{ID: 1, Name: "bob", Secret: "x"}, {ID: 2, Name: "alice, jr"}}
+
+	type input struct {
+		title          string
+		accept         string
+		resp           *Response
+		expContentType string
+		expResp        string
+	}
+
+	inputs := []input{
+		{
+			title:          "No accept falls back to JSON",
+			resp:           SuccessResponse(rows),
+			expContentType: "",
+			expResp:        "[{\"ID\":1,\"Name\":\"bob\"},{\"ID\":2,\"Name\":\"alice, jr\"}]",
+		},
+		{
+			title:          "CSV for slice of structs",
+			accept:         "text/csv",
+			resp:           SuccessResponse(rows),
+			expContentType: "text/csv",
+			expResp:        "id,name\n1,bob\n2,\"alice, jr\"\n",
+		},
+		{
+			title:          "CSV can't encode maps, next acceptable type wins",
+			accept:         "text/csv, application/xml;q=0.8, application/json;q=0.5",
+			resp:           SuccessResponse(map[string]int{"ID": 1}),
+			expContentType: "",
+			expResp:        "{\"ID\":1}",
+		},
+		{
+			title:          "XML for structs",
+			accept:         "application/xml",
+			resp:           SuccessResponse(encodingRow{ID: 1, Name: "bob"}),
+			expContentType: "application/xml",
+			expResp:        "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<encodingRow><ID>1</ID><Name>bob</Name></encodingRow>",
+		},
+		{
+			title:          "Unknown type falls back to JSON",
+			accept:         "application/yaml",
+			resp:           SuccessResponse(map[string]int{"ID": 1}),
+			expContentType: "",
+			expResp:        "{\"ID\":1}",
+		},
+		{
+			title:          "Explicit content type skips negotiation",
+			accept:         "application/xml",
+			resp:           SuccessResponse(rows).WithContentType("text/csv; charset=utf-8"),
+			expContentType: "text/csv; charset=utf-8",
+			expResp:        "id,name\n1,bob\n2,\"alice, jr\"\n",
+		},
+		{
+			title:          "Strings are never encoded",
+			accept:         "application/xml",
+			resp:           SuccessResponse("OK"),
+			expContentType: "",
+			expResp:        "OK",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			req := &Request{ID: "req-1", Header: http.Header{}}
+			if StringLenGtZero(input.accept) {
+				req.Header["Accept"] = []string{input.accept}
+			}
+			w := &MockResponseWriter{}
+			s.returnResp(w, input.resp, req)
+			if w.dataWritten != input.expResp {
+				t.Errorf("expected %q got %q", input.expResp, w.dataWritten)
+			}
+			if got := w.Header().Get("Content-Type"); got != input.expContentType {
+				t.Errorf("expected content type %q got %q", input.expContentType, got)
+			}
+		})
+	}
+}
+
+func TestReturnRespMsgPack(t *testing.T) {
+	s := NewService(&Config{}, &[]App{})
+	req := &Request{ID: "req-1", Header: http.Header{"Accept": []string{"application/msgpack"}}}
+
+	w := &MockResponseWriter{}
+	s.returnResp(w, SuccessResponse(encodingRow{ID: 7, Name: "bob"}), req)
+
+	if got := w.Header().Get("Content-Type"); got != MsgPackContentType {
+		t.Errorf("expected content type %s got %s", MsgPackContentType, got)
+	}
+	var decoded map[string]any
+	if err := msgpack.Unmarshal([]byte(w.dataWritten), &decoded); err != nil {
+		t.Fatalf("invalid msgpack body: %s", err)
+	}
+	if decoded["Name"] != "bob" {
+		t.Errorf("expected json field names to be reused, got %v", decoded)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	s := NewService(&Config{}, &[]App{})
+	s.RegisterCodec("text/plain", func(w io.Writer, v any) error {
+		_, err := io.WriteString(w, "plain")
+		return err
+	}, nil)
+
+	req := &Request{ID: "req-1", Header: http.Header{"Accept": []string{"text/plain"}}}
+	w := &MockResponseWriter{}
+	s.returnResp(w, SuccessResponse(map[string]int{"ID": 1}), req)
+	if w.dataWritten != "plain" {
+		t.Errorf("expected registered encoder to be used, got %s", w.dataWritten)
+	}
+}
+
+func TestGetDecodedBody(t *testing.T) {
+	msgPackBody, _ := msgpack.Marshal(map[string]any{"ID": 1, "Name": "bob"})
+
+	type input struct {
+		title       string
+		contentType string
+		body        []byte
+		exp         []encodingRow
+	}
+
+	inputs := []input{
+		{
+			title: "Missing content type is JSON",
+			body:  []byte("[{\"ID\":1,\"Name\":\"bob\"}]"),
+			exp:   []encodingRow{{ID: 1, Name: "bob"}},
+		},
+		{
+			title:       "JSON with charset",
+			contentType: "application/json; charset=utf-8",
+			body:        []byte("[{\"ID\":1,\"Name\":\"bob\"}]"),
+			exp:         []encodingRow{{ID: 1, Name: "bob"}},
+		},
+		{
+			title:       "CSV matches header names",
+			contentType: "text/csv",
+			body:        []byte("name,id,unknown\nbob,1,x\n\"alice, jr\",2,y\n"),
+			exp:         []encodingRow{{ID: 1, Name: "bob"}, {ID: 2, Name: "alice, jr"}},
+		},
+		{
+			title:       "XML",
+			contentType: "application/xml",
+			body:        []byte("<rows><encodingRow><ID>1</ID><Name>bob</Name></encodingRow></rows>"),
+			exp:         []encodingRow{{ID: 1, Name: "bob"}},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			req := &Request{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(input.body)), codecs: NewCodecs()}
+			if StringLenGtZero(input.contentType) {
+				req.Header["Content-Type"] = []string{input.contentType}
+			}
+
+			var got []encodingRow
+			var err error
+			if strings.Contains(input.contentType, "xml") {
+				wrapper := struct {
+					Rows []encodingRow `xml:"encodingRow"`
+				}{}
+				err = req.GetDecodedBody(&wrapper)
+				got = wrapper.Rows
+			} else {
+				err = req.GetDecodedBody(&got)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+			if !reflect.DeepEqual(got, input.exp) {
+				t.Errorf("expected %v got %v", input.exp, got)
+			}
+		})
+	}
+
+	t.Run("MessagePack", func(t *testing.T) {
+		req := &Request{
+			Header: http.Header{"Content-Type": []string{"application/msgpack"}},
+			Body:   io.NopCloser(bytes.NewReader(msgPackBody)),
+		}
+		var got encodingRow
+		if err := req.GetDecodedBody(&got); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if got.ID != 1 || got.Name != "bob" {
+			t.Errorf("expected bob got %v", got)
+		}
+	})
+
+	t.Run("Body map", func(t *testing.T) {
+		req := &Request{Header: http.Header{}, Body: io.NopCloser(strings.NewReader("{\"ID\":1}"))}
+		data, err := req.GetBodyMap()
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if (*data)["ID"] != float64(1) {
+			t.Errorf("expected body to be decoded, got %v", *data)
+		}
+	})
+}
@@ -2,8 +2,8 @@ package lib
 
 import (
 	"errors"
-	"fmt"
 	"log"
+	"log/slog"
 
 	"github.com/getsentry/sentry-go"
 )
@@ -18,6 +18,6 @@ func CheckFatal(e error, msg string) {
 
 func CaptureSentryException(msg string) {
 	err := errors.New(msg)
-	log.Println(fmt.Sprintf("Error: %s", msg))
+	slog.Error(msg)
 	sentry.CaptureException(err)
 }
@@ -0,0 +1,322 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultMaxRequestSize = 32 << 20
+	defaultMaxFileSize    = 10 << 20
+	defaultMaxMemory      = 1 << 20
+	maxFormValueSize      = 1 << 20
+	sniffLen              = 512
+)
+
+// UploadLimits controls ParseForm, zero values fall back to defaults.
+type UploadLimits struct {
+	MaxRequestSize int64      // Whole body, defaults to 32MB
+	MaxFileSize    int64      // Per file, defaults to 10MB
+	MaxMemory      int64      // Files up to this size stay in memory, bigger ones go to Sink. Defaults to 1MB
+	AllowedTypes   []string   // Detected content types, "image/*" style wildcards allowed. Everything is allowed when empty
+	Sink           UploadSink // Where large files end up, defaults to TempFileSink
+}
+
+// UploadSink stores uploaded files which are too large to be kept in memory.
+type UploadSink interface {
+	Store(ctx context.Context, file *UploadedFile, content io.Reader) (location string, err error)
+	Open(ctx context.Context, location string) (io.ReadCloser, error)
+	Remove(ctx context.Context, location string) error
+}
+
+type UploadedFile struct {
+	Field       string
+	FileName    string
+	ContentType string // Detected from content, client supplied type is never trusted
+	Size        int64
+	Location    string // Set by sink, empty when file is held in memory
+
+	data []byte
+	sink UploadSink
+}
+
+// Open returns file contents regardless of whether it's held in memory or in the sink.
+func (file *UploadedFile) Open(ctx context.Context) (io.ReadCloser, error) {
+	if !StringLenGtZero(file.Location) {
+		return io.NopCloser(bytes.NewReader(file.data)), nil
+	}
+	return file.sink.Open(ctx, file.Location)
+}
+
+type Form struct {
+	Values url.Values
+	Files  map[string][]*UploadedFile
+}
+
+// File returns the first file uploaded for field.
+func (form *Form) File(field string) *UploadedFile {
+	if files := form.Files[field]; len(files) > 0 {
+		return files[0]
+	}
+	return nil
+}
+
+// Cleanup removes files handed over to the sink, handlers should defer it unless they keep the files.
+func (form *Form) Cleanup(ctx context.Context) {
+	for _, files := range form.Files {
+		for _, file := range files {
+			if StringLenGtZero(file.Location) {
+				file.sink.Remove(ctx, file.Location)
+			}
+		}
+	}
+}
+
+// TempFileSink writes uploads to Dir, os.TempDir() when empty.
+type TempFileSink struct {
+	Dir string
+}
+
+func (sink *TempFileSink) Store(ctx context.Context, file *UploadedFile, content io.Reader) (string, error) {
+	tmpFile, err := os.CreateTemp(sink.Dir, "upload-*"+filepath.Ext(file.FileName))
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, content); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+func (sink *TempFileSink) Open(ctx context.Context, location string) (io.ReadCloser, error) {
+	return os.Open(location)
+}
+
+func (sink *TempFileSink) Remove(ctx context.Context, location string) error {
+	return os.Remove(location)
+}
+
+func ErrPayloadTooLarge(message string) *APIError {
+	return NewAPIError(http.StatusRequestEntityTooLarge, "payload_too_large", message)
+}
+
+func ErrUnsupportedMediaType(message string) *APIError {
+	return NewAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", message)
+}
+
+func (limits UploadLimits) withDefaults() UploadLimits {
+	if limits.MaxRequestSize <= 0 {
+		limits.MaxRequestSize = defaultMaxRequestSize
+	}
+	if limits.MaxFileSize <= 0 {
+		limits.MaxFileSize = defaultMaxFileSize
+	}
+	if limits.MaxMemory <= 0 {
+		limits.MaxMemory = defaultMaxMemory
+	}
+	if limits.Sink == nil {
+		limits.Sink = &TempFileSink{}
+	}
+	return limits
+}
+
+func (limits UploadLimits) allows(contentType string) bool {
+	if len(limits.AllowedTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range limits.AllowedTypes {
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseForm reads urlencoded and multipart bodies, errors are *APIError so handlers can return them as is.
+func (r *Request) ParseForm(limits *UploadLimits) (*Form, error) {
+	formLimits := UploadLimits{}
+	if limits != nil {
+		formLimits = *limits
+	}
+	formLimits = formLimits.withDefaults()
+
+	form := &Form{
+		Values: url.Values{},
+		Files:  make(map[string][]*UploadedFile),
+	}
+	if r.Body == nil {
+		return form, nil
+	}
+
+	contentType := ""
+	if val := r.GetHeaderVal("Content-Type"); val != nil {
+		contentType = *val
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, ErrUnsupportedMediaType("invalid Content-Type")
+	}
+
+	body := http.MaxBytesReader(nil, r.Body, formLimits.MaxRequestSize)
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, uploadReadErr(err)
+		}
+		values, err := url.ParseQuery(string(data))
+		if err != nil {
+			return nil, ErrBadRequest("invalid form body")
+		}
+		form.Values = values
+		return form, nil
+	case "multipart/form-data":
+		if err := r.parseMultipart(form, multipart.NewReader(body, params["boundary"]), formLimits); err != nil {
+			form.Cleanup(r.Context())
+			return nil, err
+		}
+		return form, nil
+	}
+
+	return nil, ErrUnsupportedMediaType(fmt.Sprintf("%s is not a form", mediaType))
+}
+
+func (r *Request) parseMultipart(form *Form, reader *multipart.Reader, limits UploadLimits) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return uploadReadErr(err)
+		}
+
+		if !StringLenGtZero(part.FileName()) {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize+1))
+			if err != nil {
+				return uploadReadErr(err)
+			}
+			if len(value) > maxFormValueSize {
+				return ErrPayloadTooLarge(fmt.Sprintf("%s is too large", part.FormName()))
+			}
+			form.Values.Add(part.FormName(), string(value))
+			continue
+		}
+
+		file, err := r.receiveFile(part, limits)
+		if err != nil {
+			return err
+		}
+		form.Files[file.Field] = append(form.Files[file.Field], file)
+	}
+}
+
+// receiveFile sniffs the type from the first bytes and keeps small files in memory, rest is streamed to sink.
+func (r *Request) receiveFile(part *multipart.Part, limits UploadLimits) (*UploadedFile, error) {
+	file := &UploadedFile{
+		Field:    part.FormName(),
+		FileName: filepath.Base(part.FileName()),
+		sink:     limits.Sink,
+	}
+
+	sniff := make([]byte, sniffLen)
+	n, err := io.ReadFull(part, sniff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, uploadReadErr(err)
+	}
+	sniff = sniff[:n]
+	file.ContentType = http.DetectContentType(sniff)
+
+	if !limits.allows(file.ContentType) {
+		return nil, ErrUnsupportedMediaType(fmt.Sprintf("%s is not allowed", file.ContentType)).WithDetails(map[string]string{
+			"Field":       file.Field,
+			"FileName":    file.FileName,
+			"ContentType": file.ContentType,
+		})
+	}
+
+	tooLarge := ErrPayloadTooLarge(fmt.Sprintf("%s exceeds %d bytes", file.FileName, limits.MaxFileSize)).WithDetails(map[string]string{
+		"Field":    file.Field,
+		"FileName": file.FileName,
+	})
+
+	// One extra byte tells us whether the limit was crossed.
+	content := &io.LimitedReader{R: io.MultiReader(bytes.NewReader(sniff), part), N: limits.MaxFileSize + 1}
+
+	memLimit := limits.MaxMemory
+	if memLimit > limits.MaxFileSize {
+		memLimit = limits.MaxFileSize
+	}
+	buffered, err := io.ReadAll(io.LimitReader(content, memLimit+1))
+	if err != nil {
+		return nil, uploadReadErr(err)
+	}
+	if int64(len(buffered)) <= memLimit {
+		file.data = buffered
+		file.Size = int64(len(buffered))
+		return file, nil
+	}
+
+	if content.N == 0 {
+		return nil, tooLarge
+	}
+
+	counter := &countingReader{r: io.MultiReader(bytes.NewReader(buffered), content)}
+	location, err := limits.Sink.Store(r.Context(), file, counter)
+	if err != nil {
+		return nil, uploadReadErr(err)
+	}
+	file.Location = location
+	file.Size = counter.n
+
+	if content.N == 0 {
+		limits.Sink.Remove(r.Context(), location)
+		return nil, tooLarge
+	}
+
+	return file, nil
+}
+
+// uploadReadErr maps body read failures to client errors.
+func uploadReadErr(err error) *APIError {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return ErrPayloadTooLarge(fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || strings.Contains(err.Error(), "multipart") {
+		return ErrBadRequest("malformed multipart body")
+	}
+	return ErrInternal(err)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+func multipartRequest(t *testing.T, fields map[string]string, files map[string][]byte) *Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, value := range fields {
+		writer.WriteField(key, value)
+	}
+	for name, content := range files {
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(content)
+	}
+	writer.Close()
+
+	return &Request{
+		Body:   io.NopCloser(body),
+		Header: map[string][]string{"Content-Type": {writer.FormDataContentType()}},
+	}
+}
+
+func TestParseForm(t *testing.T) {
+	t.Run("Urlencoded form", func(t *testing.T) {
+		req := &Request{
+			Body:   io.NopCloser(strings.NewReader("name=bob&tag=a&tag=b")),
+			Header: map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}},
+		}
+		form, err := req.ParseForm(nil)
+		if err != nil || form.Values.Get("name") != "bob" || len(form.Values["tag"]) != 2 {
+			t.Errorf("unexpected form %+v %s", form, err)
+		}
+	})
+
+	t.Run("Small file is kept in memory with detected type", func(t *testing.T) {
+		req := multipartRequest(t, map[string]string{"title": "avatar"}, map[string][]byte{"avatar.txt": append(pngHeader, 1, 2, 3)})
+		form, err := req.ParseForm(&UploadLimits{AllowedTypes: []string{"image/*"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := form.File("file")
+		if form.Values.Get("title") != "avatar" || file == nil || file.ContentType != "image/png" || file.Location != "" {
+			t.Errorf("unexpected form %+v %+v", form, file)
+		}
+	})
+
+	t.Run("Large file is streamed to sink", func(t *testing.T) {
+		content := bytes.Repeat([]byte("a"), 2048)
+		req := multipartRequest(t, nil, map[string][]byte{"big.txt": content})
+		form, err := req.ParseForm(&UploadLimits{MaxMemory: 1024, Sink: &TempFileSink{Dir: t.TempDir()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer form.Cleanup(context.Background())
+
+		file := form.File("file")
+		if file.Location == "" || file.Size != 2048 {
+			t.Fatalf("expected file in sink got %+v", file)
+		}
+		reader, err := file.Open(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		stored, _ := io.ReadAll(reader)
+		if !bytes.Equal(stored, content) {
+			t.Error("stored content differs from upload")
+		}
+	})
+
+	type rejection struct {
+		title     string
+		req       *Request
+		limits    *UploadLimits
+		expStatus int
+	}
+
+	rejections := []rejection{
+		{
+			title:     "Disallowed type",
+			req:       multipartRequest(t, nil, map[string][]byte{"fake.png": []byte("plain text")}),
+			limits:    &UploadLimits{AllowedTypes: []string{"image/png"}},
+			expStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			title:     "File too large",
+			req:       multipartRequest(t, nil, map[string][]byte{"big.txt": bytes.Repeat([]byte("a"), 100)}),
+			limits:    &UploadLimits{MaxFileSize: 50},
+			expStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			title:     "File too large for sink",
+			req:       multipartRequest(t, nil, map[string][]byte{"big.txt": bytes.Repeat([]byte("a"), 3000)}),
+			limits:    &UploadLimits{MaxFileSize: 2000, MaxMemory: 1000, Sink: &TempFileSink{Dir: t.TempDir()}},
+			expStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			title:     "Request too large",
+			req:       multipartRequest(t, nil, map[string][]byte{"big.txt": bytes.Repeat([]byte("a"), 1000)}),
+			limits:    &UploadLimits{MaxRequestSize: 500},
+			expStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			title: "Not a form",
+			req: &Request{
+				Body:   io.NopCloser(strings.NewReader("{}")),
+				Header: map[string][]string{"Content-Type": {"application/json"}},
+			},
+			expStatus: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, input := range rejections {
+		t.Run(input.title, func(t *testing.T) {
+			_, err := input.req.ParseForm(input.limits)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Status != input.expStatus {
+				t.Errorf("expected %d got %v", input.expStatus, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type HealthCheckKind string
+
+const (
+	LivenessCheck  HealthCheckKind = "liveness"
+	ReadinessCheck HealthCheckKind = "readiness"
+)
+
+const (
+	HealthStatusOk      = "ok"
+	HealthStatusFailing = "failing"
+
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthCheckCacheTTL = 5 * time.Second
+)
+
+type HealthConfig struct {
+	TimeoutMs            int               `json:"TimeoutMs"`            // Default timeout for every check
+	CacheTTLMs           int               `json:"CacheTTLMs"`           // Default time a check result is reused for
+	Dependencies         map[string]string `json:"Dependencies"`         // Downstream HTTP deps, name to URL, checked for readiness
+	ShutdownDelaySeconds int               `json:"ShutdownDelaySeconds"` // Time readiness fails before server stops accepting requests
+}
+
+// HealthCheck is registered by service components and apps, Check should honour ctx cancellation.
+type HealthCheck struct {
+	Name     string
+	Kind     HealthCheckKind // Defaults to ReadinessCheck
+	Timeout  time.Duration
+	CacheTTL time.Duration
+	Check    func(ctx context.Context) error
+}
+
+type HealthCheckResult struct {
+	Name      string    `json:"Name"`
+	Status    string    `json:"Status"`
+	Error     string    `json:"Error,omitempty"`
+	LatencyMs float64   `json:"LatencyMs"`
+	CheckedAt time.Time `json:"CheckedAt"`
+}
+
+type HealthReport struct {
+	Status string              `json:"Status"`
+	Checks []HealthCheckResult `json:"Checks"`
+}
+
+func (report HealthReport) IsHealthy() bool {
+	return report.Status == HealthStatusOk
+}
+
+type healthEntry struct {
+	check HealthCheck
+
+	mu     sync.Mutex
+	cached *HealthCheckResult
+}
+
+type HealthRegistry struct {
+	mu       sync.RWMutex
+	entries  map[string]*healthEntry
+	draining atomic.Bool
+
+	timeout  time.Duration
+	cacheTTL time.Duration
+}
+
+func NewHealthRegistry(config *HealthConfig) *HealthRegistry {
+	registry := &HealthRegistry{
+		entries:  make(map[string]*healthEntry),
+		timeout:  defaultHealthCheckTimeout,
+		cacheTTL: defaultHealthCheckCacheTTL,
+	}
+	if config != nil {
+		if config.TimeoutMs > 0 {
+			registry.timeout = time.Duration(config.TimeoutMs) * time.Millisecond
+		}
+		if config.CacheTTLMs > 0 {
+			registry.cacheTTL = time.Duration(config.CacheTTLMs) * time.Millisecond
+		}
+	}
+	return registry
+}
+
+// Register adds a check, names have to be unique across service and apps.
+func (registry *HealthRegistry) Register(check HealthCheck) {
+	if check.Check == nil || !StringLenGtZero(check.Name) {
+		errTxt := "health check needs a name and a check function"
+		CheckFatal(errors.New(errTxt), errTxt)
+	}
+	if check.Kind == "" {
+		check.Kind = ReadinessCheck
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = registry.timeout
+	}
+	if check.CacheTTL <= 0 {
+		check.CacheTTL = registry.cacheTTL
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, dupFound := registry.entries[check.Name]; dupFound {
+		errTxt := fmt.Sprintf("%s health check already registered", check.Name)
+		CheckFatal(errors.New(errTxt), errTxt)
+	}
+	registry.entries[check.Name] = &healthEntry{check: check}
+}
+
+// SetDraining flips readiness to failing, used during graceful shutdown.
+func (registry *HealthRegistry) SetDraining(draining bool) {
+	registry.draining.Store(draining)
+}
+
+func (registry *HealthRegistry) IsDraining() bool {
+	return registry.draining.Load()
+}
+
+// Liveness only runs liveness checks, it should not depend on downstream services.
+func (registry *HealthRegistry) Liveness(ctx context.Context) HealthReport {
+	return registry.run(ctx, LivenessCheck)
+}
+
+// Readiness runs liveness and readiness checks and fails while draining.
+func (registry *HealthRegistry) Readiness(ctx context.Context) HealthReport {
+	report := registry.run(ctx, LivenessCheck, ReadinessCheck)
+	if registry.IsDraining() {
+		report.Status = HealthStatusFailing
+		report.Checks = append(report.Checks, HealthCheckResult{
+			Name:      "shutdown",
+			Status:    HealthStatusFailing,
+			Error:     "service is shutting down",
+			CheckedAt: time.Now(),
+		})
+	}
+	return report
+}
+
+func (registry *HealthRegistry) run(ctx context.Context, kinds ...HealthCheckKind) HealthReport {
+	registry.mu.RLock()
+	entries := []*healthEntry{}
+	for _, entry := range registry.entries {
+		for _, kind := range kinds {
+			if entry.check.Kind == kind {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	registry.mu.RUnlock()
+
+	results := make([]HealthCheckResult, len(entries))
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		go func(i int, entry *healthEntry) {
+			defer wg.Done()
+			results[i] = entry.result(ctx)
+		}(i, entry)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	report := HealthReport{Status: HealthStatusOk, Checks: results}
+	for _, result := range results {
+		if result.Status != HealthStatusOk {
+			report.Status = HealthStatusFailing
+		}
+	}
+	return report
+}
+
+// result returns the cached result when it's fresh, otherwise runs the check with its timeout.
+func (entry *healthEntry) result(ctx context.Context) (result HealthCheckResult) {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.cached != nil && time.Since(entry.cached.CheckedAt) < entry.check.CacheTTL {
+		return *entry.cached
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, entry.check.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	errChan := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				errChan <- fmt.Errorf("health check panicked: %v", recovered)
+			}
+		}()
+		errChan <- entry.check.Check(checkCtx)
+	}()
+
+	var err error
+	select {
+	case err = <-errChan:
+	case <-checkCtx.Done():
+		err = fmt.Errorf("timed out after %s", entry.check.Timeout)
+	}
+
+	result = HealthCheckResult{
+		Name:      entry.check.Name,
+		Status:    HealthStatusOk,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		result.Status = HealthStatusFailing
+		result.Error = err.Error()
+	}
+	entry.cached = &result
+
+	return result
+}
+
+// RegisterHealthCheck is meant to be called by apps during Init.
+func (s *Service) RegisterHealthCheck(check HealthCheck) {
+	s.Health.Register(check)
+}
+
+// registerComponentHealthChecks adds checks for everything initialised by Service.Init.
+func (s *Service) registerComponentHealthChecks() {
+	if s.RedisClient != nil {
+		s.Health.Register(HealthCheck{
+			Name: "redis",
+			Check: func(ctx context.Context) error {
+				return s.RedisClient.WithContext(ctx).Ping().Err()
+			},
+		})
+	}
+
+	if s.DbPool != nil {
+		s.Health.Register(HealthCheck{
+			Name: "db",
+			Check: func(ctx context.Context) error {
+				return s.DbPool.Ping(ctx)
+			},
+		})
+	}
+
+	if sqsManager, isSqsManager := s.SqsManager.(*SqsManager); isSqsManager && len(s.Config.Queues) > 0 {
+		s.Health.Register(HealthCheck{
+			Name: "sqs",
+			Check: func(ctx context.Context) error {
+				for _, queueName := range s.Config.Queues {
+					if _, err := sqsManager.getQueueURL(queueName); err != nil {
+						return fmt.Errorf("queue %s: %s", queueName, err)
+					}
+				}
+				return nil
+			},
+		})
+	}
+
+	if s.Config.Health != nil {
+		for name, url := range s.Config.Health.Dependencies {
+			s.Health.Register(HealthCheck{
+				Name:  name,
+				Check: httpDependencyCheck(url),
+			})
+		}
+	}
+}
+
+// httpDependencyCheck treats anything below 500 as the dependency being up.
+func httpDependencyCheck(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// Shutdown fails readiness, waits for load balancers to notice and then drains in-flight requests.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.Health.SetDraining(true)
+	s.Logger.Info("shutting down, readiness is now failing")
+
+	if s.Config.Health != nil && s.Config.Health.ShutdownDelaySeconds > 0 {
+		select {
+		case <-time.After(time.Duration(s.Config.Health.ShutdownDelaySeconds) * time.Second):
+		case <-ctx.Done():
+		}
+	}
+
+	err := s.Server.Shutdown(ctx)
+
+	if s.DbPool != nil {
+		s.DbPool.Close()
+	}
+	if s.RedisClient != nil {
+		s.RedisClient.Close()
+	}
+
+	return err
+}
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthRegistry(t *testing.T) {
+	registry := NewHealthRegistry(&HealthConfig{TimeoutMs: 50, CacheTTLMs: 1000})
+
+	calls := 0
+	registry.Register(HealthCheck{
+		Name: "cached",
+		Kind: LivenessCheck,
+		Check: func(ctx context.Context) error {
+			calls++
+			return nil
+		},
+	})
+	registry.Register(HealthCheck{
+		Name: "slow",
+		Check: func(ctx context.Context) error {
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		},
+	})
+
+	t.Run("Liveness skips readiness checks and caches results", func(t *testing.T) {
+		registry.Liveness(context.Background())
+		report := registry.Liveness(context.Background())
+		if !report.IsHealthy() || len(report.Checks) != 1 {
+			t.Errorf("expected single healthy liveness check got %+v", report)
+		}
+		if calls != 1 {
+			t.Errorf("expected cached result to be reused got %d calls", calls)
+		}
+	})
+
+	t.Run("Readiness fails on timed out check", func(t *testing.T) {
+		report := registry.Readiness(context.Background())
+		if report.IsHealthy() {
+			t.Errorf("expected readiness to fail got %+v", report)
+		}
+		for _, check := range report.Checks {
+			if check.Name == "slow" && check.Status != HealthStatusFailing {
+				t.Errorf("expected slow check to time out got %+v", check)
+			}
+		}
+	})
+
+	t.Run("Readiness fails while draining", func(t *testing.T) {
+		drainRegistry := NewHealthRegistry(nil)
+		drainRegistry.Register(HealthCheck{Name: "ok", Check: func(ctx context.Context) error { return nil }})
+		if !drainRegistry.Readiness(context.Background()).IsHealthy() {
+			t.Error("expected readiness to pass before draining")
+		}
+		drainRegistry.SetDraining(true)
+		if drainRegistry.Readiness(context.Background()).IsHealthy() {
+			t.Error("expected readiness to fail while draining")
+		}
+		if !drainRegistry.Liveness(context.Background()).IsHealthy() {
+			t.Error("expected liveness to pass while draining")
+		}
+	})
+
+	t.Run("Failing check reports error", func(t *testing.T) {
+		failRegistry := NewHealthRegistry(nil)
+		failRegistry.Register(HealthCheck{Name: "down", Check: func(ctx context.Context) error { return errors.New("connection refused") }})
+		report := failRegistry.Readiness(context.Background())
+		if report.IsHealthy() || report.Checks[0].Error != "connection refused" {
+			t.Errorf("expected failing check with error got %+v", report)
+		}
+	})
+}
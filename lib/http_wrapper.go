@@ -1,21 +1,26 @@
 package lib
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Request stores information about HTTP request.
 type Request struct {
 	ID            string
 	AppTitle      string
+	Action        string
+	Version       int // Requested API version, version of the action served when client didn't ask for one
 	Path          string
 	Method        string
 	Body          io.ReadCloser
@@ -24,19 +29,34 @@ type Request struct {
 	UserId        string //Fix this
 	Auth          Auth
 	Query         url.Values
+	ClientIP      string
+	Logger        *slog.Logger
+	Principal     *Principal // Roles, scopes and permissions, use Service.Principal which resolves it on first use
+
+	httpReq *http.Request
+	codecs  *Codecs
 }
 
 func (r *Request) GetDecodedBody(data interface{}) error {
 	body, readErr := ioutil.ReadAll(r.Body)
 
 	if readErr != nil {
-		log.Println(fmt.Sprintf("%s: ERROR: Failed to ioutil.ReadAll: %s", r.ID, readErr))
+		r.Log().Error("failed to read request body", "error", readErr)
 		return readErr
 	}
 
-	unmarshallErr := json.Unmarshal(body, data)
+	contentType := ""
+	if val := r.GetHeaderVal("Content-Type"); val != nil {
+		contentType = *val
+	}
+	codecs := r.codecs
+	if codecs == nil {
+		codecs = defaultCodecs
+	}
+
+	unmarshallErr := codecs.Decoder(contentType)(bytes.NewReader(body), data)
 	if unmarshallErr != nil {
-		log.Println(fmt.Sprintf("%s: ERROR: Failed to unmarshal body: %s", r.ID, unmarshallErr))
+		r.Log().Error("failed to unmarshal request body", "error", unmarshallErr)
 		return unmarshallErr
 	}
 
@@ -46,7 +66,18 @@ func (r *Request) GetDecodedBody(data interface{}) error {
 func (r *Request) GetBodyMap() (*map[string]interface{}, error) {
 
 	var data map[string]interface{}
-	return &data, r.GetDecodedBody(data)
+	return &data, r.GetDecodedBody(&data)
+}
+
+// Context is cancelled when client disconnects, handlers should pass it to downstream calls.
+func (r *Request) Context() context.Context {
+	if r.httpReq != nil {
+		return r.httpReq.Context()
+	}
+	if r.SentryContext != nil {
+		return r.SentryContext
+	}
+	return context.Background()
 }
 
 func (r *Request) GetHeaderVal(key string) *string {
@@ -60,10 +91,47 @@ func (r *Request) GetHeaderVal(key string) *string {
 	return &auth[0]
 }
 
+// Cookie returns the named request cookie, http.ErrNoCookie when it isn't set.
+func (r *Request) Cookie(name string) (*http.Cookie, error) {
+	return (&http.Request{Header: r.Header}).Cookie(name)
+}
+
 // Response stores information about HTTP response.
 type Response struct {
-	Status int
-	Body   interface{}
+	Status      int
+	Body        interface{}
+	Header      http.Header
+	Cookies     []*http.Cookie
+	ContentType string // Defaults to JSON
+}
+
+// SetHeader sets a response header and returns resp so calls can be chained.
+func (resp *Response) SetHeader(key string, value string) *Response {
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set(key, value)
+	return resp
+}
+
+// SetCookie adds a Set-Cookie header and returns resp so calls can be chained.
+func (resp *Response) SetCookie(cookie *http.Cookie) *Response {
+	resp.Cookies = append(resp.Cookies, cookie)
+	return resp
+}
+
+// WithDetails adds details to an error response and returns resp so calls can be chained.
+func (resp *Response) WithDetails(details any) *Response {
+	if apiErr, isErr := resp.Body.(*APIError); isErr {
+		resp.Body = apiErr.WithDetails(details)
+	}
+	return resp
+}
+
+// WithContentType overrides the default JSON content type.
+func (resp *Response) WithContentType(contentType string) *Response {
+	resp.ContentType = contentType
+	return resp
 }
 
 // SuccessResponse is a utility function for responding upon success (HTTP status code 200).
@@ -78,32 +146,69 @@ func SuccessResponse(body interface{}) *Response {
 func SuccessResponseWithMessage(msg string) *Response {
 	return &Response{
 		Status: http.StatusOK,
-		Body:   "{\"Msg\": \"" + msg + "\"}",
+		Body: struct {
+			Msg string `json:"Msg"`
+		}{Msg: msg},
 	}
 }
 
-// NotFoundResponse is a utility function for responding with 404 HTTP status.
-func NotFoundResponse() *Response {
+// CreatedResponse responds with 201 and Location of the newly created resource.
+func CreatedResponse(location string, body interface{}) *Response {
+	resp := &Response{
+		Status: http.StatusCreated,
+		Body:   body,
+	}
+	if StringLenGtZero(location) {
+		resp.SetHeader("Location", location)
+	}
+	return resp
+}
+
+// NoContentResponse responds with 204 and an empty body.
+func NoContentResponse() *Response {
 	return &Response{
-		Status: http.StatusNotFound,
-		Body:   "{\"Msg\": \"doesn't exist\"}",
+		Status: http.StatusNoContent,
 	}
 }
 
+// RedirectResponse redirects to location, status defaults to 302 Found.
+func RedirectResponse(location string, status int) *Response {
+	if status == 0 {
+		status = http.StatusFound
+	}
+	return (&Response{
+		Status: status,
+	}).SetHeader("Location", location)
+}
+
+// IsLocalRedirect reports whether location stays on this site, use it before redirecting to user supplied paths.
+// Browsers drop tabs and newlines and treat \ like /, so "/\t/evil.com" would otherwise land on evil.com.
+func IsLocalRedirect(location string) bool {
+	if !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") || strings.Contains(location, "\\") {
+		return false
+	}
+	for _, char := range location {
+		if char < 0x20 || char == 0x7f {
+			return false
+		}
+	}
+	parsed, err := url.Parse(location)
+	return err == nil && parsed.Scheme == "" && parsed.Host == ""
+}
+
 // NotFoundResponse is a utility function for responding with 404 HTTP status.
+func NotFoundResponse() *Response {
+	return ErrorToResponse(ErrNotFound("doesn't exist"))
+}
+
+// NotFoundResponseWithMessage is NotFoundResponse with a custom message.
 func NotFoundResponseWithMessage(message string) *Response {
-	return &Response{
-		Status: http.StatusNotFound,
-		Body:   fmt.Sprintf("{\"Msg\": %s}", message),
-	}
+	return ErrorToResponse(ErrNotFound(message))
 }
 
 // InvalidActionResponse creates response when an invalid action is requested.
 func InvalidActionResponse() *Response {
-	return &Response{
-		Status: http.StatusNotFound,
-		Body:   "{\"Msg\": \"invalid action\"}",
-	}
+	return ErrorToResponse(NewAPIError(http.StatusNotFound, "invalid_action", "invalid action"))
 }
 
 // ErrorResponse is a utility function for responding during error states (HTTP status code 500).
@@ -111,24 +216,38 @@ func ErrorResponse(err error) *Response {
 	CaptureSentryException(err.Error())
 	return &Response{
 		Status: http.StatusInternalServerError,
-		Body:   "{\"Msg\": \"something went wrong on our side\"}",
+		Body:   ErrInternal(err),
 	}
 }
 
 // ClientErrorResponse is similar to ErrorResponse but status 400 (client error).
 // It sends the error string back to client as Msg.
 func ClientErrorResponse(e error) *Response {
-	return &Response{
-		Status: http.StatusBadRequest,
-		Body:   "{\"Msg\": \"" + e.Error() + "\"}",
+	var apiErr *APIError
+	if errors.As(e, &apiErr) {
+		return ErrorToResponse(apiErr)
 	}
+	return ErrorToResponse(ErrBadRequest(e.Error()))
 }
 
 func AuthFailedResponse() *Response {
-	return &Response{
-		Status: http.StatusUnauthorized,
-		Body:   "{\"Msg\": \"Auth failed, please try again\"}",
-	}
+	return ErrorToResponse(ErrUnauthorized(authFailedMsg))
+}
+
+// ForbiddenResponse is for callers who are authenticated but not allowed, AuthFailedResponse is for unknown callers.
+func ForbiddenResponse() *Response {
+	return ErrorToResponse(ErrForbidden(forbiddenMsg))
+}
+
+// TooManyRequestsResponse answers 429, Retry-After is rounded up to whole seconds.
+func TooManyRequestsResponse(retryAfter time.Duration) *Response {
+	resp := ErrorToResponse(ErrTooManyRequests(rateLimitedMsg))
+	return resp.SetHeader("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// ForbiddenResponseWithMessage is ForbiddenResponse with a custom message.
+func ForbiddenResponseWithMessage(message string) *Response {
+	return ErrorToResponse(ErrForbidden(message))
 }
 
 // IsSuccess confirms whether a response is a success response.
@@ -159,11 +278,16 @@ func IsNotFound(resp *Response) bool {
 
 func GetResp(apiResp interface{}, statusCode int, errMsg *string) *Response {
 
+	msg := ""
+	if errMsg != nil {
+		msg = *errMsg
+	}
+
 	switch statusCode {
 	case http.StatusBadRequest:
-		return ClientErrorResponse(errors.New(*errMsg))
+		return ErrorToResponse(ErrBadRequest(msg))
 	case http.StatusInternalServerError:
-		return ErrorResponse(errors.New(*errMsg))
+		return ErrorToResponse(ErrInternal(errors.New(msg)))
 	case http.StatusNotFound:
 		return NotFoundResponse()
 	}
@@ -0,0 +1,511 @@
+package lib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	defaultJWKSCacheTTL    = time.Hour
+	defaultJWTClockSkew    = 30 * time.Second
+	minJWKSRefreshInterval = time.Minute
+	jwksFetchTimeout       = 10 * time.Second
+
+	invalidTokenReason = "invalid or expired token" // Auth.Reason for rejected tokens, details only go to logs
+)
+
+type JWTConfig struct {
+	JWKSUrl          string   `json:"JWKSUrl"`    // Falls back to Config.JwtValidationUrl
+	Issuer           string   `json:"Issuer"`     // iss has to match when set
+	Audience         []string `json:"Audience"`   // aud has to contain one of these when set
+	Algorithms       []string `json:"Algorithms"` // Defaults to RS256 and ES256, plus HS256 when HMACSecret is set
+	HMACSecret       string   `json:"HMACSecret"`
+	ClockSkewSeconds int      `json:"ClockSkewSeconds"` // Leeway for exp/nbf/iat, defaults to 30
+	JWKSCacheSeconds int      `json:"JWKSCacheSeconds"` // Defaults to an hour, unknown kids refresh earlier
+	UserIdClaim      string   `json:"UserIdClaim"`      // Defaults to sub
+}
+
+// JWTClaims is what JWTValidator puts into Auth.Payload.
+type JWTClaims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	ID        string
+	Scopes    []string       // From space separated "scope" or "scp" array
+	Raw       map[string]any // Every claim as sent, use Decode for custom ones
+}
+
+// Decode copies raw claims into v, handy for provider specific claims.
+func (claims *JWTClaims) Decode(v any) error {
+	data, err := json.Marshal(claims.Raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ClaimsFromAuth returns claims set by JWTValidator, nil for other validators.
+func ClaimsFromAuth(auth Auth) *JWTClaims {
+	switch payload := auth.Payload.(type) {
+	case *JWTClaims:
+		return payload
+	case *OktaAuth:
+		return payload.JWTClaims
+	}
+	return nil
+}
+
+type JWTValidator struct {
+	config    *JWTConfig
+	jwks      *jwksCache
+	parser    *jwt.Parser
+	clockSkew time.Duration
+}
+
+// NewJWTValidator verifies bearer tokens, config nil uses Config.JWT.
+// Key sets are shared per JWKS url so routes can create their own callbacks freely.
+// A callback used by several services builds a validator for each, from that service's config.
+func NewJWTValidator(config *JWTConfig) AuthValidatorCallback {
+	var mu sync.Mutex
+	validators := make(map[*Service]*JWTValidator)
+	return func(service *Service) AuthValidator {
+		mu.Lock()
+		defer mu.Unlock()
+		validator, found := validators[service]
+		if !found {
+			validator = service.newJWTValidator(config)
+			validators[service] = validator
+		}
+		return validator
+	}
+}
+
+func (s *Service) newJWTValidator(config *JWTConfig) *JWTValidator {
+	if config == nil {
+		config = s.Config.JWT
+	}
+	if config == nil {
+		config = &JWTConfig{}
+	}
+
+	validator := &JWTValidator{
+		config:    config,
+		clockSkew: defaultJWTClockSkew,
+	}
+	if config.ClockSkewSeconds > 0 {
+		validator.clockSkew = time.Duration(config.ClockSkewSeconds) * time.Second
+	}
+
+	algorithms := config.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{"RS256", "ES256"}
+		if StringLenGtZero(config.HMACSecret) {
+			algorithms = append(algorithms, "HS256")
+		}
+	}
+	validator.parser = &jwt.Parser{ValidMethods: algorithms, UseJSONNumber: true, SkipClaimsValidation: true}
+
+	jwksUrl := config.JWKSUrl
+	if !StringLenGtZero(jwksUrl) {
+		jwksUrl = s.Config.JwtValidationUrl
+	}
+	if StringLenGtZero(jwksUrl) {
+		ttl := defaultJWKSCacheTTL
+		if config.JWKSCacheSeconds > 0 {
+			ttl = time.Duration(config.JWKSCacheSeconds) * time.Second
+		}
+		validator.jwks = s.jwksCache(jwksUrl, ttl)
+	}
+
+	return validator
+}
+
+func (v *JWTValidator) SecurityScheme() (string, SecurityScheme) {
+	return "bearerJWT", SecurityScheme{Type: "http", Scheme: "bearer", BearerFormat: "JWT"}
+}
+
+func (v *JWTValidator) Validate(req *Request) Auth {
+	token := bearerToken(req)
+	if !StringLenGtZero(token) {
+		return Auth{}
+	}
+
+	claims, err := v.Verify(req.Context(), token)
+	if err != nil {
+		req.Log().Info("jwt rejected", "error", err)
+		return Auth{Reason: invalidTokenReason}
+	}
+
+	userIdClaim := v.config.UserIdClaim
+	if !StringLenGtZero(userIdClaim) {
+		userIdClaim = "sub"
+	}
+	userId, _ := claims.Raw[userIdClaim].(string)
+
+	return Auth{
+		IsAuthenticated: true,
+		UserId:          userId,
+		Payload:         claims,
+	}
+}
+
+// Verify checks signature and registered claims, usable outside of request auth e.g. for websocket first messages.
+func (v *JWTValidator) Verify(ctx context.Context, token string) (*JWTClaims, error) {
+	mapClaims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, mapClaims, func(parsed *jwt.Token) (interface{}, error) {
+		return v.key(ctx, parsed)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := typedClaims(mapClaims)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.validateClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTValidator) key(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	if strings.HasPrefix(token.Method.Alg(), "HS") {
+		if !StringLenGtZero(v.config.HMACSecret) {
+			return nil, errors.New("hmac signed tokens aren't accepted")
+		}
+		return []byte(v.config.HMACSecret), nil
+	}
+	if v.jwks == nil {
+		return nil, errors.New("no JWKS url configured")
+	}
+	kid, _ := token.Header["kid"].(string)
+	return v.jwks.key(ctx, kid)
+}
+
+func (v *JWTValidator) validateClaims(claims *JWTClaims, now time.Time) error {
+	if claims.ExpiresAt.IsZero() {
+		return errors.New("token has no exp")
+	}
+	if now.After(claims.ExpiresAt.Add(v.clockSkew)) {
+		return errors.New("token is expired")
+	}
+	if !claims.NotBefore.IsZero() && now.Add(v.clockSkew).Before(claims.NotBefore) {
+		return errors.New("token is not valid yet")
+	}
+	if !claims.IssuedAt.IsZero() && now.Add(v.clockSkew).Before(claims.IssuedAt) {
+		return errors.New("token is issued in the future")
+	}
+	if StringLenGtZero(v.config.Issuer) && claims.Issuer != v.config.Issuer {
+		return fmt.Errorf("unexpected issuer %s", claims.Issuer)
+	}
+	if len(v.config.Audience) > 0 && !hasCommon(claims.Audience, v.config.Audience) {
+		return fmt.Errorf("unexpected audience %v", claims.Audience)
+	}
+	return nil
+}
+
+func hasCommon(values []string, allowed []string) bool {
+	for _, value := range values {
+		for _, allowedValue := range allowed {
+			if value == allowedValue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func bearerToken(req *Request) string {
+	val := req.GetHeaderVal("Authorization")
+	if val == nil {
+		return ""
+	}
+	scheme, token, found := strings.Cut(*val, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func typedClaims(raw jwt.MapClaims) (*JWTClaims, error) {
+	claims := &JWTClaims{Raw: map[string]any(raw)}
+	claims.Subject, _ = raw["sub"].(string)
+	claims.Issuer, _ = raw["iss"].(string)
+	claims.ID, _ = raw["jti"].(string)
+
+	var err error
+	if claims.Audience, err = stringOrList(raw["aud"]); err != nil {
+		return nil, fmt.Errorf("invalid aud: %w", err)
+	}
+	for claim, target := range map[string]*time.Time{"exp": &claims.ExpiresAt, "nbf": &claims.NotBefore, "iat": &claims.IssuedAt} {
+		if *target, err = numericDate(raw[claim]); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", claim, err)
+		}
+	}
+
+	if scope, isStr := raw["scope"].(string); isStr {
+		claims.Scopes = strings.Fields(scope)
+	} else if claims.Scopes, err = stringOrList(raw["scp"]); err != nil {
+		return nil, fmt.Errorf("invalid scp: %w", err)
+	}
+
+	return claims, nil
+}
+
+func stringOrList(value any) ([]string, error) {
+	switch typed := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{typed}, nil
+	case []interface{}:
+		values := make([]string, 0, len(typed))
+		for _, item := range typed {
+			str, isStr := item.(string)
+			if !isStr {
+				return nil, errors.New("expected strings")
+			}
+			values = append(values, str)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected type %T", value)
+}
+
+func numericDate(value any) (time.Time, error) {
+	switch typed := value.(type) {
+	case nil:
+		return time.Time{}, nil
+	case json.Number:
+		seconds, err := typed.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(int64(seconds), 0), nil
+	case float64:
+		return time.Unix(int64(typed), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unexpected type %T", value)
+}
+
+// jwksCache keeps keys of a single JWKS url, unknown kids trigger a refresh so rotated keys are picked up early.
+type jwksCache struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]interface{}
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	refreshing  chan struct{} // Closed once the running fetch is done, nil when none is
+	refreshErr  error         // Outcome of the last fetch, for callers that waited on it
+}
+
+func (s *Service) jwksCache(url string, ttl time.Duration) *jwksCache {
+	s.jwksMu.Lock()
+	defer s.jwksMu.Unlock()
+	if s.jwksCaches == nil {
+		s.jwksCaches = make(map[string]*jwksCache)
+	}
+	if cache, found := s.jwksCaches[url]; found {
+		return cache
+	}
+	cache := &jwksCache{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+	}
+	s.jwksCaches[url] = cache
+	return cache
+}
+
+func (cache *jwksCache) key(ctx context.Context, kid string) (interface{}, error) {
+	cache.mu.RLock()
+	key, found := cache.lookup(kid)
+	fresh := time.Since(cache.fetchedAt) < cache.ttl
+	cache.mu.RUnlock()
+	if found && fresh {
+		return key, nil
+	}
+
+	if err := cache.refresh(ctx); err != nil {
+		// Stale keys beat locking everyone out while the IdP is down.
+		if found {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	if key, found := cache.lookup(kid); found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown kid %s", kid)
+}
+
+// lookup expects the lock to be held, tokens without kid are fine as long as there's a single key.
+func (cache *jwksCache) lookup(kid string) (interface{}, bool) {
+	if StringLenGtZero(kid) {
+		key, found := cache.keys[kid]
+		return key, found
+	}
+	if len(cache.keys) == 1 {
+		for _, key := range cache.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// refresh fetches the key set without holding the lock so verification with cached keys carries on,
+// concurrent callers wait for the fetch already running instead of starting their own.
+// The fetch is detached from ctx, a caller giving up doesn't fail it for everyone else waiting.
+func (cache *jwksCache) refresh(ctx context.Context) error {
+	cache.mu.Lock()
+	done := cache.refreshing
+	if done == nil {
+		// Garbage kids shouldn't be able to hammer the IdP.
+		if time.Since(cache.lastAttempt) < minJWKSRefreshInterval {
+			cache.mu.Unlock()
+			return nil
+		}
+		done = make(chan struct{})
+		cache.refreshing = done
+		fetchCtx := context.WithoutCancel(ctx)
+		GoFuncWrapper("jwks refresh", func() {
+			cache.runRefresh(fetchCtx, done)
+		})
+	}
+	cache.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	return cache.refreshErr
+}
+
+func (cache *jwksCache) runRefresh(ctx context.Context, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	keys, err := cache.fetch(ctx)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if err == nil {
+		cache.keys = keys
+		cache.fetchedAt = time.Now()
+	}
+	// Throttle from when the fetch finished, a slow IdP isn't asked again straight away.
+	cache.lastAttempt = time.Now()
+	cache.refreshErr = err
+	cache.refreshing = nil
+	close(done)
+}
+
+func (cache *jwksCache) fetch(ctx context.Context) (map[string]interface{}, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, cache.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cache.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS fetch returned %d", resp.StatusCode)
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range keySet.Keys {
+		if StringLenGtZero(jwk.Use) && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			slog.Warn("skipping JWKS key", "kid", jwk.Kid, "error", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
@@ -0,0 +1,366 @@
+package lib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    []map[string]string
+	fetches atomic.Int32
+	gate    chan struct{} // Fetches wait for it to close when set
+}
+
+func newJWKSServer() *jwksServer {
+	server := &jwksServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.fetches.Add(1)
+		server.mu.Lock()
+		gate := server.gate
+		server.mu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": server.keys})
+	}))
+	return server
+}
+
+func (server *jwksServer) setKeys(keys ...map[string]string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.keys = keys
+}
+
+func b64(value []byte) string {
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(key.X.Bytes()), "y": b64(key.Y.Bytes())}
+}
+
+func signJWT(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if StringLenGtZero(kid) {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func bearerReq(token string) *Request {
+	return &Request{Header: http.Header{"Authorization": []string{"Bearer " + token}}}
+}
+
+func TestJWTValidator(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwks := newJWKSServer()
+	defer jwks.Close()
+	jwks.setKeys(rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey))
+
+	s := NewService(&Config{
+		JwtValidationUrl: jwks.URL,
+		JWT: &JWTConfig{
+			Issuer:           "https://issuer.example.com",
+			Audience:         []string{"api"},
+			HMACSecret:       "shared-secret",
+			ClockSkewSeconds: 60,
+		},
+	}, &[]App{})
+	validator := NewJWTValidator(nil)(s)
+
+	now := time.Now()
+	validClaims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"sub":   "user-1",
+			"iss":   "https://issuer.example.com",
+			"aud":   []string{"other", "api"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"scope": "read write",
+		}
+		for key, value := range overrides {
+			if value == nil {
+				delete(claims, key)
+				continue
+			}
+			claims[key] = value
+		}
+		return claims
+	}
+
+	type input struct {
+		title   string
+		token   string
+		expAuth bool
+	}
+
+	inputs := []input{
+		{
+			title:   "RS256",
+			token:   signJWT(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(nil)),
+			expAuth: true,
+		},
+		{
+			title:   "ES256",
+			token:   signJWT(t, jwt.SigningMethodES256, "ec-1", ecKey, validClaims(nil)),
+			expAuth: true,
+		},
+		{
+			title:   "HS256",
+			token:   signJWT(t, jwt.SigningMethodHS256, "", []byte("shared-secret"), validClaims(jwt.MapClaims{"aud": "api"})),
+			expAuth: true,
+		},
+		{
+			title:   "Expired within clock skew",
+			token:   signJWT(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()})),
+			expAuth: true,
+		},
+		{
+			title: "Expired",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"exp": now.Add(-2 * time.Minute).Unix()})),
+		},
+		{
+			title: "Missing exp",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"exp": nil})),
+		},
+		{
+			title: "Not valid yet",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"nbf": now.Add(5 * time.Minute).Unix()})),
+		},
+		{
+			title: "Wrong issuer",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"iss": "https://evil.example.com"})),
+		},
+		{
+			title: "Wrong audience",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"aud": "other"})),
+		},
+		{
+			title: "Signed by unknown key",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa-1", otherKey, validClaims(nil)),
+		},
+		{
+			title: "Unknown kid",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa-9", otherKey, validClaims(nil)),
+		},
+		{
+			title: "Alg none",
+			token: signJWT(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, validClaims(nil)),
+		},
+		{
+			title: "Garbage",
+			token: "not-a-token",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			auth := validator.Validate(bearerReq(input.token))
+			if auth.IsAuthenticated != input.expAuth {
+				t.Fatalf("expected %t got %t", input.expAuth, auth.IsAuthenticated)
+			}
+			if !input.expAuth {
+				return
+			}
+			claims := ClaimsFromAuth(auth)
+			if auth.UserId != "user-1" || claims.Subject != "user-1" || len(claims.Scopes) != 2 {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+		})
+	}
+
+	t.Run("Missing header", func(t *testing.T) {
+		if validator.Validate(&Request{Header: http.Header{}}).IsAuthenticated {
+			t.Error("expected unauthenticated")
+		}
+	})
+}
+
+func TestJWTValidatorKeyRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwks := newJWKSServer()
+	defer jwks.Close()
+	jwks.setKeys(rsaJWK("old", oldKey))
+
+	s := NewService(&Config{JWT: &JWTConfig{JWKSUrl: jwks.URL}}, &[]App{})
+	validator := NewJWTValidator(nil)(s)
+	claims := jwt.MapClaims{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if !validator.Validate(bearerReq(signJWT(t, jwt.SigningMethodRS256, "old", oldKey, claims))).IsAuthenticated {
+		t.Fatal("expected old key to work")
+	}
+	if !validator.Validate(bearerReq(signJWT(t, jwt.SigningMethodRS256, "old", oldKey, claims))).IsAuthenticated {
+		t.Fatal("expected cached key to work")
+	}
+	if got := jwks.fetches.Load(); got != 1 {
+		t.Errorf("expected keys to be cached, got %d fetches", got)
+	}
+
+	// New kid shows up, refresh is throttled so force it by pretending the last attempt was a while ago.
+	jwks.setKeys(rsaJWK("old", oldKey), rsaJWK("new", newKey))
+	cache := s.jwksCache(jwks.URL, defaultJWKSCacheTTL)
+	cache.mu.Lock()
+	cache.lastAttempt = time.Now().Add(-2 * minJWKSRefreshInterval)
+	cache.mu.Unlock()
+
+	if !validator.Validate(bearerReq(signJWT(t, jwt.SigningMethodRS256, "new", newKey, claims))).IsAuthenticated {
+		t.Fatal("expected rotated key to be fetched")
+	}
+
+	// Unknown kids right after a refresh don't hit the JWKS endpoint again.
+	fetches := jwks.fetches.Load()
+	validator.Validate(bearerReq(signJWT(t, jwt.SigningMethodRS256, "bogus", newKey, claims)))
+	if got := jwks.fetches.Load(); got != fetches {
+		t.Errorf("expected refresh to be throttled, got %d fetches", got)
+	}
+}
+
+func TestJWKSRefreshDoesntBlockVerification(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwks := newJWKSServer()
+	defer jwks.Close()
+	jwks.setKeys(rsaJWK("old", oldKey))
+
+	s := NewService(&Config{JWT: &JWTConfig{JWKSUrl: jwks.URL}}, &[]App{})
+	validator := NewJWTValidator(nil)(s)
+	claims := jwt.MapClaims{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()}
+	oldToken, newToken := signJWT(t, jwt.SigningMethodRS256, "old", oldKey, claims), signJWT(t, jwt.SigningMethodRS256, "new", newKey, claims)
+	if !validator.Validate(bearerReq(oldToken)).IsAuthenticated {
+		t.Fatal("expected old key to work")
+	}
+
+	gate := make(chan struct{})
+	jwks.mu.Lock()
+	jwks.gate = gate
+	jwks.mu.Unlock()
+	jwks.setKeys(rsaJWK("old", oldKey), rsaJWK("new", newKey))
+	cache := s.jwksCache(jwks.URL, defaultJWKSCacheTTL)
+	cache.mu.Lock()
+	cache.lastAttempt = time.Now().Add(-2 * minJWKSRefreshInterval)
+	cache.mu.Unlock()
+
+	// Both wait on a single fetch for the new kid.
+	results := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- validator.Validate(bearerReq(newToken)).IsAuthenticated }()
+	}
+	for jwks.fetches.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	verified := make(chan bool)
+	go func() { verified <- validator.Validate(bearerReq(oldToken)).IsAuthenticated }()
+	select {
+	case ok := <-verified:
+		if !ok {
+			t.Error("expected cached key to keep working during the refresh")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("verification with a cached key waited for the refresh")
+	}
+
+	close(gate)
+	for i := 0; i < 2; i++ {
+		if !<-results {
+			t.Error("expected rotated key to verify once fetched")
+		}
+	}
+	if got := jwks.fetches.Load(); got != 2 {
+		t.Errorf("expected concurrent refreshes to share one fetch, got %d fetches", got)
+	}
+}
+
+func TestJWKSRefreshOutlivesCancelledCaller(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwks := newJWKSServer()
+	defer jwks.Close()
+	jwks.setKeys(rsaJWK("current", key))
+	gate := make(chan struct{})
+	jwks.gate = gate
+
+	s := NewService(&Config{JWT: &JWTConfig{JWKSUrl: jwks.URL}}, &[]App{})
+	cache := s.jwksCache(jwks.URL, defaultJWKSCacheTTL)
+
+	// First caller starts the fetch and gives up while it's running.
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := cache.key(ctx, "current")
+		firstErr <- err
+	}()
+	for jwks.fetches.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	waiter := make(chan error)
+	go func() {
+		_, err := cache.key(context.Background(), "current")
+		waiter <- err
+	}()
+	cancel()
+	if err := <-firstErr; err == nil {
+		t.Error("expected cancelled caller to give up")
+	}
+
+	close(gate)
+	if err := <-waiter; err != nil {
+		t.Errorf("expected waiting caller to get the fetched keys got %s", err)
+	}
+	if _, err := cache.key(context.Background(), "current"); err != nil {
+		t.Errorf("expected keys to be cached got %s", err)
+	}
+	if got := jwks.fetches.Load(); got != 1 {
+		t.Errorf("expected a single fetch got %d", got)
+	}
+}
+
+func TestJWTValidatorPerService(t *testing.T) {
+	callback := NewJWTValidator(nil)
+	first := NewService(&Config{JWT: &JWTConfig{HMACSecret: "first"}}, &[]App{})
+	second := NewService(&Config{JWT: &JWTConfig{HMACSecret: "second"}}, &[]App{})
+	claims := jwt.MapClaims{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if !callback(first).Validate(bearerReq(signJWT(t, jwt.SigningMethodHS256, "", []byte("first"), claims))).IsAuthenticated {
+		t.Error("expected first service to use its own secret")
+	}
+	if !callback(second).Validate(bearerReq(signJWT(t, jwt.SigningMethodHS256, "", []byte("second"), claims))).IsAuthenticated {
+		t.Error("expected second service to use its own secret")
+	}
+	if callback(first) != callback(first) {
+		t.Error("expected the validator to be built once per service")
+	}
+}
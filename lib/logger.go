@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+)
+
+const redactedValue = "[REDACTED]"
+
+// Keys equal to any of these are always masked, config can extend this list via Log.RedactKeys.
+var defaultRedactKeys = []string{
+	"authorization",
+	"proxy-authorization",
+	"password",
+	"secret",
+	"token",
+	"api_key",
+	"apikey",
+	"x-api-key",
+	"private_key",
+	"cookie",
+	"set-cookie",
+}
+
+// Keys ending with any of these are masked too, e.g. refresh_token, client_secret or X-Csrf-Token.
+var redactKeySuffixes = []string{
+	"_token",
+	"-token",
+	"_secret",
+	"-secret",
+	"_password",
+	"-password",
+}
+
+type LogConfig struct {
+	Level      string            `json:"Level"`      // DEBUG, INFO, WARN, ERROR
+	Levels     map[string]string `json:"Levels"`     // Level overrides keyed on app title or component(sqs, redis..)
+	Format     string            `json:"Format"`     // json or text, defaults to text on LOCAL and json otherwise
+	RedactKeys []string          `json:"RedactKeys"` // Additional keys to be masked in log output, matched exactly ignoring case
+}
+
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToUpper(strings.TrimSpace(level)) {
+	case "DEBUG":
+		return slog.LevelDebug
+	case "WARN", "WARNING":
+		return slog.LevelWarn
+	case "ERROR":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// NewLogger builds the service wide logger, output is JSON unless running LOCAL.
+func NewLogger(config *Config, w io.Writer) *slog.Logger {
+	logConfig := config.Log
+	if logConfig == nil {
+		logConfig = &LogConfig{}
+	}
+
+	levels := make(map[string]slog.Level)
+	for component, level := range logConfig.Levels {
+		levels[component] = parseLogLevel(level)
+	}
+
+	return slog.New(&leveledHandler{
+		handler: newLogHandler(config, w),
+		level:   parseLogLevel(logConfig.Level),
+		levels:  levels,
+	})
+}
+
+// newLogHandler formats and redacts records without any level gate, that's left to leveledHandler.
+func newLogHandler(config *Config, w io.Writer) slog.Handler {
+	logConfig := config.Log
+	if logConfig == nil {
+		logConfig = &LogConfig{}
+	}
+	if w == nil {
+		w = os.Stdout
+	}
+
+	redactKeys := make(map[string]bool)
+	for _, key := range append(defaultRedactKeys, logConfig.RedactKeys...) {
+		redactKeys[strings.ToLower(key)] = true
+	}
+
+	opts := &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			return redactAttr(redactKeys, attr)
+		},
+	}
+
+	format := strings.ToLower(logConfig.Format)
+	if format == "" {
+		format = "json"
+		if config.ENV == "LOCAL" {
+			format = "text"
+		}
+	}
+
+	if format == "text" {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+// leveledHandler picks the minimum level based on the app or component a logger is scoped to.
+type leveledHandler struct {
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+}
+
+func (h *leveledHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *leveledHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *leveledHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	level := h.level
+	for _, attr := range attrs {
+		if attr.Key != "app" && attr.Key != "component" {
+			continue
+		}
+		if componentLevel, found := h.levels[attr.Value.String()]; found {
+			level = componentLevel
+		}
+	}
+	return &leveledHandler{
+		handler: h.handler.WithAttrs(attrs),
+		level:   level,
+		levels:  h.levels,
+	}
+}
+
+func (h *leveledHandler) WithGroup(name string) slog.Handler {
+	return &leveledHandler{
+		handler: h.handler.WithGroup(name),
+		level:   h.level,
+		levels:  h.levels,
+	}
+}
+
+func redactAttr(redactKeys map[string]bool, attr slog.Attr) slog.Attr {
+	if isRedactKey(redactKeys, attr.Key) {
+		return slog.String(attr.Key, redactedValue)
+	}
+	if attr.Value.Kind() == slog.KindAny {
+		return slog.Any(attr.Key, redactValue(redactKeys, attr.Value.Any()))
+	}
+	return attr
+}
+
+// isRedactKey matches whole keys case insensitively so ids and counters named after secrets(api_key_id,
+// token_type) still show up.
+func isRedactKey(redactKeys map[string]bool, key string) bool {
+	key = strings.ToLower(key)
+	if redactKeys[key] {
+		return true
+	}
+	for _, suffix := range redactKeySuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue masks sensitive keys of maps keyed by strings, named ones(http.Header, url.Values) included.
+// Maps come back as map[string]any, which logs the same way.
+func redactValue(redactKeys map[string]bool, value any) any {
+	mapValue := reflect.ValueOf(value)
+	if mapValue.Kind() != reflect.Map || mapValue.Type().Key().Kind() != reflect.String {
+		return value
+	}
+	redacted := make(map[string]any, mapValue.Len())
+	iter := mapValue.MapRange()
+	for iter.Next() {
+		key := iter.Key().String()
+		if isRedactKey(redactKeys, key) {
+			redacted[key] = redactedValue
+			continue
+		}
+		redacted[key] = redactValue(redactKeys, iter.Value().Interface())
+	}
+	return redacted
+}
+
+// traceIDFromContext returns sentry's trace ID when a transaction is running, falls back to request ID.
+func traceIDFromContext(ctx context.Context, fallback string) string {
+	if ctx == nil {
+		return fallback
+	}
+	if span := sentry.TransactionFromContext(ctx); span != nil {
+		return span.TraceID.String()
+	}
+	return fallback
+}
+
+// newRequestLogger scopes logger with all the request level fields.
+func (s *Service) newRequestLogger(req *Request, action string) *slog.Logger {
+	return s.Logger.With(
+		"app", req.AppTitle,
+		"action", action,
+		"request_id", req.ID,
+		"trace_id", traceIDFromContext(req.SentryContext, req.ID),
+	)
+}
+
+// Log returns request scoped logger, safe to call on requests created outside ServeHTTP.
+func (r *Request) Log() *slog.Logger {
+	if r.Logger == nil {
+		return slog.Default().With("request_id", r.ID)
+	}
+	return r.Logger
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLoggerRedaction(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLogger(&Config{Log: &LogConfig{RedactKeys: []string{"ssn"}}}, buf)
+
+	logger.Info("login", "password", "hunter2", "ssn", "123", "headers", map[string][]string{"Authorization": {"Bearer abc"}}, "user", "bob")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected json log line got %s", buf.String())
+	}
+	if line["password"] != redactedValue || line["ssn"] != redactedValue {
+		t.Errorf("expected sensitive keys to be redacted got %s", buf.String())
+	}
+	if strings.Contains(buf.String(), "Bearer abc") {
+		t.Errorf("expected authorization header to be redacted got %s", buf.String())
+	}
+	if line["user"] != "bob" {
+		t.Errorf("expected user to be logged got %s", buf.String())
+	}
+
+	buf.Reset()
+	logger.Info("request",
+		"Refresh_Token", "r1",
+		"header", http.Header{"X-Api-Key": {"k1"}, "Set-Cookie": {"c1"}, "Accept": {"text/plain"}},
+		"query", url.Values{"access_token": {"t1"}, "page": {"2"}},
+		"body", map[string]any{"user": map[string]string{"Client_Secret": "s1", "name": "bob"}},
+		"api_key_id", "key-42",
+		"rate_limit_key", "ip:1.1.1.1",
+		"token_type", "Bearer",
+		"keys", 3,
+	)
+	for _, secret := range []string{"r1", "k1", "c1", "t1", "s1"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("expected %s to be redacted got %s", secret, buf.String())
+		}
+	}
+	for _, visible := range []string{"text/plain", `"page":["2"]`, `"name":"bob"`, "key-42", "ip:1.1.1.1", `"token_type":"Bearer"`, `"keys":3`} {
+		if !strings.Contains(buf.String(), visible) {
+			t.Errorf("expected %s to be logged got %s", visible, buf.String())
+		}
+	}
+}
+
+func TestLoggerAppLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLogger(&Config{
+		ENV: "LOCAL",
+		Log: &LogConfig{Level: "WARN", Levels: map[string]string{"mock-app": "DEBUG"}},
+	}, buf)
+
+	logger.Info("service info")
+	if buf.Len() != 0 {
+		t.Errorf("expected info to be dropped at WARN got %s", buf.String())
+	}
+
+	logger.With("app", "mock-app").Debug("app debug")
+	if !strings.Contains(buf.String(), "app debug") {
+		t.Errorf("expected app level override to allow debug got %s", buf.String())
+	}
+
+	buf.Reset()
+	logger.With("app", "other-app").Info("other info")
+	if buf.Len() != 0 {
+		t.Errorf("expected other apps to use default level got %s", buf.String())
+	}
+}
@@ -5,6 +5,14 @@ type OktaConfig struct {
 	Token         string `json:"OKTA_API_TOKEN"`
 	Issuer        string `json:"OKTA_ISSUER"`
 	RetailGroupId string `json:"OKTA_RETAIL_GROUP_ID"`
+
+	ClientId      string   `json:"OKTA_CLIENT_ID"`
+	ClientSecret  string   `json:"OKTA_CLIENT_SECRET"`  // Empty for public clients, PKCE alone protects the code exchange
+	RedirectUrl   string   `json:"OKTA_REDIRECT_URL"`   // Callback of the login app, has to be registered with Okta
+	Audience      string   `json:"OKTA_AUDIENCE"`       // Expected aud of access tokens, e.g. api://default
+	Scopes        []string `json:"OKTA_SCOPES"`         // Defaults to openid, profile and email
+	LoginRedirect string   `json:"OKTA_LOGIN_REDIRECT"` // Where browsers land after login and logout, defaults to /
+	CookieSecret  string   `json:"OKTA_COOKIE_SECRET"`  // Signs the login state cookie, same on every instance
 }
 
 func (OktaConfig *OktaConfig) IsValid() bool {
@@ -15,6 +23,11 @@ type RedisCreds struct {
 	Addr     string
 	Password string
 	Db       int
+
+	CAFile             string // PEM CA of the server when it isn't signed by a public CA
+	ServerName         string // Name on the server certificate, defaults to the host of Addr
+	InsecureSkipVerify bool   // Accepts any server certificate, only for local development
+	DisableTLS         bool   // Plain tcp, e.g. a redis container without tls
 }
 
 type Config struct {
@@ -34,9 +47,15 @@ type Config struct {
 	AuthToken       string `json:"AuthToken"`
 	AllowStressTest bool   `json:"AllowStressTest"`
 
-	JwtValidationUrl string `json:"JwtValidationUrl"`
-	DroneApiUrl      string `json:"DroneApiUrl"`
-	SegmentWriteKey  string `json:"SegmentWriteKey"`
+	JwtValidationUrl string           `json:"JwtValidationUrl"` // JWKS url used by JWTValidator when JWT.JWKSUrl isn't set
+	JWT              *JWTConfig       `json:"JWT"`
+	Okta             *OktaConfig      `json:"Okta"`
+	APIKeys          *APIKeyConfig    `json:"APIKeys"`
+	Signature        *SignatureConfig `json:"Signature"` // Used by NewSignatureValidator(nil)
+	Sessions         *SessionConfig   `json:"Sessions"`
+	RateLimit        *RateLimitConfig `json:"RateLimit"`
+	DroneApiUrl      string           `json:"DroneApiUrl"`
+	SegmentWriteKey  string           `json:"SegmentWriteKey"`
 
 	NotificationApiUrl string `json:"NotificationApiUrl"`
 
@@ -46,6 +65,19 @@ type Config struct {
 
 	DbUrl      string      `json:"DbUrl"`
 	RedisCreds *RedisCreds `json:"Redis"`
+	TLS        *TLSConfig  `json:"TLS"` // Serves https, and mTLS with ClientCAFile
+
+	Log            *LogConfig       `json:"Log"`
+	AccessLog      *AccessLogConfig `json:"AccessLog"`
+	TrustedProxies []string         `json:"TrustedProxies"` // IPs or CIDRs allowed to set X-Forwarded-For
+	Health         *HealthConfig    `json:"Health"`
+	ProblemJSON    bool             `json:"ProblemJSON"` // Send errors as RFC 7807 application/problem+json
+
+	SSEHeartbeatSeconds int               `json:"SSEHeartbeatSeconds"` // Interval of keep-alive comments on event streams, defaults to 15
+	WebSocket           *WebSocketConfig  `json:"WebSocket"`
+	CORS                *CORSConfig       `json:"CORS"` // Allows every origin when not set
+	Versioning          *VersioningConfig `json:"Versioning"`
+	OpenAPI             *OpenAPIConfig    `json:"OpenAPI"`
 }
 
 func (config *Config) IsValid() bool {
@@ -0,0 +1,453 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oktaDiscoveryTTL   = time.Hour
+	oktaDiscoveryRetry = time.Minute // Failed refreshes keep the previous document this long before trying again
+	oktaGroupsTTL      = 5 * time.Minute
+	oktaHTTPTimeout    = 10 * time.Second
+
+	// OktaTokenCookie carries the access token for browser clients logged in through the auth code flow.
+	OktaTokenCookie = "okta_access_token"
+)
+
+// OIDCDiscovery is the subset of the issuer's openid-configuration we rely on.
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type OIDCTokens struct {
+	AccessToken  string `json:"access_token"`
+	IdToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+type IntrospectionResult struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub"`
+	Username  string `json:"username"`
+	UserId    string `json:"uid"`
+	Scope     string `json:"scope"`
+	ClientId  string `json:"client_id"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type OktaGroup struct {
+	Id      string `json:"id"`
+	Profile struct {
+		Name string `json:"name"`
+	} `json:"profile"`
+}
+
+// OktaAuth is the Auth.Payload set by OktaValidator.
+type OktaAuth struct {
+	*JWTClaims
+	Groups   []string // Group names from the token's groups claim, or from Okta API when the claim is missing
+	GroupIds []string // Group ids from Okta API, only set when the validator checks groups
+}
+
+// OktaClient talks to the issuer (discovery, tokens, introspection) and to Okta management API for groups.
+type OktaClient struct {
+	config     *OktaConfig
+	service    *Service
+	httpClient *http.Client
+
+	mu               sync.Mutex
+	discovery        *OIDCDiscovery
+	discoveryAt      time.Time
+	discoveryAttempt time.Time
+	accessJWT        *JWTValidator
+	idJWT            *JWTValidator
+
+	groupsMu    sync.Mutex
+	groups      map[string]cachedGroups
+	groupsSweep time.Time
+}
+
+type cachedGroups struct {
+	groups    []OktaGroup
+	expiresAt time.Time
+}
+
+// Okta returns the client for Config.Okta, created on first use.
+func (s *Service) Okta() *OktaClient {
+	s.oktaOnce.Do(func() {
+		if s.Config.Okta == nil || !StringLenGtZero(s.Config.Okta.Issuer) {
+			errTxt := "Okta config with an issuer is required"
+			CheckFatal(errors.New(errTxt), errTxt)
+		}
+		s.okta = &OktaClient{
+			config:     s.Config.Okta,
+			service:    s,
+			httpClient: &http.Client{Timeout: oktaHTTPTimeout},
+			groups:     make(map[string]cachedGroups),
+		}
+	})
+	return s.okta
+}
+
+func (client *OktaClient) Config() *OktaConfig {
+	return client.config
+}
+
+// Discovery fetches openid-configuration from issuer, cached for an hour.
+// A failed refresh keeps serving the previous document and is retried at most once a minute.
+func (client *OktaClient) Discovery(ctx context.Context) (*OIDCDiscovery, error) {
+	client.mu.Lock()
+	previous := client.discovery
+	if previous != nil && (time.Since(client.discoveryAt) < oktaDiscoveryTTL || time.Since(client.discoveryAttempt) < oktaDiscoveryRetry) {
+		client.mu.Unlock()
+		return previous, nil
+	}
+	client.discoveryAttempt = time.Now()
+	client.mu.Unlock()
+
+	// Fetched without the lock so requests don't queue behind a slow issuer.
+	discovery, err := client.fetchDiscovery(ctx)
+	if err != nil {
+		if previous != nil {
+			// Keep using what we had, issuer hiccups shouldn't log everyone out.
+			client.service.Logger.Error("refreshing okta discovery failed, using the previous one", "error", err)
+			return previous, nil
+		}
+		return nil, err
+	}
+
+	audience := []string{}
+	if StringLenGtZero(client.config.Audience) {
+		audience = append(audience, client.config.Audience)
+	}
+	accessJWT := client.service.newJWTValidator(&JWTConfig{JWKSUrl: discovery.JwksUri, Issuer: discovery.Issuer, Audience: audience})
+	idJWT := client.service.newJWTValidator(&JWTConfig{JWKSUrl: discovery.JwksUri, Issuer: discovery.Issuer, Audience: []string{client.config.ClientId}})
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.accessJWT, client.idJWT = accessJWT, idJWT
+	client.discovery = discovery
+	client.discoveryAt = time.Now()
+	return discovery, nil
+}
+
+func (client *OktaClient) fetchDiscovery(ctx context.Context) (*OIDCDiscovery, error) {
+	discoveryUrl := strings.TrimSuffix(client.config.Issuer, "/") + "/.well-known/openid-configuration"
+	discovery := &OIDCDiscovery{}
+	if err := client.getJSON(ctx, discoveryUrl, nil, discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != strings.TrimSuffix(client.config.Issuer, "/") {
+		return nil, fmt.Errorf("discovery issuer %s doesn't match %s", discovery.Issuer, client.config.Issuer)
+	}
+	return discovery, nil
+}
+
+// jwtValidators returns the access and id token validators for the current discovery document.
+func (client *OktaClient) jwtValidators(ctx context.Context) (*JWTValidator, *JWTValidator, error) {
+	if _, err := client.Discovery(ctx); err != nil {
+		return nil, nil, err
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.accessJWT, client.idJWT, nil
+}
+
+// VerifyAccessToken checks signature, issuer, audience and expiry locally against the issuer's keys.
+func (client *OktaClient) VerifyAccessToken(ctx context.Context, token string) (*JWTClaims, error) {
+	accessJWT, _, err := client.jwtValidators(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return accessJWT.Verify(ctx, token)
+}
+
+// VerifyIDToken checks an id_token from the auth code flow, nonce has to match the one sent with the login redirect.
+func (client *OktaClient) VerifyIDToken(ctx context.Context, token string, nonce string) (*JWTClaims, error) {
+	_, idJWT, err := client.jwtValidators(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := idJWT.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if tokenNonce, _ := claims.Raw["nonce"].(string); tokenNonce != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// Introspect asks the issuer whether token is still active, catches revoked tokens local verification can't.
+func (client *OktaClient) Introspect(ctx context.Context, token string) (*IntrospectionResult, error) {
+	discovery, err := client.Discovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !StringLenGtZero(discovery.IntrospectionEndpoint) {
+		return nil, errors.New("issuer doesn't support introspection")
+	}
+
+	result := &IntrospectionResult{}
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	if err := client.postForm(ctx, discovery.IntrospectionEndpoint, form, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// AuthCodeURL builds the login redirect, verifier is kept by the caller and sent back with Exchange.
+func (client *OktaClient) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	discovery, err := client.Discovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	scopes := client.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	query := url.Values{
+		"client_id":             {client.config.ClientId},
+		"response_type":         {"code"},
+		"scope":                 {strings.Join(scopes, " ")},
+		"redirect_uri":          {client.config.RedirectUrl},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	return discovery.AuthorizationEndpoint + "?" + query.Encode(), nil
+}
+
+// Exchange swaps an authorization code for tokens.
+func (client *OktaClient) Exchange(ctx context.Context, code string, verifier string) (*OIDCTokens, error) {
+	discovery, err := client.Discovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := &OIDCTokens{}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {client.config.RedirectUrl},
+		"code_verifier": {verifier},
+	}
+	if err := client.postForm(ctx, discovery.TokenEndpoint, form, tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// UserGroups lists groups userId belongs to through Okta API, cached for a few minutes.
+func (client *OktaClient) UserGroups(ctx context.Context, userId string) ([]OktaGroup, error) {
+	if !StringLenGtZero(client.config.Api) || !StringLenGtZero(client.config.Token) {
+		return nil, errors.New("OKTA_API and OKTA_API_TOKEN are required for group lookups")
+	}
+
+	client.groupsMu.Lock()
+	cached, found := client.groups[userId]
+	client.groupsMu.Unlock()
+	if found && time.Now().Before(cached.expiresAt) {
+		return cached.groups, nil
+	}
+
+	oktaGroups := []OktaGroup{}
+	groupsUrl := fmt.Sprintf("%s/api/v1/users/%s/groups", strings.TrimSuffix(client.config.Api, "/"), url.PathEscape(userId))
+	header := http.Header{"Authorization": {"SSWS " + client.config.Token}}
+	if err := client.getJSON(ctx, groupsUrl, header, &oktaGroups); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	client.groupsMu.Lock()
+	if now.Sub(client.groupsSweep) > limiterSweepInterval {
+		client.groupsSweep = now
+		for cachedUser, cached := range client.groups {
+			if now.After(cached.expiresAt) {
+				delete(client.groups, cachedUser)
+			}
+		}
+	}
+	client.groups[userId] = cachedGroups{groups: oktaGroups, expiresAt: now.Add(oktaGroupsTTL)}
+	client.groupsMu.Unlock()
+	return oktaGroups, nil
+}
+
+func (client *OktaClient) getJSON(ctx context.Context, url string, header http.Header, v any) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		httpReq.Header[key] = values
+	}
+	httpReq.Header.Set("Accept", JSONContentType)
+	return client.do(httpReq, v)
+}
+
+// postForm authenticates with client credentials, public clients(no secret) send client_id only.
+func (client *OktaClient) postForm(ctx context.Context, endpoint string, form url.Values, v any) error {
+	if !StringLenGtZero(client.config.ClientSecret) {
+		form.Set("client_id", client.config.ClientId)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", JSONContentType)
+	if StringLenGtZero(client.config.ClientSecret) {
+		httpReq.SetBasicAuth(url.QueryEscape(client.config.ClientId), url.QueryEscape(client.config.ClientSecret))
+	}
+	return client.do(httpReq, v)
+}
+
+func (client *OktaClient) do(httpReq *http.Request, v any) error {
+	resp, err := client.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %d", httpReq.Method, httpReq.URL.Path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type OktaValidatorOptions struct {
+	Introspect         bool     // Ask the issuer on every request instead of verifying locally, catches revoked tokens
+	Groups             []string // Caller has to be in one of these Okta group ids, checked through Okta API
+	RequireRetailGroup bool     // Adds OKTA_RETAIL_GROUP_ID to Groups
+}
+
+type OktaValidator struct {
+	client  *OktaClient
+	options OktaValidatorOptions
+	groups  []string
+}
+
+// NewOktaValidator authenticates bearer tokens(or the login cookie) issued by Config.Okta.Issuer.
+func NewOktaValidator(options OktaValidatorOptions) AuthValidatorCallback {
+	var mu sync.Mutex
+	validators := make(map[*Service]*OktaValidator)
+	return func(service *Service) AuthValidator {
+		mu.Lock()
+		defer mu.Unlock()
+		validator, found := validators[service]
+		if !found {
+			validator = service.newOktaValidator(options)
+			validators[service] = validator
+		}
+		return validator
+	}
+}
+
+func (s *Service) newOktaValidator(options OktaValidatorOptions) *OktaValidator {
+	validator := &OktaValidator{client: s.Okta(), options: options, groups: options.Groups}
+	if options.RequireRetailGroup {
+		validator.groups = append(append([]string{}, options.Groups...), s.Config.Okta.RetailGroupId)
+	}
+	return validator
+}
+
+func (v *OktaValidator) SecurityScheme() (string, SecurityScheme) {
+	return "okta", SecurityScheme{Type: "openIdConnect", OpenIdUrl: strings.TrimSuffix(v.client.config.Issuer, "/") + "/.well-known/openid-configuration"}
+}
+
+func (v *OktaValidator) Validate(req *Request) Auth {
+	token := bearerToken(req)
+	if !StringLenGtZero(token) {
+		if cookie, err := req.Cookie(OktaTokenCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if !StringLenGtZero(token) {
+		return Auth{}
+	}
+
+	claims, err := v.claims(req.Context(), token)
+	if err != nil {
+		req.Log().Info("okta token rejected", "error", err)
+		return Auth{Reason: invalidTokenReason}
+	}
+
+	// Okta puts the user id in uid, sub is the login.
+	userId, _ := claims.Raw["uid"].(string)
+	if !StringLenGtZero(userId) {
+		userId = claims.Subject
+	}
+
+	oktaAuth := &OktaAuth{JWTClaims: claims}
+	if groups, err := stringOrList(claims.Raw["groups"]); err == nil {
+		oktaAuth.Groups = groups
+	}
+
+	if len(v.groups) > 0 {
+		// The groups claim only has names, required groups are ids so they're always checked against Okta API.
+		groups, err := v.client.UserGroups(req.Context(), userId)
+		if err != nil {
+			req.Log().Error("okta group lookup failed", "error", err)
+			return Auth{}
+		}
+		names := []string{}
+		for _, group := range groups {
+			oktaAuth.GroupIds = append(oktaAuth.GroupIds, group.Id)
+			names = append(names, group.Profile.Name)
+		}
+		if len(oktaAuth.Groups) == 0 {
+			oktaAuth.Groups = names
+		}
+		if !hasCommon(oktaAuth.GroupIds, v.groups) {
+			req.Log().Info("okta user not in required groups", "user_id", userId)
+			return Auth{UserId: userId, Forbidden: true, Reason: "not in a required group"}
+		}
+	}
+
+	return Auth{
+		IsAuthenticated: true,
+		UserId:          userId,
+		Payload:         oktaAuth,
+	}
+}
+
+func (v *OktaValidator) claims(ctx context.Context, token string) (*JWTClaims, error) {
+	if !v.options.Introspect {
+		return v.client.VerifyAccessToken(ctx, token)
+	}
+
+	result, err := v.client.Introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !result.Active {
+		return nil, errors.New("token isn't active")
+	}
+	return &JWTClaims{
+		Subject:   result.Subject,
+		ExpiresAt: time.Unix(result.ExpiresAt, 0),
+		Scopes:    strings.Fields(result.Scope),
+		Raw:       map[string]any{"sub": result.Subject, "uid": result.UserId, "username": result.Username, "client_id": result.ClientId},
+	}, nil
+}
@@ -0,0 +1,320 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type fakeOkta struct {
+	*httptest.Server
+	key         *rsa.PrivateKey
+	active      map[string]bool     // Tokens introspection reports as active
+	groups      map[string][]string // Group names by user id
+	groupCalls  atomic.Int32
+	discoveries atomic.Int32
+	issuerDown  atomic.Bool
+	lastForm    url.Values
+	idTokenSent string
+}
+
+func newFakeOkta(t *testing.T) *fakeOkta {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	okta := &fakeOkta{key: key, active: map[string]bool{}, groups: map[string][]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		okta.discoveries.Add(1)
+		if okta.issuerDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(OIDCDiscovery{
+			Issuer:                okta.URL,
+			AuthorizationEndpoint: okta.URL + "/v1/authorize",
+			TokenEndpoint:         okta.URL + "/v1/token",
+			IntrospectionEndpoint: okta.URL + "/v1/introspect",
+			JwksUri:               okta.URL + "/v1/keys",
+		})
+	})
+	mux.HandleFunc("/v1/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{rsaJWK("okta-1", key)}})
+	})
+	mux.HandleFunc("/v1/introspect", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "client" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token := r.PostFormValue("token")
+		json.NewEncoder(w).Encode(IntrospectionResult{Active: okta.active[token], Subject: "jane@example.com", UserId: "00u1", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	})
+	mux.HandleFunc("/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		okta.lastForm = r.PostForm
+		json.NewEncoder(w).Encode(OIDCTokens{AccessToken: "access", IdToken: okta.idTokenSent, ExpiresIn: 3600})
+	})
+	mux.HandleFunc("/api/v1/users/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "SSWS api-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		okta.groupCalls.Add(1)
+		userId := r.URL.Path[len("/api/v1/users/") : len(r.URL.Path)-len("/groups")]
+		groups := []map[string]any{}
+		for _, name := range okta.groups[userId] {
+			groups = append(groups, map[string]any{"id": "id-" + name, "profile": map[string]string{"name": name}})
+		}
+		json.NewEncoder(w).Encode(groups)
+	})
+	okta.Server = httptest.NewServer(mux)
+	t.Cleanup(okta.Close)
+	return okta
+}
+
+func (okta *fakeOkta) token(t *testing.T, claims jwt.MapClaims) string {
+	base := jwt.MapClaims{"iss": okta.URL, "aud": "api://default", "sub": "jane@example.com", "uid": "00u1", "exp": time.Now().Add(time.Hour).Unix()}
+	for key, value := range claims {
+		base[key] = value
+	}
+	return signJWT(t, jwt.SigningMethodRS256, "okta-1", okta.key, base)
+}
+
+func newOktaService(okta *fakeOkta) *Service {
+	return NewService(&Config{Okta: &OktaConfig{
+		Api:           okta.URL,
+		Token:         "api-token",
+		Issuer:        okta.URL,
+		RetailGroupId: "id-retail",
+		ClientId:      "client",
+		ClientSecret:  "secret",
+		RedirectUrl:   "https://app.example.com/okta/callback",
+		Audience:      "api://default",
+	}}, &[]App{})
+}
+
+func TestOktaValidator(t *testing.T) {
+	okta := newFakeOkta(t)
+	okta.groups["00u1"] = []string{"retail", "support"}
+	okta.groups["00u2"] = []string{"wholesale"}
+	okta.active["opaque"] = true
+	s := newOktaService(okta)
+
+	type input struct {
+		title        string
+		options      OktaValidatorOptions
+		req          *Request
+		expAuth      bool
+		expUser      string
+		expForbidden bool
+	}
+
+	inputs := []input{
+		{
+			title:   "Verified locally",
+			req:     bearerReq(okta.token(t, nil)),
+			expAuth: true,
+			expUser: "00u1",
+		},
+		{
+			title: "Wrong audience",
+			req:   bearerReq(okta.token(t, jwt.MapClaims{"aud": "api://other"})),
+		},
+		{
+			title:   "Token from login cookie",
+			req:     &Request{Header: http.Header{"Cookie": {OktaTokenCookie + "=" + okta.token(t, nil)}}},
+			expAuth: true,
+			expUser: "00u1",
+		},
+		{
+			title:   "Sub when uid is missing",
+			req:     bearerReq(okta.token(t, jwt.MapClaims{"uid": nil})),
+			expAuth: true,
+			expUser: "jane@example.com",
+		},
+		{
+			title:   "Group ids from Okta API",
+			options: OktaValidatorOptions{Groups: []string{"id-admins", "id-support"}},
+			req:     bearerReq(okta.token(t, jwt.MapClaims{"groups": []string{"support"}})),
+			expAuth: true,
+			expUser: "00u1",
+		},
+		{
+			title:        "Groups claim names don't count as ids",
+			options:      OktaValidatorOptions{Groups: []string{"id-admins"}},
+			req:          bearerReq(okta.token(t, jwt.MapClaims{"groups": []string{"admins", "id-admins"}})),
+			expUser:      "00u1",
+			expForbidden: true,
+		},
+		{
+			title:   "Retail group with a groups claim",
+			options: OktaValidatorOptions{RequireRetailGroup: true},
+			req:     bearerReq(okta.token(t, jwt.MapClaims{"groups": []string{"retail", "support"}})),
+			expAuth: true,
+			expUser: "00u1",
+		},
+		{
+			title:   "Retail group from Okta API",
+			options: OktaValidatorOptions{RequireRetailGroup: true},
+			req:     bearerReq(okta.token(t, nil)),
+			expAuth: true,
+			expUser: "00u1",
+		},
+		{
+			title:        "Not in retail group",
+			options:      OktaValidatorOptions{RequireRetailGroup: true},
+			req:          bearerReq(okta.token(t, jwt.MapClaims{"uid": "00u2"})),
+			expUser:      "00u2",
+			expForbidden: true,
+		},
+		{
+			title:   "Introspected",
+			options: OktaValidatorOptions{Introspect: true},
+			req:     bearerReq("opaque"),
+			expAuth: true,
+			expUser: "00u1",
+		},
+		{
+			title:   "Introspected revoked token",
+			options: OktaValidatorOptions{Introspect: true},
+			req:     bearerReq(okta.token(t, nil)),
+		},
+		{
+			title: "No token",
+			req:   &Request{Header: http.Header{}},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			auth := NewOktaValidator(input.options)(s).Validate(input.req)
+			if auth.IsAuthenticated != input.expAuth {
+				t.Fatalf("expected %t got %t", input.expAuth, auth.IsAuthenticated)
+			}
+			if auth.UserId != input.expUser || auth.Forbidden != input.expForbidden {
+				t.Errorf("expected user %q forbidden %t got %q %t", input.expUser, input.expForbidden, auth.UserId, auth.Forbidden)
+			}
+			if input.expAuth && ClaimsFromAuth(auth) == nil {
+				t.Errorf("expected claims")
+			}
+		})
+	}
+
+	t.Run("Groups are cached", func(t *testing.T) {
+		calls := okta.groupCalls.Load()
+		validator := NewOktaValidator(OktaValidatorOptions{RequireRetailGroup: true})(s)
+		validator.Validate(bearerReq(okta.token(t, nil)))
+		validator.Validate(bearerReq(okta.token(t, nil)))
+		if got := okta.groupCalls.Load(); got != calls {
+			t.Errorf("expected cached groups, got %d calls", got-calls)
+		}
+	})
+
+	t.Run("Expired groups are swept", func(t *testing.T) {
+		client := s.Okta()
+		client.groupsMu.Lock()
+		client.groups["gone"] = cachedGroups{expiresAt: time.Now().Add(-time.Second)}
+		client.groupsSweep = time.Time{}
+		client.groupsMu.Unlock()
+
+		if _, err := client.UserGroups(context.Background(), "00u9"); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := client.groups["gone"]; found {
+			t.Error("expected expired groups to be swept")
+		}
+	})
+}
+
+func TestOktaValidatorPerService(t *testing.T) {
+	first, second := newFakeOkta(t), newFakeOkta(t)
+	first.groups["00u1"] = []string{"retail"}
+	second.groups["00u1"] = []string{"retail"}
+	firstService, secondService := newOktaService(first), newOktaService(second)
+	callback := NewOktaValidator(OktaValidatorOptions{RequireRetailGroup: true})
+
+	if !callback(firstService).Validate(bearerReq(first.token(t, nil))).IsAuthenticated {
+		t.Error("expected first service to use its own issuer")
+	}
+	if !callback(secondService).Validate(bearerReq(second.token(t, nil))).IsAuthenticated {
+		t.Error("expected second service to use its own issuer")
+	}
+	if second.groupCalls.Load() != 1 {
+		t.Error("expected second service to look groups up through its own client")
+	}
+	if callback(firstService) != callback(firstService) {
+		t.Error("expected the validator to be built once per service")
+	}
+}
+
+func TestOktaDiscovery(t *testing.T) {
+	okta := newFakeOkta(t)
+	client := newOktaService(okta).Okta()
+	if _, err := client.Discovery(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	okta.issuerDown.Store(true)
+	client.discoveryAt = time.Now().Add(-2 * oktaDiscoveryTTL)
+	client.discoveryAttempt = client.discoveryAt
+	calls := okta.discoveries.Load()
+	for i := 0; i < 3; i++ {
+		if discovery, err := client.Discovery(context.Background()); err != nil || discovery.Issuer != okta.URL {
+			t.Fatalf("expected the previous document got %+v %v", discovery, err)
+		}
+	}
+	if got := okta.discoveries.Load() - calls; got != 1 {
+		t.Errorf("expected one refresh attempt while the issuer is down got %d", got)
+	}
+
+	okta.issuerDown.Store(false)
+	client.discoveryAttempt = time.Now().Add(-2 * oktaDiscoveryRetry)
+	client.Discovery(context.Background())
+	if client.discoveryAt.Before(time.Now().Add(-time.Minute)) {
+		t.Error("expected discovery to be refreshed once the issuer is back")
+	}
+}
+
+func TestOktaLoginFlow(t *testing.T) {
+	okta := newFakeOkta(t)
+	client := newOktaService(okta).Okta()
+
+	authUrl, err := client.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := url.Parse(authUrl)
+	challenge := sha256.Sum256([]byte("verifier"))
+	query := parsed.Query()
+	if query.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) || query.Get("code_challenge_method") != "S256" {
+		t.Errorf("expected S256 challenge got %v", query)
+	}
+	if query.Get("state") != "state" || query.Get("nonce") != "nonce" || query.Get("scope") != "openid profile email" {
+		t.Errorf("unexpected auth params %v", query)
+	}
+
+	okta.idTokenSent = okta.token(t, jwt.MapClaims{"aud": "client", "nonce": "nonce"})
+	tokens, err := client.Exchange(context.Background(), "code", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if okta.lastForm.Get("code_verifier") != "verifier" || okta.lastForm.Get("grant_type") != "authorization_code" {
+		t.Errorf("unexpected token request %v", okta.lastForm)
+	}
+
+	if _, err := client.VerifyIDToken(context.Background(), tokens.IdToken, "nonce"); err != nil {
+		t.Errorf("expected id token to verify got %s", err)
+	}
+	if _, err := client.VerifyIDToken(context.Background(), tokens.IdToken, "replayed"); err == nil {
+		t.Errorf("expected nonce mismatch")
+	}
+}
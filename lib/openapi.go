@@ -0,0 +1,503 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const openAPIVersion = "3.0.3"
+
+type OpenAPIConfig struct {
+	Path    string   `json:"Path"`    // Spec is served here when set, e.g. "/docs/openapi.json"
+	Title   string   `json:"Title"`   // Defaults to Config.Name
+	Servers []string `json:"Servers"` // Base URLs clients should use
+}
+
+// SecurityScheme is the OpenAPI description of how a validator authenticates callers.
+type SecurityScheme struct {
+	Type         string `json:"type"` // apiKey, http, oauth2, openIdConnect, mutualTLS
+	Description  string `json:"description,omitempty"`
+	Name         string `json:"name,omitempty"` // apiKey only
+	In           string `json:"in,omitempty"`   // apiKey only: header, query or cookie
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	OpenIdUrl    string `json:"openIdConnectUrl,omitempty"`
+}
+
+// DocumentedAuthValidator is implemented by validators which can describe themselves in the OpenAPI spec.
+// Validators which don't are listed under x-auth-validators of every operation using them.
+type DocumentedAuthValidator interface {
+	SecurityScheme() (name string, scheme SecurityScheme)
+}
+
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Servers    []openAPIServer                         `json:"servers,omitempty"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+
+	schemaNames map[reflect.Type]string // Component name picked for each named struct
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type openAPIOperation struct {
+	Tags            []string                    `json:"tags,omitempty"`
+	Summary         string                      `json:"summary,omitempty"`
+	OperationId     string                      `json:"operationId"`
+	Parameters      []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody     *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses       map[string]*openAPIResponse `json:"responses"`
+	Security        []map[string][]string       `json:"security,omitempty"`
+	Deprecated      bool                        `json:"deprecated,omitempty"`
+	XAuthValidators []string                    `json:"x-auth-validators,omitempty"`
+	XRoles          []string                    `json:"x-roles,omitempty"`       // Any of
+	XPermissions    []string                    `json:"x-permissions,omitempty"` // All of
+}
+
+type openAPIParameter struct {
+	Name   string         `json:"name"`
+	In     string         `json:"in"`
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema,omitempty"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+}
+
+// OpenAPISpec documents every app/action/method registered on the service as an OpenAPI 3 JSON document.
+func (s *Service) OpenAPISpec() ([]byte, error) {
+	title := s.Config.Name
+	config := s.Config.OpenAPI
+	if config != nil && StringLenGtZero(config.Title) {
+		title = config.Title
+	}
+
+	doc := &openAPIDoc{
+		OpenAPI:     openAPIVersion,
+		Info:        openAPIInfo{Title: title, Version: s.Config.Version},
+		Paths:       make(map[string]map[string]*openAPIOperation),
+		schemaNames: make(map[reflect.Type]string),
+		Components: openAPIComponents{
+			Schemas:         make(map[string]*openAPISchema),
+			SecuritySchemes: make(map[string]SecurityScheme),
+		},
+	}
+	if config != nil {
+		for _, server := range config.Servers {
+			doc.Servers = append(doc.Servers, openAPIServer{URL: server})
+		}
+	}
+
+	pathVersions := s.Config.Versioning != nil && s.Config.Versioning.Strategy == PathVersioning
+	for appTitle, route := range s.routes {
+		if _, isSpecApp := s.apps[appTitle].(*openAPIApp); isSpecApp {
+			continue
+		}
+		for action, methods := range route {
+			path := "/" + appTitle
+			if StringLenGtZero(action) {
+				path += "/" + action
+			}
+			for method, actions := range methods {
+				if latest, found := actions.resolve(latestVersion); found {
+					s.addOperation(doc, path, appTitle, method, latest, false)
+				}
+				if !pathVersions {
+					continue
+				}
+				for _, httpAction := range actions {
+					if httpAction.Version > 0 {
+						s.addOperation(doc, fmt.Sprintf("/v%d%s", httpAction.Version, path), appTitle, method, httpAction, true)
+					}
+				}
+			}
+		}
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// WriteOpenAPISpec writes the spec to file, used by the -openapi flag for client generation.
+func (s *Service) WriteOpenAPISpec(file string) error {
+	spec, err := s.OpenAPISpec()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, spec, 0644)
+}
+
+// addOperation documents httpAction under path, versionedPath keeps operation ids unique for /v{n}/ copies.
+func (s *Service) addOperation(doc *openAPIDoc, path string, appTitle string, method HttpMethod, httpAction HttpAction, versionedPath bool) {
+	operationId := fmt.Sprintf("%s_%s_%s", appTitle, strings.ReplaceAll(httpAction.Action, "-", "_"), strings.ToLower(string(method)))
+	if versionedPath {
+		operationId += "_v" + strconv.Itoa(httpAction.Version)
+	}
+
+	operation := &openAPIOperation{
+		Tags:        []string{appTitle},
+		Summary:     httpAction.Summary,
+		OperationId: operationId,
+		Responses:   make(map[string]*openAPIResponse),
+	}
+
+	if httpAction.QueryType != nil {
+		operation.Parameters = queryParameters(doc, reflect.TypeOf(httpAction.QueryType))
+	}
+	if httpAction.RequestType != nil {
+		operation.RequestBody = &openAPIRequestBody{
+			Required: true,
+			Content:  map[string]openAPIMediaType{JSONContentType: {Schema: schemaFor(doc, reflect.TypeOf(httpAction.RequestType))}},
+		}
+	}
+
+	switch {
+	case httpAction.WSHandler != nil:
+		operation.Responses["101"] = &openAPIResponse{Description: "Switched to websocket"}
+	case httpAction.SSEHandler != nil:
+		operation.Responses["200"] = &openAPIResponse{
+			Description: "Event stream",
+			Content:     map[string]openAPIMediaType{"text/event-stream": {Schema: &openAPISchema{Type: "string"}}},
+		}
+	case httpAction.ResponseType != nil:
+		operation.Responses["200"] = &openAPIResponse{
+			Description: "OK",
+			Content:     map[string]openAPIMediaType{JSONContentType: {Schema: schemaFor(doc, reflect.TypeOf(httpAction.ResponseType))}},
+		}
+	default:
+		operation.Responses["200"] = &openAPIResponse{Description: "OK"}
+	}
+
+	errorContent := map[string]openAPIMediaType{JSONContentType: {Schema: schemaFor(doc, reflect.TypeOf(APIError{}))}}
+	operation.Responses["default"] = &openAPIResponse{Description: "Error", Content: errorContent}
+
+	if len(httpAction.AuthValidators) > 0 {
+		operation.Responses["401"] = &openAPIResponse{Description: "Authentication failed", Content: errorContent}
+		// Any validator passing is enough, which is how alternatives are expressed in OpenAPI.
+		operation.Security = s.securityRequirements(doc, operation, AnyOf(httpAction.AuthValidators...)(s))
+		// Scopes can only be listed against OAuth schemes, other schemes keep an empty list.
+		for _, requirement := range operation.Security {
+			for name := range requirement {
+				if schemeType := doc.Components.SecuritySchemes[name].Type; len(httpAction.Scopes) > 0 && (schemeType == "oauth2" || schemeType == "openIdConnect") {
+					requirement[name] = httpAction.Scopes
+				}
+			}
+		}
+	}
+
+	if len(httpAction.Roles) > 0 || len(httpAction.Scopes) > 0 || len(httpAction.Permissions) > 0 || len(httpAction.Policies) > 0 {
+		operation.Responses["403"] = &openAPIResponse{Description: "Not allowed", Content: errorContent}
+		operation.XRoles = httpAction.Roles
+		operation.XPermissions = httpAction.Permissions
+	}
+
+	if rule, _ := s.rateLimitRule(appTitle, &httpAction); rule != nil {
+		operation.Responses["429"] = &openAPIResponse{Description: "Rate limited, retry after Retry-After seconds", Content: errorContent}
+	}
+
+	if versioning := s.Config.Versioning; versioning != nil && httpAction.Version > 0 {
+		_, operation.Deprecated = versioning.Deprecations[strconv.Itoa(httpAction.Version)]
+	}
+
+	if _, found := doc.Paths[path]; !found {
+		doc.Paths[path] = make(map[string]*openAPIOperation)
+	}
+	doc.Paths[path][strings.ToLower(string(method))] = operation
+}
+
+// securityRequirements lists alternatives, AllOf validators share one requirement object.
+func (s *Service) securityRequirements(doc *openAPIDoc, operation *openAPIOperation, validator AuthValidator) []map[string][]string {
+	validator = unwrapValidator(validator)
+	policy, isPolicy := validator.(*authPolicy)
+	if !isPolicy {
+		documented, isDocumented := validator.(DocumentedAuthValidator)
+		if !isDocumented {
+			operation.XAuthValidators = append(operation.XAuthValidators, reflect.TypeOf(validator).String())
+			return nil
+		}
+		name, scheme := documented.SecurityScheme()
+		doc.Components.SecuritySchemes[name] = scheme
+		return []map[string][]string{{name: {}}}
+	}
+
+	requirements := []map[string][]string{}
+	if policy.all {
+		requirements = append(requirements, map[string][]string{})
+	}
+	for _, callback := range policy.validators {
+		alternatives := s.securityRequirements(doc, operation, callback(s))
+		if !policy.all {
+			requirements = append(requirements, alternatives...)
+			continue
+		}
+		if len(alternatives) == 0 {
+			continue
+		}
+		combined := []map[string][]string{}
+		for _, requirement := range requirements {
+			for _, alternative := range alternatives {
+				merged := map[string][]string{}
+				for name, scopes := range requirement {
+					merged[name] = scopes
+				}
+				for name, scopes := range alternative {
+					merged[name] = scopes
+				}
+				combined = append(combined, merged)
+			}
+		}
+		requirements = combined
+	}
+	if len(requirements) == 1 && len(requirements[0]) == 0 {
+		return nil
+	}
+	return requirements
+}
+
+func queryParameters(doc *openAPIDoc, queryType reflect.Type) []openAPIParameter {
+	for queryType.Kind() == reflect.Pointer {
+		queryType = queryType.Elem()
+	}
+	if queryType.Kind() != reflect.Struct {
+		return nil
+	}
+
+	params := []openAPIParameter{}
+	for i := 0; i < queryType.NumField(); i++ {
+		field := queryType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("query"); StringLenGtZero(tag) {
+			name = tag
+		} else if tagName, _, skip := jsonFieldName(field); skip {
+			continue
+		} else {
+			name = tagName
+		}
+		if name == "-" {
+			continue
+		}
+		params = append(params, openAPIParameter{Name: name, In: "query", Schema: schemaFor(doc, field.Type)})
+	}
+	return params
+}
+
+// jsonFieldName follows encoding/json naming so schemas match what handlers actually send.
+func jsonFieldName(field reflect.StructField) (name string, omitEmpty bool, skip bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, true
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if !StringLenGtZero(name) {
+		name = field.Name
+	}
+	return name, strings.Contains(opts, "omitempty"), false
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor converts Go types to schemas, named structs end up in components and are referenced.
+func schemaFor(doc *openAPIDoc, t reflect.Type) *openAPISchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		return &openAPISchema{Type: "array", Items: schemaFor(doc, t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: schemaFor(doc, t.Elem())}
+	case reflect.Struct:
+		if !StringLenGtZero(t.Name()) {
+			return structSchema(doc, t)
+		}
+		name, found := doc.schemaNames[t]
+		if !found {
+			name = schemaName(doc, t)
+			doc.schemaNames[t] = name
+			// Placeholder first so self referencing types don't recurse forever.
+			doc.Components.Schemas[name] = &openAPISchema{}
+			*doc.Components.Schemas[name] = *structSchema(doc, t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + name}
+	}
+
+	// interfaces and anything else can't be described any further.
+	return &openAPISchema{}
+}
+
+// schemaName is the type name, qualified with its package path when a type from another package already took it.
+func schemaName(doc *openAPIDoc, t reflect.Type) string {
+	name := t.Name()
+	if _, taken := doc.Components.Schemas[name]; !taken {
+		return name
+	}
+	// Component names may only hold letters, digits, '.', '-' and '_'.
+	qualified := strings.Map(func(char rune) rune {
+		if char == '.' || char == '-' || char == '_' || ('a' <= char && char <= 'z') || ('A' <= char && char <= 'Z') || ('0' <= char && char <= '9') {
+			return char
+		}
+		return '.'
+	}, t.PkgPath()+"."+name)
+	// Types declared inside functions share package and name.
+	name = qualified
+	for i := 2; ; i++ {
+		if _, taken := doc.Components.Schemas[name]; !taken {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d", qualified, i)
+	}
+}
+
+func structSchema(doc *openAPIDoc, t reflect.Type) *openAPISchema {
+	schema := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, omitEmpty, skip := jsonFieldName(field)
+		if skip {
+			continue
+		}
+
+		// Embedded structs are flattened by encoding/json unless tagged.
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				embeddedSchema := structSchema(doc, embedded)
+				for propName, prop := range embeddedSchema.Properties {
+					schema.Properties[propName] = prop
+				}
+				schema.Required = append(schema.Required, embeddedSchema.Required...)
+				continue
+			}
+		}
+
+		schema.Properties[name] = schemaFor(doc, field.Type)
+		if !omitEmpty && field.Type.Kind() != reflect.Pointer {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return schema
+}
+
+// openAPIApp serves the spec at Config.OpenAPI.Path like any other app so CORS, logging etc. apply.
+type openAPIApp struct {
+	title   string
+	action  string
+	service *Service
+
+	once sync.Once
+	spec []byte
+	err  error
+}
+
+func newOpenAPIApp(path string) *openAPIApp {
+	pathTokens := strings.Split(strings.Trim(path, "/"), "/")
+	if len(pathTokens) > 2 || !StringLenGtZero(pathTokens[0]) {
+		errTxt := fmt.Sprintf("OpenAPI path %s has to be /{app} or /{app}/{action}", path)
+		CheckFatal(errors.New(errTxt), errTxt)
+	}
+	app := &openAPIApp{title: pathTokens[0]}
+	if len(pathTokens) == 2 {
+		app.action = pathTokens[1]
+	}
+	return app
+}
+
+func (app *openAPIApp) Title() string {
+	return app.title
+}
+
+func (app *openAPIApp) Init(service *Service) {
+	app.service = service
+}
+
+func (app *openAPIApp) Routes() []HttpAction {
+	return []HttpAction{
+		{
+			Action: app.action,
+			Method: GET,
+			Handler: func(req *Request) *Response {
+				// Routes can't change after startup so the spec is built once.
+				app.once.Do(func() {
+					app.spec, app.err = app.service.OpenAPISpec()
+				})
+				if app.err != nil {
+					return ErrorToResponse(ErrInternal(app.err))
+				}
+				return SuccessResponse(app.spec).WithContentType(JSONContentType)
+			},
+		},
+	}
+}
+
+func (app *openAPIApp) QueueHandlers() QueueRoute {
+	return QueueRoute{}
+}
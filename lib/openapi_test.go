@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type specAddress struct {
+	City string `json:"City"`
+}
+
+type specUser struct {
+	ID        int64          `json:"ID"`
+	Name      string         `json:"Name"`
+	Email     string         `json:"Email,omitempty"`
+	Tags      []string       `json:"Tags"`
+	Address   *specAddress   `json:"Address"`
+	Manager   *specUser      `json:"Manager"`
+	CreatedAt time.Time      `json:"CreatedAt"`
+	Meta      map[string]int `json:"Meta,omitempty"`
+	password  string
+}
+
+type specQuery struct {
+	Page   int    `query:"page"`
+	Search string `json:"q"`
+}
+
+type documentedValidator struct{}
+
+func (v *documentedValidator) Validate(req *Request) Auth {
+	return Auth{}
+}
+
+func (v *documentedValidator) SecurityScheme() (string, SecurityScheme) {
+	return "bearerAuth", SecurityScheme{Type: "http", Scheme: "bearer", BearerFormat: "JWT"}
+}
+
+type SpecApp struct {
+	MockApp
+}
+
+func (app *SpecApp) Title() string {
+	return "users"
+}
+
+func (app *SpecApp) Routes() []HttpAction {
+	handler := func(r *Request) *Response { return SuccessResponse("OK") }
+	return []HttpAction{
+		{
+			Action:       "get",
+			Summary:      "Fetch a user",
+			QueryType:    specQuery{},
+			ResponseType: specUser{},
+			Handler:      handler,
+			AuthValidators: []AuthValidatorCallback{
+				func(s *Service) AuthValidator { return &documentedValidator{} },
+				NewMockAuthValidator(Auth{}),
+			},
+		},
+		{Action: "create", Method: POST, RequestType: specUser{}, ResponseType: specUser{}, Handler: handler},
+		{Action: "list", Version: 1, ResponseType: []specUser{}, Handler: handler},
+		{Action: "list", Version: 2, ResponseType: map[string][]specUser{}, Handler: handler},
+	}
+}
+
+func loadSpec(t *testing.T, s *Service) map[string]any {
+	spec, err := s.OpenAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// lookup walks nested maps, returns nil as soon as a key is missing.
+func lookup(doc any, keys ...string) any {
+	for _, key := range keys {
+		object, isMap := doc.(map[string]any)
+		if !isMap {
+			return nil
+		}
+		doc = object[key]
+	}
+	return doc
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	config := &Config{
+		Name:    "users-service",
+		Version: "1.2.0",
+		Versioning: &VersioningConfig{
+			Strategy:     PathVersioning,
+			Deprecations: map[string]*VersionDeprecation{"1": {}},
+		},
+	}
+	doc := loadSpec(t, NewService(config, &[]App{&SpecApp{}}))
+
+	type input struct {
+		title string
+		keys  []string
+		exp   any
+	}
+
+	inputs := []input{
+		{
+			title: "Info",
+			keys:  []string{"info", "version"},
+			exp:   "1.2.0",
+		},
+		{
+			title: "Summary",
+			keys:  []string{"paths", "/users/get", "get", "summary"},
+			exp:   "Fetch a user",
+		},
+		{
+			title: "Query params",
+			keys:  []string{"paths", "/users/get", "get", "parameters"},
+			exp: []any{
+				map[string]any{"name": "page", "in": "query", "schema": map[string]any{"type": "integer", "format": "int32"}},
+				map[string]any{"name": "q", "in": "query", "schema": map[string]any{"type": "string"}},
+			},
+		},
+		{
+			title: "Response schema is referenced",
+			keys:  []string{"paths", "/users/get", "get", "responses", "200", "content", "application/json", "schema", "$ref"},
+			exp:   "#/components/schemas/specUser",
+		},
+		{
+			title: "Documented validators become security requirements",
+			keys:  []string{"paths", "/users/get", "get", "security"},
+			exp:   []any{map[string]any{"bearerAuth": []any{}}},
+		},
+		{
+			title: "Undocumented validators are listed",
+			keys:  []string{"paths", "/users/get", "get", "x-auth-validators"},
+			exp:   []any{"*lib.MockAuthValidator"},
+		},
+		{
+			title: "Security scheme",
+			keys:  []string{"components", "securitySchemes", "bearerAuth", "scheme"},
+			exp:   "bearer",
+		},
+		{
+			title: "Request body",
+			keys:  []string{"paths", "/users/create", "post", "requestBody", "content", "application/json", "schema", "$ref"},
+			exp:   "#/components/schemas/specUser",
+		},
+		{
+			title: "Struct fields follow json naming and omitempty",
+			keys:  []string{"components", "schemas", "specUser", "required"},
+			exp:   []any{"ID", "Name", "Tags", "CreatedAt"},
+		},
+		{
+			title: "Time is a date-time string",
+			keys:  []string{"components", "schemas", "specUser", "properties", "CreatedAt", "format"},
+			exp:   "date-time",
+		},
+		{
+			title: "Self reference",
+			keys:  []string{"components", "schemas", "specUser", "properties", "Manager", "$ref"},
+			exp:   "#/components/schemas/specUser",
+		},
+		{
+			title: "Unversioned path documents latest version",
+			keys:  []string{"paths", "/users/list", "get", "responses", "200", "content", "application/json", "schema", "type"},
+			exp:   "object",
+		},
+		{
+			title: "Versioned path",
+			keys:  []string{"paths", "/v1/users/list", "get", "responses", "200", "content", "application/json", "schema", "type"},
+			exp:   "array",
+		},
+		{
+			title: "Deprecated version",
+			keys:  []string{"paths", "/v1/users/list", "get", "deprecated"},
+			exp:   true,
+		},
+		{
+			title: "Errors",
+			keys:  []string{"components", "schemas", "APIError", "required"},
+			exp:   []any{"Code", "Msg"},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			if got := lookup(doc, input.keys...); !reflect.DeepEqual(got, input.exp) {
+				t.Errorf("expected %v got %v", input.exp, got)
+			}
+		})
+	}
+}
+
+func TestOpenAPIEndpoint(t *testing.T) {
+	config := &Config{OpenAPI: &OpenAPIConfig{Path: "/docs/openapi.json", Title: "Users"}}
+	s := NewService(config, &[]App{&SpecApp{}})
+
+	w := &MockResponseWriter{}
+	s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: "/docs/openapi.json"}})
+	if w.statusCode != 200 {
+		t.Fatalf("expected 200 got %d", w.statusCode)
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(w.dataWritten), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookup(doc, "info", "title"); got != "Users" {
+		t.Errorf("expected configured title got %v", got)
+	}
+	if got := lookup(doc, "paths", "/docs/openapi.json"); got != nil {
+		t.Errorf("spec endpoint shouldn't document itself")
+	}
+
+	file := filepath.Join(t.TempDir(), "openapi.json")
+	if err := s.WriteOpenAPISpec(file); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := os.ReadFile(file)
+	if !json.Valid(written) {
+		t.Errorf("expected a valid JSON file")
+	}
+}
+
+func TestOpenAPISchemaNameCollision(t *testing.T) {
+	libError := reflect.TypeOf(APIError{})
+	// Same name as lib.APIError, as if it came from another package.
+	type APIError struct {
+		Retries int
+	}
+	doc := &openAPIDoc{Components: openAPIComponents{Schemas: make(map[string]*openAPISchema)}, schemaNames: make(map[reflect.Type]string)}
+
+	ours := schemaFor(doc, libError)
+	theirs := schemaFor(doc, reflect.TypeOf(APIError{}))
+	again := schemaFor(doc, reflect.TypeOf(&APIError{}))
+
+	if ours.Ref == theirs.Ref || theirs.Ref != again.Ref {
+		t.Fatalf("expected a distinct, stable name for the second APIError got %s %s %s", ours.Ref, theirs.Ref, again.Ref)
+	}
+	if theirs.Ref != "#/components/schemas/github.com.udayRedI.go-starter-kit.lib.APIError" {
+		t.Errorf("expected name qualified with the package path got %s", theirs.Ref)
+	}
+	if _, found := doc.Components.Schemas["APIError"].Properties["Retries"]; found {
+		t.Errorf("expected lib.APIError to keep its own schema")
+	}
+}
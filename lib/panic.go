@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Recovered panics keyed on where they happened(http, goroutine), exposed via expvar.
+var panicsTotal = expvar.NewMap("panics_total")
+
+func Handlepanic(errorContext string) {
+	if a := recover(); a != nil {
+		stck := debug.Stack()
+		panicsTotal.Add("goroutine", 1)
+		slog.Error("recovered from panic", "context", errorContext, "panic", fmt.Sprint(a), "stack", string(stck))
+		// Not CaptureSentryException, it would log the panic a second time.
+		sentry.CaptureException(fmt.Errorf("RECOVER from error at %s: %v %s", errorContext, a, stck))
+	}
+}
+
+// GoFuncWrapper runs callback in background and recovers if it panics.
+func GoFuncWrapper(title string, callback func()) {
+	go func() {
+		defer Handlepanic(title)
+		callback()
+	}()
+}
+
+// GoFuncWithContext is GoFuncWrapper for callbacks which should stop once ctx is cancelled,
+// callback is skipped entirely if ctx is already done.
+func GoFuncWithContext(ctx context.Context, title string, callback func(context.Context)) {
+	go func() {
+		defer Handlepanic(title)
+		if ctx.Err() != nil {
+			return
+		}
+		callback(ctx)
+	}()
+}
+
+// handleHTTPPanic records the panic and responds with 500 unless handler had already started writing.
+func (s *Service) handleHTTPPanic(w *responseRecorder, req *Request, recovered any) {
+	if recovered == http.ErrAbortHandler {
+		// Deliberate abort, let net/http deal with it.
+		panic(recovered)
+	}
+
+	stck := debug.Stack()
+	panicsTotal.Add("http", 1)
+	req.Log().Error("handler panicked", "panic", fmt.Sprint(recovered), "stack", string(stck))
+	sentry.CaptureException(fmt.Errorf("%s: API (%s) crashed: %v %s", req.ID, req.Path, recovered, stck))
+
+	if w.status != 0 || w.bytes > 0 {
+		return
+	}
+
+	s.writeInternalError(w, req)
+}
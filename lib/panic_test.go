@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type PanicApp struct {
+}
+
+func (pApp *PanicApp) Title() string {
+	return "panic-app"
+}
+
+func (pApp *PanicApp) Init(s *Service) {
+}
+
+func (pApp *PanicApp) Routes() []HttpAction {
+	return []HttpAction{
+		{
+			Action: "crash",
+			Handler: func(*Request) *Response {
+				panic("boom")
+			},
+		},
+	}
+}
+
+func (pApp *PanicApp) QueueHandlers() QueueRoute {
+	return QueueRoute{}
+}
+
+func TestHandlerPanicReturns500(t *testing.T) {
+	s := NewService(&Config{}, &[]App{&PanicApp{}})
+	resp := &MockResponseWriter{}
+	before := httpPanicCount()
+
+	s.ServeHTTP(resp, &http.Request{Method: "GET", URL: &url.URL{Path: "panic-app/crash"}})
+
+	if resp.statusCode != http.StatusInternalServerError {
+		t.Errorf("expected 500 got %d", resp.statusCode)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.dataWritten), &body); err != nil {
+		t.Fatalf("expected json body got %s", resp.dataWritten)
+	}
+	if requestId, _ := body["RequestId"].(string); !StringLenGtZero(requestId) {
+		t.Errorf("expected request ID in body got %s", resp.dataWritten)
+	}
+	if httpPanicCount() != before+1 {
+		t.Error("expected http panic metric to be incremented")
+	}
+}
+
+func TestHandlerPanicIsLoggedOnce(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := NewService(&Config{}, &[]App{&PanicApp{}})
+	s.Logger = NewLogger(&Config{}, buf)
+	defaultLogger := slog.Default()
+	slog.SetDefault(s.Logger)
+	defer slog.SetDefault(defaultLogger)
+
+	s.ServeHTTP(&MockResponseWriter{}, &http.Request{Method: "GET", URL: &url.URL{Path: "panic-app/crash"}})
+
+	if lines := strings.Count(buf.String(), "boom"); lines != 1 {
+		t.Errorf("expected the panic to be logged once got %d lines %s", lines, buf.String())
+	}
+}
+
+func httpPanicCount() int64 {
+	if counter, ok := panicsTotal.Get("http").(*expvar.Int); ok {
+		return counter.Value()
+	}
+	return 0
+}
+
+func TestGoFuncWrapperRecovers(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	GoFuncWrapper("panicking goroutine", func() {
+		defer wg.Done()
+		panic("boom")
+	})
+	wg.Wait()
+
+	wg.Add(1)
+	GoFuncWithContext(context.Background(), "panicking goroutine with context", func(ctx context.Context) {
+		defer wg.Done()
+		panic("boom")
+	})
+	wg.Wait()
+}
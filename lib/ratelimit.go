@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	limiterSweepInterval   = time.Minute
+	defaultRateLimitPeriod = time.Minute
+
+	RateLimitByIP     = "ip"
+	RateLimitByUser   = "user"
+	RateLimitByAPIKey = "api_key"
+
+	MemoryRateLimitStore = "memory"
+	RedisRateLimitStore  = "redis"
+)
+
+type RateLimitConfig struct {
+	Store   string                `json:"Store"`   // memory(default) or redis, redis counts requests of every replica together
+	Default *RateLimit            `json:"Default"` // Budget per client over every route without a more specific limit
+	Rules   map[string]*RateLimit `json:"Rules"`   // Keyed on app or app/action, app/action wins. Limit 0 turns limiting off
+}
+
+// RateLimit allows Limit requests per period with bursts up to Limit, per client as picked by Key.
+type RateLimit struct {
+	Limit         int    `json:"Limit"`
+	PeriodSeconds int    `json:"PeriodSeconds"` // Defaults to 60
+	Key           string `json:"Key"`           // ip(default), user or api_key. Callers without one are counted by ip
+}
+
+func (limit *RateLimit) period() time.Duration {
+	if limit.PeriodSeconds > 0 {
+		return time.Duration(limit.PeriodSeconds) * time.Second
+	}
+	return defaultRateLimitPeriod
+}
+
+// RateLimiter takes one request from key's budget. Errors are logged and the request counted in memory instead.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit int, period time.Duration) (RateLimitResult, error)
+}
+
+// memoryLimiter is a token bucket per key, buckets refill continuously so bursts up to limit are allowed.
+// Only counts requests this replica sees.
+type memoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	limit     int
+	period    time.Duration
+}
+
+// RateLimitResult is the outcome of a limiter check, used for RateLimit-* and Retry-After headers.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // Until the next request would be allowed, 0 when allowed
+	ResetAfter time.Duration // Until the bucket is full again
+}
+
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+func (limiter *memoryLimiter) Allow(ctx context.Context, key string, limit int, period time.Duration) (RateLimitResult, error) {
+	return limiter.allow(key, limit, period), nil
+}
+
+// allow takes a token from key's bucket, limit requests per period.
+func (limiter *memoryLimiter) allow(key string, limit int, period time.Duration) RateLimitResult {
+	now := time.Now()
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.sweep(now)
+
+	bucket, found := limiter.buckets[key]
+	if !found || bucket.limit != limit || bucket.period != period {
+		bucket = &tokenBucket{tokens: float64(limit), updatedAt: now, limit: limit, period: period}
+		limiter.buckets[key] = bucket
+	}
+
+	rate := float64(limit) / float64(period) // Tokens per nanosecond
+	bucket.tokens = math.Min(float64(limit), bucket.tokens+float64(now.Sub(bucket.updatedAt))*rate)
+	bucket.updatedAt = now
+
+	result := RateLimitResult{Limit: limit}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.tokens) / rate)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.ResetAfter = time.Duration((float64(limit) - bucket.tokens) / rate)
+	return result
+}
+
+// sweep drops full buckets now and then so one-off clients don't pile up.
+func (limiter *memoryLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < limiterSweepInterval {
+		return
+	}
+	limiter.lastSweep = now
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.updatedAt) >= bucket.period {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// gcraScript is the generic cell rate algorithm: the key holds the theoretical arrival time(tat) of the next request
+// in ms, each request pushes it by period/limit and requests more than period ahead of now are refused.
+// Returns allowed, remaining, retry after ms and reset after ms.
+var gcraScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local emission = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local newTat = tat + emission
+local allowAt = newTat - limit * emission
+local diff = now - allowAt
+if diff < 0 then
+	return {0, 0, -diff, tat - now}
+end
+redis.call("SET", KEYS[1], newTat, "PX", math.ceil(newTat - now))
+return {1, math.floor(diff / emission), 0, newTat - now}
+`)
+
+// redisLimiter runs GCRA in redis so every replica shares one budget per key.
+// Time comes from the replica, keep clocks in sync.
+type redisLimiter struct {
+	client *redis.Client
+}
+
+func NewRedisRateLimiter(client *redis.Client) RateLimiter {
+	return &redisLimiter{client: client}
+}
+
+func (limiter *redisLimiter) Allow(ctx context.Context, key string, limit int, period time.Duration) (RateLimitResult, error) {
+	emission := float64(period.Milliseconds()) / float64(limit)
+	values, err := gcraScript.Run(limiter.client.WithContext(ctx), []string{"rate-limit:" + key}, time.Now().UnixMilli(), emission, limit).Result()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	result, isSlice := values.([]interface{})
+	if !isSlice || len(result) != 4 {
+		return RateLimitResult{}, fmt.Errorf("unexpected rate limit result %v", values)
+	}
+	ints := make([]int64, len(result))
+	for idx, value := range result {
+		if ints[idx], isSlice = value.(int64); !isSlice {
+			return RateLimitResult{}, fmt.Errorf("unexpected rate limit result %v", values)
+		}
+	}
+	return RateLimitResult{
+		Allowed:    ints[0] == 1,
+		Limit:      limit,
+		Remaining:  int(ints[1]),
+		RetryAfter: time.Duration(ints[2]) * time.Millisecond,
+		ResetAfter: time.Duration(ints[3]) * time.Millisecond,
+	}, nil
+}
+
+// initRateLimiter picks the limiter for Config.RateLimit.Store once redis is set up, a limiter set with
+// SetRateLimiter is kept.
+func (s *Service) initRateLimiter() {
+	if s.rateLimiter != nil {
+		return
+	}
+	store := ""
+	if s.Config.RateLimit != nil {
+		store = s.Config.RateLimit.Store
+	}
+	switch store {
+	case "", MemoryRateLimitStore:
+		s.rateLimiter = s.memoryRateLimiter
+	case RedisRateLimitStore:
+		if s.RedisClient == nil {
+			errTxt := "Redis is required for the redis rate limit store"
+			CheckFatal(errors.New(errTxt), errTxt)
+		}
+		s.rateLimiter = NewRedisRateLimiter(s.RedisClient)
+	default:
+		errTxt := fmt.Sprintf("unknown rate limit store %s", store)
+		CheckFatal(errors.New(errTxt), errTxt)
+	}
+}
+
+// rateLimiters returns the configured limiter and the in memory one it falls back to.
+func (s *Service) rateLimiters() (RateLimiter, *memoryLimiter) {
+	if s.rateLimiter == nil {
+		// Init hasn't picked one yet, memory is all there is.
+		return s.memoryRateLimiter, s.memoryRateLimiter
+	}
+	return s.rateLimiter, s.memoryRateLimiter
+}
+
+// SetRateLimiter swaps the configured limiter for a custom one, call it before serving.
+func (s *Service) SetRateLimiter(limiter RateLimiter) {
+	s.rateLimiter = limiter
+}
+
+// rateLimitRule picks the limit of a route and the scope its budget is shared over:
+// Config rule for app/action, Config rule for app, HttpAction.RateLimit then Config default.
+func (s *Service) rateLimitRule(app string, httpAction *HttpAction) (*RateLimit, string) {
+	config := s.Config.RateLimit
+	if config != nil {
+		for _, scope := range []string{app + "/" + httpAction.Action, app} {
+			if rule, found := config.Rules[scope]; found {
+				return activeRateLimit(rule), scope
+			}
+		}
+	}
+	if httpAction.RateLimit != nil {
+		return activeRateLimit(httpAction.RateLimit), app + "/" + httpAction.Action
+	}
+	if config != nil {
+		return activeRateLimit(config.Default), "default"
+	}
+	return nil, ""
+}
+
+func activeRateLimit(rule *RateLimit) *RateLimit {
+	if rule == nil || rule.Limit <= 0 {
+		return nil
+	}
+	return rule
+}
+
+// allowRequest counts req under key with the service's limiter.
+func (s *Service) allowRequest(req *Request, key string, limit int, period time.Duration) RateLimitResult {
+	limiter, fallback := s.rateLimiters()
+	result, err := limiter.Allow(req.Context(), key, limit, period)
+	if err != nil {
+		// Failing open to memory keeps serving when redis is down, limits are per replica until it's back.
+		req.Log().Error("rate limiter failed, counting in memory", "error", err)
+		result = fallback.allow(key, limit, period)
+	}
+	return result
+}
+
+// rateLimitKey identifies the client, falling back to ip for callers without a user or api key.
+func rateLimitKey(req *Request, rule *RateLimit) string {
+	switch rule.Key {
+	case RateLimitByAPIKey:
+		if key, isAPIKey := req.Auth.Payload.(*APIKey); isAPIKey {
+			return "api_key:" + key.Id
+		}
+		fallthrough
+	case RateLimitByUser:
+		if req.Auth.IsAuthenticated && StringLenGtZero(req.UserId) {
+			return "user:" + req.UserId
+		}
+	}
+	return "ip:" + req.ClientIP
+}
+
+// rateLimit counts req against its route's limit, ip limits run before auth and the others once auth passed.
+// RateLimit-* headers are set on w, the returned 429 is nil when the request may go on.
+func (s *Service) rateLimit(w http.ResponseWriter, req *Request, httpAction *HttpAction, authenticated bool) *Response {
+	rule, scope := s.rateLimitRule(req.AppTitle, httpAction)
+	if rule == nil {
+		return nil
+	}
+	if byIP := rule.Key == "" || rule.Key == RateLimitByIP; byIP == authenticated {
+		return nil
+	}
+
+	key := scope + ":" + rateLimitKey(req, rule)
+	result := s.allowRequest(req, key, rule.Limit, rule.period())
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.ResetAfter.Seconds()))))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Limit, int(rule.period().Seconds())))
+	if result.Allowed {
+		return nil
+	}
+	req.Log().Info("rate limited", "rate_limit_key", key)
+	return TooManyRequestsResponse(result.RetryAfter)
+}
@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// headerUserValidator authenticates whoever is named in X-User.
+type headerUserValidator struct{}
+
+func (v *headerUserValidator) Validate(req *Request) Auth {
+	if user := req.GetHeaderVal("X-User"); user != nil {
+		return Auth{IsAuthenticated: true, UserId: *user}
+	}
+	return Auth{}
+}
+
+type RateLimitApp struct {
+	MockApp
+}
+
+func (app *RateLimitApp) Title() string {
+	return "limited"
+}
+
+func (app *RateLimitApp) Routes() []HttpAction {
+	handler := func(r *Request) *Response { return SuccessResponse("ok") }
+	users := []AuthValidatorCallback{func(*Service) AuthValidator { return &headerUserValidator{} }}
+	return []HttpAction{
+		{Action: "by-ip", Handler: handler, RateLimit: &RateLimit{Limit: 2}},
+		{Action: "by-user", Handler: handler, RateLimit: &RateLimit{Limit: 2, Key: RateLimitByUser}, AuthValidators: users},
+		{Action: "override", Handler: handler, RateLimit: &RateLimit{Limit: 5}},
+		{Action: "disabled", Handler: handler, RateLimit: &RateLimit{Limit: 1}},
+		{Action: "default", Handler: handler},
+	}
+}
+
+type failingLimiter struct{}
+
+func (limiter *failingLimiter) Allow(ctx context.Context, key string, limit int, period time.Duration) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("redis is down")
+}
+
+func TestRateLimit(t *testing.T) {
+	newService := func() *Service {
+		return NewService(&Config{RateLimit: &RateLimitConfig{
+			Default: &RateLimit{Limit: 3},
+			Rules: map[string]*RateLimit{
+				"limited/override": {Limit: 1},
+				"limited/disabled": {Limit: 0},
+			},
+		}}, &[]App{&RateLimitApp{}})
+	}
+
+	type call struct {
+		remoteAddr string
+		user       string
+	}
+
+	type input struct {
+		title       string
+		path        string
+		calls       []call
+		expStatuses []int16
+	}
+
+	alice, bob := call{remoteAddr: "1.1.1.1:1"}, call{remoteAddr: "2.2.2.2:1"}
+	inputs := []input{
+		{title: "Per ip", path: "/limited/by-ip", calls: []call{alice, alice, alice, bob}, expStatuses: []int16{200, 200, 429, 200}},
+		{
+			title:       "Per user whatever the ip",
+			path:        "/limited/by-user",
+			calls:       []call{{"1.1.1.1:1", "u1"}, {"2.2.2.2:1", "u1"}, {"3.3.3.3:1", "u1"}, {"1.1.1.1:1", "u2"}},
+			expStatuses: []int16{200, 200, 429, 200},
+		},
+		{title: "Config rule wins over the action", path: "/limited/override", calls: []call{alice, alice}, expStatuses: []int16{200, 429}},
+		{title: "Limit 0 turns it off", path: "/limited/disabled", calls: []call{alice, alice, alice}, expStatuses: []int16{200, 200, 200}},
+		{title: "Default", path: "/limited/default", calls: []call{alice, alice, alice, alice}, expStatuses: []int16{200, 200, 200, 429}},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			s := newService()
+			statuses := []int16{}
+			for _, call := range input.calls {
+				header := http.Header{}
+				if call.user != "" {
+					header.Set("X-User", call.user)
+				}
+				w := &MockResponseWriter{}
+				s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: input.path}, Header: header, RemoteAddr: call.remoteAddr})
+				statuses = append(statuses, w.statusCode)
+			}
+			for idx := range statuses {
+				if statuses[idx] != input.expStatuses[idx] {
+					t.Fatalf("expected %v got %v", input.expStatuses, statuses)
+				}
+			}
+		})
+	}
+
+	t.Run("Headers", func(t *testing.T) {
+		s := newService()
+		serve := func() *MockResponseWriter {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: "/limited/by-ip"}, Header: http.Header{}, RemoteAddr: "1.1.1.1:1"})
+			return w
+		}
+		first := serve()
+		if first.Header().Get("RateLimit-Limit") != "2" || first.Header().Get("RateLimit-Remaining") != "1" || first.Header().Get("RateLimit-Policy") != "2;w=60" {
+			t.Errorf("unexpected headers %v", first.Header())
+		}
+		serve()
+		limited := serve()
+		if limited.Header().Get("Retry-After") != "30" || limited.Header().Get("RateLimit-Remaining") != "0" {
+			t.Errorf("unexpected headers %v", limited.Header())
+		}
+	})
+
+	t.Run("Falls back to memory", func(t *testing.T) {
+		s := newService()
+		s.SetRateLimiter(&failingLimiter{})
+		statuses := []int16{}
+		for i := 0; i < 3; i++ {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: "/limited/by-ip"}, Header: http.Header{}, RemoteAddr: "1.1.1.1:1"})
+			statuses = append(statuses, w.statusCode)
+		}
+		if statuses[0] != 200 || statuses[1] != 200 || statuses[2] != 429 {
+			t.Errorf("expected 200, 200, 429 got %v", statuses)
+		}
+	})
+
+	t.Run("Init picks the configured store", func(t *testing.T) {
+		s := newService()
+		s.initRateLimiter()
+		if limiter, fallback := s.rateLimiters(); limiter != fallback {
+			t.Errorf("expected the memory limiter got %T", limiter)
+		}
+
+		custom := &failingLimiter{}
+		s = newService()
+		s.SetRateLimiter(custom)
+		s.initRateLimiter()
+		if limiter, _ := s.rateLimiters(); limiter != custom {
+			t.Errorf("expected the custom limiter to be kept got %T", limiter)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReturnResp(t *testing.T) {
+	s := NewService(&Config{}, &[]App{})
+	req := &Request{ID: "req-1"}
+
+	type input struct {
+		title         string
+		resp          *Response
+		expStatusCode int16
+		expResp       string
+		expHeader     map[string]string
+	}
+
+	inputs := []input{
+		{
+			title:         "Created sets Location",
+			resp:          CreatedResponse("/users/1", map[string]int{"ID": 1}),
+			expStatusCode: http.StatusCreated,
+			expResp:       "{\"ID\":1}",
+			expHeader:     map[string]string{"Location": "/users/1"},
+		},
+		{
+			title:         "No content has no body or content type",
+			resp:          NoContentResponse(),
+			expStatusCode: http.StatusNoContent,
+			expResp:       "",
+			expHeader:     map[string]string{"Content-Type": ""},
+		},
+		{
+			title:         "Redirect defaults to 302",
+			resp:          RedirectResponse("https://example.com/login", 0),
+			expStatusCode: http.StatusFound,
+			expResp:       "",
+			expHeader:     map[string]string{"Location": "https://example.com/login"},
+		},
+		{
+			title:         "Explicit content type and headers are honoured",
+			resp:          SuccessResponse("id,name\n1,bob\n").WithContentType("text/csv").SetHeader("Cache-Control", "no-store"),
+			expStatusCode: http.StatusOK,
+			expResp:       "id,name\n1,bob\n",
+			expHeader:     map[string]string{"Content-Type": "text/csv", "Cache-Control": "no-store"},
+		},
+		{
+			title:         "Cookies are set",
+			resp:          SuccessResponse("OK").SetCookie(&http.Cookie{Name: "theme", Value: "dark"}),
+			expStatusCode: http.StatusOK,
+			expResp:       "OK",
+			expHeader:     map[string]string{"Set-Cookie": "theme=dark"},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			w := &MockResponseWriter{}
+			s.returnResp(w, input.resp, req)
+			if w.dataWritten != input.expResp {
+				t.Errorf("expected %s got %s", input.expResp, w.dataWritten)
+			}
+			if w.statusCode != input.expStatusCode {
+				t.Errorf("expected %d got %d", input.expStatusCode, w.statusCode)
+			}
+			for key, exp := range input.expHeader {
+				if got := w.Header().Get(key); got != exp {
+					t.Errorf("expected header %s to be %s got %s", key, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestIsLocalRedirect(t *testing.T) {
+	inputs := map[string]bool{
+		"/dashboard?tab=1":    true,
+		"/":                   true,
+		"":                    false,
+		"dashboard":           false,
+		"//evil.com":          false,
+		"/\\evil.com":         false,
+		"/\t/evil.com":        false,
+		"/\n/evil.com":        false,
+		"/\r\n/evil.com":      false,
+		"https://evil.com":    false,
+		"/%09/evil.com":       true,
+		"javascript:alert(1)": false,
+	}
+	for location, exp := range inputs {
+		if got := IsLocalRedirect(location); got != exp {
+			t.Errorf("expected %t for %q got %t", exp, location, got)
+		}
+	}
+}
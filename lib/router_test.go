@@ -1,8 +1,13 @@
 package lib
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -28,8 +33,14 @@ func (m *MockResponseWriter) WriteHeader(statusCode int) {
 	m.statusCode = int16(statusCode)
 }
 
+// GotExpResp compares JSON bodies structurally, ignoring RequestId as it's random per request.
 func (m *MockResponseWriter) GotExpResp(exp string) bool {
-	return m.dataWritten == exp
+	var expJSON, gotJSON map[string]interface{}
+	if json.Unmarshal([]byte(exp), &expJSON) != nil || json.Unmarshal([]byte(m.dataWritten), &gotJSON) != nil {
+		return m.dataWritten == exp
+	}
+	delete(gotJSON, "RequestId")
+	return reflect.DeepEqual(expJSON, gotJSON)
 }
 
 type MockApp struct {
@@ -108,6 +119,17 @@ func (mApp *MockApp) Routes() []HttpAction {
 				return SuccessResponse("Success POST")
 			},
 		},
+		{
+			Method: "POST",
+			Action: "echo-body",
+			Handler: func(r *Request) *Response {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					return ErrorToResponse(err)
+				}
+				return SuccessResponse(string(body))
+			},
+		},
 		{
 			Action: "get",
 			Handler: func(*Request) *Response {
@@ -145,13 +167,43 @@ func TestRouter(t *testing.T) {
 
 	inputs := []input{
 		{
-			title: "Options returns empty response",
+			title: "Options on unknown route returns 404",
+			req: http.Request{
+				Method: "OPTIONS",
+				URL: &url.URL{
+					Path: "mock-app/invalid-route",
+				},
+			},
+			resp:          &MockResponseWriter{},
+			expStatusCode: 404,
+			expResp:       "{\"Code\": \"not_found\", \"Msg\": \"doesn't exist\"}",
+			apps:          []App{&MockApp{}},
+		},
+		{
+			title: "Options on known route returns empty response",
 			req: http.Request{
 				Method: "OPTIONS",
+				URL: &url.URL{
+					Path: "mock-app/models",
+				},
 			},
 			resp:          &MockResponseWriter{},
-			expStatusCode: 0,
+			expStatusCode: 204,
 			expResp:       "",
+			apps:          []App{&MockApp{}},
+		},
+		{
+			title: "Head is served by get",
+			req: http.Request{
+				Method: "HEAD",
+				URL: &url.URL{
+					Path: "mock-app/public-success-get",
+				},
+			},
+			resp:          &MockResponseWriter{},
+			expStatusCode: 200,
+			expResp:       "Success",
+			apps:          []App{&MockApp{}},
 		},
 		{
 			title: "Public valid get API should return 200",
@@ -176,7 +228,7 @@ func TestRouter(t *testing.T) {
 			},
 			expStatusCode: 404,
 			resp:          &MockResponseWriter{},
-			expResp:       "{\"Msg\": \"doesn't exist\"}",
+			expResp:       "{\"Code\": \"not_found\", \"Msg\": \"doesn't exist\"}",
 			apps:          []App{&MockApp{}},
 		},
 		{
@@ -189,7 +241,7 @@ func TestRouter(t *testing.T) {
 			},
 			expStatusCode: 405,
 			resp:          &MockResponseWriter{},
-			expResp:       "POST not allowed on mock-app/public-success-get",
+			expResp:       "{\"Code\": \"method_not_allowed\", \"Msg\": \"POST not allowed on mock-app/public-success-get\"}",
 			apps:          []App{&MockApp{}},
 		},
 		{
@@ -215,7 +267,7 @@ func TestRouter(t *testing.T) {
 			},
 			expStatusCode: 401,
 			resp:          &MockResponseWriter{},
-			expResp:       "{\"Msg\": \"Auth failed, please try again\"}",
+			expResp:       "{\"Code\": \"auth_failed\", \"Msg\": \"Auth failed, please try again\"}",
 			apps:          []App{&MockApp{}},
 		},
 		{
@@ -331,3 +383,80 @@ func TestRouter(t *testing.T) {
 	}
 
 }
+
+func TestAllowHeader(t *testing.T) {
+	s := NewService(&Config{}, &[]App{&MockApp{}})
+
+	type input struct {
+		title    string
+		method   string
+		path     string
+		expAllow string
+	}
+
+	inputs := []input{
+		{
+			title:    "405 lists allowed methods",
+			method:   "DELETE",
+			path:     "mock-app/models",
+			expAllow: "GET, HEAD, OPTIONS, POST",
+		},
+		{
+			title:    "Options lists allowed methods",
+			method:   "OPTIONS",
+			path:     "mock-app/public-success-get",
+			expAllow: "GET, HEAD, OPTIONS",
+		},
+		{
+			title:    "Served requests have no Allow",
+			method:   "GET",
+			path:     "mock-app/models",
+			expAllow: "",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{Method: input.method, URL: &url.URL{Path: input.path}})
+			if got := w.Header().Get("Allow"); got != input.expAllow {
+				t.Errorf("expected Allow %q got %q", input.expAllow, got)
+			}
+		})
+	}
+}
+
+func TestHeadHasNoBody(t *testing.T) {
+	server := httptest.NewServer(NewService(&Config{}, &[]App{&MockApp{}}))
+	defer server.Close()
+
+	resp, err := http.Head(server.URL + "/mock-app/public-success-get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || len(body) != 0 {
+		t.Errorf("expected empty 200 got %d %q", resp.StatusCode, body)
+	}
+	if resp.ContentLength != int64(len("Success")) {
+		t.Errorf("expected Content-Length of GET body got %d", resp.ContentLength)
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	server := httptest.NewServer(NewService(&Config{}, &[]App{&MockApp{}}))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/mock-app/echo-body", "text/plain", strings.NewReader("raw payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "raw payload" {
+		t.Errorf("expected handler to read the request body got %d %q", resp.StatusCode, body)
+	}
+}
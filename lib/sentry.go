@@ -3,6 +3,7 @@ package lib
 import (
 	"context"
 	"log"
+	"log/slog"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -32,7 +33,7 @@ func InitiateSentry(config *Config) {
 	if err != nil {
 		log.Fatalf("sentry.Init: %s", err)
 	} else {
-		log.Println("INFO: Sentry initiated successfully")
+		slog.Info("sentry initiated successfully")
 	}
 	// Flush buffered events before the program terminates.
 	defer sentry.Flush(2 * time.Second)
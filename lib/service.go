@@ -1,15 +1,21 @@
 package lib
 
 import (
-	"crypto/tls"
-	"encoding/json"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/go-redis/redis"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Service struct {
@@ -21,6 +27,38 @@ type Service struct {
 
 	SqsManager  ISqsManager
 	RedisClient *redis.Client
+	DbPool      *pgxpool.Pool
+	Logger      *slog.Logger
+	Health      *HealthRegistry
+	Codecs      *Codecs
+
+	accessLog      *accessLogger
+	trustedProxies []*net.IPNet
+
+	jwksMu     sync.Mutex
+	jwksCaches map[string]*jwksCache
+
+	oktaOnce sync.Once
+	okta     *OktaClient
+
+	principalResolver PrincipalResolver
+
+	apiKeyStore APIKeyStore
+
+	noncesOnce sync.Once
+	nonces     *nonceCache
+
+	authCacheOnce sync.Once
+	authCache     *authCache
+
+	sessions     *SessionManager
+	sessionStore SessionStore
+
+	hubsMu sync.Mutex
+	hubs   []*Hub
+
+	rateLimiter       RateLimiter
+	memoryRateLimiter *memoryLimiter
 }
 
 func NewService(config *Config, definedApps *[]App) *Service {
@@ -30,9 +68,22 @@ func NewService(config *Config, definedApps *[]App) *Service {
 		apps:          make(map[string]App),
 		routes:        make(map[string]HttpRoute),
 		queueHandlers: make(map[string]QueueRoute),
+		Logger:        NewLogger(config, nil),
+		Health:        NewHealthRegistry(config.Health),
+		Codecs:        NewCodecs(),
+	}
+
+	s.accessLog = newAccessLogger(config, nil)
+	s.memoryRateLimiter = newMemoryLimiter()
+	s.trustedProxies = parseTrustedProxies(config.TrustedProxies)
+
+	if config.OpenAPI != nil && StringLenGtZero(config.OpenAPI.Path) {
+		withSpec := append(append([]App{}, *definedApps...), newOpenAPIApp(config.OpenAPI.Path))
+		definedApps = &withSpec
 	}
 
 	s.createRoutes(definedApps)
+	s.checkCORSPolicies()
 
 	// Always keep this separate as there's guarantee that all apps are recognised by service.
 	for _, app := range *definedApps {
@@ -55,13 +106,15 @@ func (s *Service) createRoutes(definedApps *[]App) {
 		for _, route := range app.Routes() {
 			route.Validate()
 			if _, routeFound := s.routes[appTitle][route.Action]; !routeFound {
-				s.routes[appTitle][route.Action] = make(map[HttpMethod]HttpAction)
+				s.routes[appTitle][route.Action] = make(map[HttpMethod]versionedActions)
 			}
-			if _, dupFound := s.routes[appTitle][route.Action][route.Method]; dupFound {
-				errTitle := fmt.Sprintf("route re-initialization not allowed for %s action %s method %s", appTitle, route.Action, route.Method)
-				CheckFatal(errors.New(errTitle), errTitle)
+			for _, existing := range s.routes[appTitle][route.Action][route.Method] {
+				if existing.Version == route.Version {
+					errTitle := fmt.Sprintf("route re-initialization not allowed for %s action %s method %s version %d", appTitle, route.Action, route.Method, route.Version)
+					CheckFatal(errors.New(errTitle), errTitle)
+				}
 			}
-			s.routes[appTitle][route.Action][route.Method] = route
+			s.routes[appTitle][route.Action][route.Method] = s.routes[appTitle][route.Action][route.Method].add(route)
 		}
 		for queueRefName, handler := range app.QueueHandlers() {
 			queueName, found := s.Config.Queues[queueRefName]
@@ -80,12 +133,14 @@ func (s *Service) Init() string {
 	s.Server.Handler = s
 	startPort := ":" + s.Config.Port
 	s.Server.Addr = startPort
+	s.initTLS()
 
 	sqsManager, sqsErr := NewSqsManager(s.Config.ENV)
 	if sqsErr != nil {
 		CheckFatal(sqsErr, "SQS initialization failed")
 	}
 
+	sqsManager.logger = s.Logger.With("component", "sqs")
 	s.SqsManager = sqsManager
 
 	for _, queues := range s.queueHandlers {
@@ -98,22 +153,38 @@ func (s *Service) Init() string {
 	}
 
 	if s.Config.RedisCreds != nil {
+		tlsConfig, tlsErr := redisTLSConfig(s.Config.RedisCreds)
+		CheckFatal(tlsErr, "unable to load redis tls config")
+		if s.Config.RedisCreds.InsecureSkipVerify {
+			s.Logger.Warn("redis certificate isn't verified, set Redis.CAFile instead of InsecureSkipVerify")
+		}
 		s.RedisClient = redis.NewClient(&redis.Options{
-			Addr:     s.Config.RedisCreds.Addr,
-			Password: s.Config.RedisCreds.Password,
-			DB:       s.Config.RedisCreds.Db,
-			TLSConfig: &tls.Config{
-				InsecureSkipVerify: true,
-				MinVersion:         tls.VersionTLS12,
-			},
+			Addr:      s.Config.RedisCreds.Addr,
+			Password:  s.Config.RedisCreds.Password,
+			DB:        s.Config.RedisCreds.Db,
+			TLSConfig: tlsConfig,
 		})
 
 		if s.RedisClient == nil {
 			errorMsg := "unable to initiate redis"
 			CheckFatal(errors.New(errorMsg), errorMsg)
 		}
+		s.startHubs()
 	}
 
+	if StringLenGtZero(s.Config.DbUrl) {
+		// Pool connects lazily, failures surface through the db readiness check.
+		dbPool, dbErr := pgxpool.New(context.Background(), s.Config.DbUrl)
+		CheckFatal(dbErr, "unable to initiate db pool")
+		s.DbPool = dbPool
+	}
+
+	s.initRateLimiter()
+	s.initAPIKeys()
+	s.initSessions()
+	s.initSignature()
+	s.registerComponentHealthChecks()
+
 	return startPort
 }
 
@@ -128,21 +199,21 @@ func (s *Service) GetAppByTitle(title string) App {
 	return app
 }
 
-func (s *Service) handleAuthResp(req *Request, validators *[]AuthValidatorCallback, onSuccess func(*Request) *Response, onFailure func(*Request) *Response) *Response {
-
-	reqAuth := Auth{}
+func (s *Service) handleAuthResp(req *Request, validators *[]AuthValidatorCallback, onSuccess func(*Request) *Response, onFailure func(*Request, Auth, []AuthFailure) *Response) *Response {
 
 	if validators != nil && len(*validators) > 0 { // Auth check
-		for _, validator := range *validators {
-			if auth := validator(s).Validate(req); auth.IsAuthenticated {
-				reqAuth = auth
-			}
-		}
+		policy := &authPolicy{service: s, validators: *validators}
+		reqAuth, failures := policy.check(req)
 		if reqAuth.IsAuthenticated {
 			req.Auth = reqAuth
+			if StringLenGtZero(reqAuth.UserId) {
+				req.UserId = reqAuth.UserId
+				req.Logger = req.Log().With("user_id", reqAuth.UserId)
+			}
 			return onSuccess(req)
 		} else {
-			return onFailure(req)
+			req.Log().Info("auth failed", "forbidden", reqAuth.Forbidden)
+			return onFailure(req, reqAuth, failures)
 		}
 	}
 
@@ -150,42 +221,50 @@ func (s *Service) handleAuthResp(req *Request, validators *[]AuthValidatorCallba
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, httpReq *http.Request) {
-
-	if httpReq.Method != "OPTIONS" {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	start := time.Now()
+	recorder := &responseRecorder{ResponseWriter: w}
+	req := s.serveHTTP(recorder, httpReq)
+	if s.accessLog != nil {
+		s.accessLog.log(httpReq, req, recorder, start)
 	}
+}
 
-	// Set access control headers
-	w.Header().Set("Vary", "Accept-Encoding, Authorization, Origin")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if httpReq.Method == "OPTIONS" {
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Accept-Encoding, Accept-Language, Access-Control-Allow-Headers, Access-Control-Allow-Methods, Access-Control-Allow-Origin, Access-Control-Max-Age, Access-Control-Request-Headers, Access-Control-Request-Method, Authorization, Origin, Cache-Control, Connection, Content-Type, Content-Encoding, Content-Length, Sec-Fetch-Dest, Sec-Fetch-Mode, Sec-Fetch-Site, X-Requested-With")
-		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST")
-	}
+// serveHTTP routes the request and returns the lib.Request it built.
+func (s *Service) serveHTTP(w *responseRecorder, httpReq *http.Request) (req *Request) {
 
-	// No body required if OPTIONS request
-	if httpReq.Method == "OPTIONS" {
-		fmt.Fprintf(w, "")
-		return
-	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Vary", "Accept, Accept-Encoding, Authorization, Origin")
 
-	appName, action := decodeURI(httpReq)
+	versioning := s.Config.Versioning
+	pathVersion, appName, action := decodeURI(httpReq, versioning != nil && versioning.Strategy == PathVersioning)
+	corsPolicy := s.corsPolicy(appName)
+	corsAllowed := corsPolicy.applyCORS(w, httpReq)
 
 	ctx := httpReq.Context()
 
 	var resp *Response
 
-	req := &Request{
+	req = &Request{
 		AppTitle:      appName,
+		Action:        action,
 		Path:          httpReq.URL.Path,
 		Method:        httpReq.Method,
+		Body:          httpReq.Body,
 		Header:        httpReq.Header,
 		ID:            GenerateRandomUUID(),
 		SentryContext: ctx,
 		Query:         httpReq.URL.Query(),
+		ClientIP:      clientIP(httpReq, s.trustedProxies),
+		httpReq:       httpReq,
+		codecs:        s.Codecs,
 	}
+	req.Logger = s.newRequestLogger(req, action)
 
-	defer Handlepanic(fmt.Sprintf("%s: API (%s) crashed", req.ID, req.Path))
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.handleHTTPPanic(w, req, recovered)
+		}
+	}()
 
 	if hub := sentry.GetHubFromContext(ctx); hub != nil {
 		hub.Scope().SetTag("trace-id", req.ID)
@@ -196,77 +275,182 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, httpReq *http.Request) {
 		s.returnResp(w, resp, req)
 	}
 
-	methodMap, foundRoute := s.routes[appName][action]
-	if !foundRoute {
+	version, versionErr := s.requestedVersion(httpReq, pathVersion)
+	if versionErr != nil {
+		s.returnResp(w, ErrorToResponse(versionErr), req)
+		return req
+	}
+
+	methodMap := forVersion(s.routes[appName][action], version)
+	if len(methodMap) == 0 {
 		returnError(fmt.Sprintf("Invalid route %s encountered in app %s", action, appName), NotFoundResponse())
-		return
+		return req
 	}
 
-	var httpAction HttpAction
+	httpAction, actionFound := methodMap[HttpMethod(req.Method)]
+	// HEAD is served by GET, net/http drops the body.
+	if !actionFound && req.Method == string(HEAD) {
+		httpAction, actionFound = methodMap[GET]
+	}
 
-	if action, actionFound := methodMap[HttpMethod(req.Method)]; actionFound {
-		httpAction = action
-	} else {
-		returnError(fmt.Sprintf("%s not allowed on %s", req.Method, httpReq.URL.Path), &Response{
-			Status: http.StatusMethodNotAllowed,
-			Body:   fmt.Sprintf("%s not allowed on %s", req.Method, httpReq.URL.Path),
-		})
-		return
+	if !actionFound {
+		w.Header().Set("Allow", strings.Join(allowedMethods(methodMap), ", "))
+		if req.Method == string(OPTIONS) {
+			if corsAllowed {
+				corsPolicy.writePreflight(w, methodMap)
+			}
+			s.returnResp(w, NoContentResponse(), req)
+			return req
+		}
+		errTxt := fmt.Sprintf("%s not allowed on %s", req.Method, httpReq.URL.Path)
+		returnError(errTxt, ErrorToResponse(ErrMethodNotAllowed(errTxt)))
+		return req
+	}
+
+	req.Version = version
+	if version == latestVersion {
+		req.Version = httpAction.Version
 	}
+	s.setVersionHeaders(w, httpAction)
 
 	if hub := sentry.GetHubFromContext(ctx); hub != nil {
 		hub.Scope().SetTag("RequestType", "HTTP")
 	}
 
+	if limited := s.rateLimit(w, req, &httpAction, false); limited != nil {
+		s.returnResp(w, limited, req)
+		return req
+	}
+
 	resp = s.handleAuthResp(req, &httpAction.AuthValidators, func(r *Request) *Response {
+		if forbidden := s.authorize(req, &httpAction); forbidden != nil {
+			return forbidden
+		}
+		if limited := s.rateLimit(w, req, &httpAction, true); limited != nil {
+			return limited
+		}
+		if httpAction.SSEHandler != nil {
+			return s.eventStreamResponse(req, httpAction.SSEHandler)
+		}
+		if httpAction.WSHandler != nil {
+			return s.webSocketResponse(httpAction.WSHandler)
+		}
 		return httpAction.Handler(req)
-	}, func(r *Request) *Response {
-		return AuthFailedResponse()
+	}, func(r *Request, auth Auth, failures []AuthFailure) *Response {
+		return authFailedResponse(auth, failures)
 	})
 
 	s.returnResp(w, resp, req)
 
+	return req
 }
 
 func (s *Service) prepareResp(w http.ResponseWriter, resp *Response, req *Request) *[]byte {
 	// Prepare HTTP response
+	if apiErr, respIsErr := resp.Body.(*APIError); respIsErr {
+		httpRespBytes, contentType, err := s.marshalAPIError(apiErr, req)
+		if err != nil {
+			req.Log().Error("failed to marshal error response", "error", err)
+			CaptureSentryException(fmt.Sprintf("%s Error encountered during json.Marshal for error %s, error %s", req.ID, apiErr.Code, err))
+			return nil
+		}
+		w.Header().Set("Content-Type", contentType)
+		return &httpRespBytes
+	}
+
 	httpRespStr, respIsStr := resp.Body.(string)
 	httpRespBytes := []byte(httpRespStr)
 	if !respIsStr {
 		var respIsBytes bool
 		httpRespBytes, respIsBytes = resp.Body.([]byte)
 		if !respIsBytes {
-			httpRespJSONBytes, err := json.Marshal(resp.Body)
+			encodedBytes, contentType, err := s.encodeBody(resp, req)
 			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				CaptureSentryException(fmt.Sprintf("%s Error encountered during json.Marshal for body %v, error %s", req.ID, resp.Body, err))
-				fmt.Fprintf(w, "{\"Msg\": \"something went wrong on our side\"}")
+				req.Log().Error("failed to encode response body", "error", err, "content_type", contentType)
+				CaptureSentryException(fmt.Sprintf("%s Error encountered while encoding %s body of type %T, error %s", req.ID, contentType, resp.Body, err))
 				return nil
 			}
-			httpRespBytes = httpRespJSONBytes
+			if contentType != JSONContentType {
+				w.Header().Set("Content-Type", contentType)
+			}
+			httpRespBytes = encodedBytes
 		}
 	}
 	return &httpRespBytes
 }
 
+// encodeBody uses the encoder for an explicit resp.ContentType, otherwise negotiates on Accept.
+func (s *Service) encodeBody(resp *Response, req *Request) ([]byte, string, error) {
+	if StringLenGtZero(resp.ContentType) {
+		if mediaType, _, err := mime.ParseMediaType(resp.ContentType); err == nil {
+			if encoder, found := s.Codecs.encoder(strings.ToLower(mediaType)); found {
+				var buf bytes.Buffer
+				err := encoder(&buf, resp.Body)
+				return buf.Bytes(), resp.ContentType, err
+			}
+		}
+	}
+
+	accept := ""
+	if val := req.GetHeaderVal("Accept"); val != nil {
+		accept = *val
+	}
+	return s.Codecs.Encode(accept, resp.Body)
+}
+
+// bodyAllowed is false for statuses where a nil body means no body at all.
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified && (status < 300 || status >= 400)
+}
+
 func (s *Service) returnResp(w http.ResponseWriter, resp *Response, req *Request) {
 
-	bytesResp := s.prepareResp(w, resp, req)
-	if resp.Status != 0 {
+	for key, values := range resp.Header {
+		w.Header()[http.CanonicalHeaderKey(key)] = values
+	}
+	for _, cookie := range resp.Cookies {
+		http.SetCookie(w, cookie)
+	}
+	if StringLenGtZero(resp.ContentType) {
+		w.Header().Set("Content-Type", resp.ContentType)
+	}
+
+	if wsBody, isWebSocket := resp.Body.(*webSocketBody); isWebSocket {
+		s.serveWebSocket(w, req, wsBody)
+		return
+	}
+
+	if isStreamBody(resp.Body) {
+		s.writeStream(w, resp, req)
+		return
+	}
+
+	if resp.Body == nil && !bodyAllowed(resp.Status) {
+		w.Header().Del("Content-Type")
 		w.WriteHeader(resp.Status)
+		return
 	}
 
+	bytesResp := s.prepareResp(w, resp, req)
 	if bytesResp == nil {
-		log.Printf("%s bytesResp is nil", req.ID)
-		w.WriteHeader(http.StatusInternalServerError)
+		s.writeInternalError(w, req)
 		return
 	}
 
-	_, err := w.Write(*bytesResp)
-	if err != nil {
-		log.Printf("%s Error during w.Write with %s", req.ID, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "{\"Msg\": \"something went wrong on our side\"}")
+	if resp.Status != 0 {
+		w.WriteHeader(resp.Status)
 	}
+
+	// Headers are already sent, nothing left to do apart from logging.
+	if _, err := w.Write(*bytesResp); err != nil {
+		req.Log().Error("failed to write response", "error", err)
+	}
+}
+
+// writeInternalError is the last resort response when the actual one can't be prepared.
+func (s *Service) writeInternalError(w http.ResponseWriter, req *Request) {
+	body, contentType, _ := s.marshalAPIError(ErrInternal(nil), req)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(body)
 }
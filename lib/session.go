@@ -0,0 +1,410 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	defaultSessionCookie  = "session"
+	defaultSessionIdleTTL = 30 * time.Minute
+	defaultSessionMaxTTL  = 12 * time.Hour
+	defaultCSRFHeader     = "X-CSRF-Token"
+	sessionIdBytes        = 32
+	sessionTouchInterval  = time.Minute
+	csrfFailedReason      = "missing or invalid csrf token"
+	sessionExpiredReason  = "session expired"
+
+	MemorySessionStore = "memory"
+	RedisSessionStore  = "redis"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+type SessionConfig struct {
+	Secret          string `json:"Secret"`          // Signs session cookies, required
+	Store           string `json:"Store"`           // redis(default) or memory
+	CookieName      string `json:"CookieName"`      // Defaults to session
+	CookieDomain    string `json:"CookieDomain"`    // Defaults to the host of the request
+	SameSite        string `json:"SameSite"`        // lax(default) or strict
+	Insecure        bool   `json:"Insecure"`        // Drops the Secure flag, for local development over http
+	IdleMinutes     int    `json:"IdleMinutes"`     // Sliding expiry, defaults to 30
+	MaxLifetimeMins int    `json:"MaxLifetimeMins"` // Absolute expiry however active the session is, defaults to 720
+	CSRFHeader      string `json:"CSRFHeader"`      // Defaults to X-CSRF-Token
+}
+
+// Session is what's kept server side, the cookie only holds the signed Id.
+type Session struct {
+	Id         string            `json:"Id"`
+	UserId     string            `json:"UserId"`
+	Roles      []string          `json:"Roles"`
+	Data       map[string]string `json:"Data"`
+	CSRFToken  string            `json:"CSRFToken"` // Send back in the CSRF header on unsafe methods
+	CreatedAt  time.Time         `json:"CreatedAt"`
+	LastSeenAt time.Time         `json:"LastSeenAt"`
+}
+
+func (session *Session) Principal() *Principal {
+	return &Principal{Roles: session.Roles}
+}
+
+// SessionStore keeps sessions until ttl runs out, Get returns ErrSessionNotFound for unknown or expired ids.
+type SessionStore interface {
+	Get(ctx context.Context, id string) (*Session, error)
+	Save(ctx context.Context, session *Session, ttl time.Duration) error
+	// Touch is Save for sessions that still exist, ErrSessionNotFound once they were deleted so logouts stay logged out.
+	Touch(ctx context.Context, session *Session, ttl time.Duration) error
+	Delete(ctx context.Context, id string) error
+}
+
+type SessionManager struct {
+	config SessionConfig
+	store  SessionStore
+}
+
+// Sessions returns the manager configured by Config.Sessions, set up by Init. It's nil without Config.Sessions.
+func (s *Service) Sessions() *SessionManager {
+	return s.sessions
+}
+
+// initSessions creates the manager once redis is set up, a store set with SetSessionStore is kept.
+func (s *Service) initSessions() {
+	if s.Config.Sessions == nil {
+		return
+	}
+	config := *s.Config.Sessions
+	if !StringLenGtZero(config.Secret) {
+		errTxt := "Sessions.Secret is required for sessions"
+		CheckFatal(errors.New(errTxt), errTxt)
+	}
+	if !StringLenGtZero(config.CookieName) {
+		config.CookieName = defaultSessionCookie
+	}
+	if !StringLenGtZero(config.CSRFHeader) {
+		config.CSRFHeader = defaultCSRFHeader
+	}
+	// Request.Header is keyed canonically, X-CSRF-Token arrives as X-Csrf-Token.
+	config.CSRFHeader = http.CanonicalHeaderKey(config.CSRFHeader)
+
+	store := s.sessionStore
+	if store == nil {
+		switch config.Store {
+		case MemorySessionStore:
+			store = NewMemorySessionStore()
+		case "", RedisSessionStore:
+			if s.RedisClient == nil {
+				errTxt := "Redis is required for the redis session store"
+				CheckFatal(errors.New(errTxt), errTxt)
+			}
+			store = NewRedisSessionStore(s.RedisClient)
+		default:
+			errTxt := fmt.Sprintf("unknown session store %s", config.Store)
+			CheckFatal(errors.New(errTxt), errTxt)
+		}
+	}
+	s.sessions = &SessionManager{config: config, store: store}
+}
+
+// SetSessionStore swaps the configured store for a custom one, call it from App.Init so Init builds the manager with it.
+func (s *Service) SetSessionStore(store SessionStore) {
+	s.sessionStore = store
+}
+
+func (manager *SessionManager) idleTTL() time.Duration {
+	if manager.config.IdleMinutes > 0 {
+		return time.Duration(manager.config.IdleMinutes) * time.Minute
+	}
+	return defaultSessionIdleTTL
+}
+
+func (manager *SessionManager) maxTTL() time.Duration {
+	if manager.config.MaxLifetimeMins > 0 {
+		return time.Duration(manager.config.MaxLifetimeMins) * time.Minute
+	}
+	return defaultSessionMaxTTL
+}
+
+// ttl is how long the store keeps session, idle time but never past its max lifetime.
+func (manager *SessionManager) ttl(session *Session, now time.Time) time.Duration {
+	ttl := manager.idleTTL()
+	if untilMax := session.CreatedAt.Add(manager.maxTTL()).Sub(now); untilMax < ttl {
+		ttl = untilMax
+	}
+	return ttl
+}
+
+// Login starts a session for userId and returns the cookie to set on the response.
+// Any session the request came with is destroyed so a planted session id can't be logged into(session fixation).
+func (manager *SessionManager) Login(req *Request, userId string, roles []string, data map[string]string) (*Session, *http.Cookie, error) {
+	if existing, err := manager.Load(req); err == nil {
+		if err := manager.store.Delete(req.Context(), existing.Id); err != nil {
+			return nil, nil, err
+		}
+	}
+	if data == nil {
+		data = map[string]string{}
+	}
+	now := time.Now().UTC()
+	session := &Session{UserId: userId, Roles: roles, Data: data, CreatedAt: now, LastSeenAt: now}
+	return manager.issue(req.Context(), session)
+}
+
+// Rotate gives session a new id and CSRF token, keeping its data. Use it when privileges change.
+func (manager *SessionManager) Rotate(req *Request, session *Session) (*Session, *http.Cookie, error) {
+	if err := manager.store.Delete(req.Context(), session.Id); err != nil {
+		return nil, nil, err
+	}
+	rotated := *session
+	return manager.issue(req.Context(), &rotated)
+}
+
+func (manager *SessionManager) issue(ctx context.Context, session *Session) (*Session, *http.Cookie, error) {
+	session.Id = RandomToken(sessionIdBytes)
+	session.CSRFToken = RandomToken(sessionIdBytes)
+	if err := manager.store.Save(ctx, session, manager.ttl(session, time.Now())); err != nil {
+		return nil, nil, err
+	}
+	return session, manager.cookie(SignValue(manager.config.Secret, session.Id), manager.maxTTL()), nil
+}
+
+// Logout destroys the request's session, the returned cookie clears it in the browser.
+func (manager *SessionManager) Logout(req *Request) (*http.Cookie, error) {
+	if session, err := manager.Load(req); err == nil {
+		if err := manager.store.Delete(req.Context(), session.Id); err != nil {
+			return nil, err
+		}
+	}
+	return manager.cookie("", -1), nil
+}
+
+// Load returns the request's session and extends it, ErrSessionNotFound when there's no valid one.
+func (manager *SessionManager) Load(req *Request) (*Session, error) {
+	cookie, err := req.Cookie(manager.config.CookieName)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	id, valid := VerifySignedValue(manager.config.Secret, cookie.Value)
+	if !valid {
+		return nil, ErrSessionNotFound
+	}
+
+	session, err := manager.store.Get(req.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if now.Sub(session.CreatedAt) >= manager.maxTTL() {
+		return nil, ErrSessionNotFound
+	}
+	// Sliding expiry, written at most once a minute so every request doesn't hit the store.
+	if now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		session.LastSeenAt = now
+		err := manager.store.Touch(req.Context(), session, manager.ttl(session, now))
+		if err == ErrSessionNotFound {
+			return nil, err
+		}
+		if err != nil {
+			req.Log().Error("extending session failed", "error", err)
+		}
+	}
+	return session, nil
+}
+
+// Save stores changes to session's Data or Roles.
+func (manager *SessionManager) Save(req *Request, session *Session) error {
+	return manager.store.Save(req.Context(), session, manager.ttl(session, time.Now()))
+}
+
+// VerifyCSRF checks the CSRF header against session on methods that change state.
+func (manager *SessionManager) VerifyCSRF(req *Request, session *Session) bool {
+	switch HttpMethod(req.Method) {
+	case GET, HEAD, OPTIONS:
+		return true
+	}
+	token := req.GetHeaderVal(manager.config.CSRFHeader)
+	return token != nil && subtle.ConstantTimeCompare([]byte(*token), []byte(session.CSRFToken)) == 1
+}
+
+// cookie with maxAge < 0 deletes it.
+func (manager *SessionManager) cookie(value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     manager.config.CookieName,
+		Value:    value,
+		Path:     "/",
+		Domain:   manager.config.CookieDomain,
+		HttpOnly: true,
+		Secure:   !manager.config.Insecure,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if manager.config.SameSite == "strict" {
+		cookie.SameSite = http.SameSiteStrictMode
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+type SessionValidator struct {
+	manager *SessionManager
+}
+
+// NewSessionValidator authenticates the session cookie, Auth.Payload is the *Session.
+// Unsafe methods also need the session's CSRF token, they're answered with 403 without it.
+func NewSessionValidator() AuthValidatorCallback {
+	return func(service *Service) AuthValidator {
+		return &SessionValidator{manager: service.Sessions()}
+	}
+}
+
+func (v *SessionValidator) SecurityScheme() (string, SecurityScheme) {
+	cookieName := defaultSessionCookie
+	if v.manager != nil {
+		cookieName = v.manager.config.CookieName
+	}
+	return "session", SecurityScheme{Type: "apiKey", In: "cookie", Name: cookieName}
+}
+
+func (v *SessionValidator) Validate(req *Request) Auth {
+	if v.manager == nil {
+		req.Log().Error("session validator used without Config.Sessions")
+		return Auth{Reason: "sessions aren't configured"}
+	}
+	if _, err := req.Cookie(v.manager.config.CookieName); err != nil {
+		return Auth{}
+	}
+	session, err := v.manager.Load(req)
+	if errors.Is(err, ErrSessionNotFound) {
+		return Auth{Reason: sessionExpiredReason}
+	}
+	if err != nil {
+		req.Log().Error("session lookup failed", "error", err)
+		return Auth{}
+	}
+	if !v.manager.VerifyCSRF(req, session) {
+		return Auth{UserId: session.UserId, Forbidden: true, Reason: csrfFailedReason}
+	}
+	return Auth{IsAuthenticated: true, UserId: session.UserId, Payload: session}
+}
+
+type memorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+}
+
+type memorySession struct {
+	session   Session
+	expiresAt time.Time
+}
+
+// NewMemorySessionStore keeps sessions in process, for tests and single instance development.
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: make(map[string]memorySession)}
+}
+
+func (store *memorySessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	stored, found := store.sessions[id]
+	if !found || time.Now().After(stored.expiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	session := stored.session
+	return &session, nil
+}
+
+func (store *memorySessionStore) Save(ctx context.Context, session *Session, ttl time.Duration) error {
+	now := time.Now()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if now.Sub(store.lastSweep) > limiterSweepInterval {
+		store.lastSweep = now
+		for id, stored := range store.sessions {
+			if now.After(stored.expiresAt) {
+				delete(store.sessions, id)
+			}
+		}
+	}
+	store.sessions[session.Id] = memorySession{session: *session, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (store *memorySessionStore) Touch(ctx context.Context, session *Session, ttl time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	stored, found := store.sessions[session.Id]
+	if !found || time.Now().After(stored.expiresAt) {
+		return ErrSessionNotFound
+	}
+	store.sessions[session.Id] = memorySession{session: *session, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (store *memorySessionStore) Delete(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.sessions, id)
+	return nil
+}
+
+// redisSessionStore keeps each session as JSON under session:<id>, expiring with the session.
+type redisSessionStore struct {
+	client *redis.Client
+}
+
+func NewRedisSessionStore(client *redis.Client) SessionStore {
+	return &redisSessionStore{client: client}
+}
+
+func redisSessionKey(id string) string {
+	return "session:" + id
+}
+
+func (store *redisSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	data, err := store.client.WithContext(ctx).Get(redisSessionKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	return session, json.Unmarshal(data, session)
+}
+
+func (store *redisSessionStore) Save(ctx context.Context, session *Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return store.client.WithContext(ctx).Set(redisSessionKey(session.Id), data, ttl).Err()
+}
+
+func (store *redisSessionStore) Touch(ctx context.Context, session *Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	updated, err := store.client.WithContext(ctx).SetXX(redisSessionKey(session.Id), data, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (store *redisSessionStore) Delete(ctx context.Context, id string) error {
+	return store.client.WithContext(ctx).Del(redisSessionKey(id)).Err()
+}
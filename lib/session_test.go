@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type SessionApp struct {
+	MockApp
+}
+
+func (app *SessionApp) Title() string {
+	return "admin"
+}
+
+func (app *SessionApp) Routes() []HttpAction {
+	handler := func(r *Request) *Response { return SuccessResponse(r.UserId) }
+	sessions := []AuthValidatorCallback{NewSessionValidator()}
+	return []HttpAction{
+		{Action: "me", Handler: handler, AuthValidators: sessions},
+		{Action: "update", Method: POST, Handler: handler, AuthValidators: sessions},
+		{Action: "settings", Handler: handler, Roles: []string{"admin"}, AuthValidators: sessions},
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := NewService(&Config{Sessions: &SessionConfig{Secret: "secret", Store: MemorySessionStore}}, &[]App{&SessionApp{}})
+	s.initSessions()
+	manager := s.Sessions()
+
+	withCookie := func(cookie *http.Cookie) *Request {
+		return &Request{Header: http.Header{"Cookie": {cookie.String()}}}
+	}
+
+	session, cookie, err := manager.Login(&Request{Header: http.Header{}}, "user-1", []string{"admin"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.Value == session.Id || !strings.HasPrefix(cookie.Value, session.Id+".") {
+		t.Fatalf("unexpected cookie %+v", cookie)
+	}
+	viewer, viewerCookie, _ := manager.Login(&Request{Header: http.Header{}}, "user-2", nil, nil)
+
+	type input struct {
+		title     string
+		method    string
+		path      string
+		header    http.Header
+		expStatus int16
+		expBody   string
+	}
+
+	inputs := []input{
+		{title: "Session", method: "GET", path: "/admin/me", header: http.Header{"Cookie": {cookie.String()}}, expStatus: 200, expBody: "user-1"},
+		{title: "Unsafe method with csrf token", method: "POST", path: "/admin/update", header: http.Header{"Cookie": {cookie.String()}, "X-Csrf-Token": {session.CSRFToken}}, expStatus: 200},
+		{title: "Unsafe method without csrf token", method: "POST", path: "/admin/update", header: http.Header{"Cookie": {cookie.String()}}, expStatus: 403, expBody: csrfFailedReason},
+		{title: "Csrf token of another session", method: "POST", path: "/admin/update", header: http.Header{"Cookie": {cookie.String()}, "X-Csrf-Token": {viewer.CSRFToken}}, expStatus: 403},
+		{title: "Session roles", method: "GET", path: "/admin/settings", header: http.Header{"Cookie": {cookie.String()}}, expStatus: 200},
+		{title: "Missing role", method: "GET", path: "/admin/settings", header: http.Header{"Cookie": {viewerCookie.String()}}, expStatus: 403},
+		{title: "Tampered cookie", method: "GET", path: "/admin/me", header: http.Header{"Cookie": {defaultSessionCookie + "=" + viewer.Id + "." + strings.Split(cookie.Value, ".")[1]}}, expStatus: 401, expBody: sessionExpiredReason},
+		{title: "No cookie", method: "GET", path: "/admin/me", header: http.Header{}, expStatus: 401},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{Method: input.method, URL: &url.URL{Path: input.path}, Header: input.header})
+			if w.statusCode != input.expStatus {
+				t.Fatalf("expected %d got %d %s", input.expStatus, w.statusCode, w.dataWritten)
+			}
+			if !strings.Contains(w.dataWritten, input.expBody) {
+				t.Errorf("expected %s in %s", input.expBody, w.dataWritten)
+			}
+		})
+	}
+
+	t.Run("Sliding expiry", func(t *testing.T) {
+		stale := *session
+		stale.LastSeenAt = time.Now().Add(-2 * time.Minute)
+		manager.store.Save(context.Background(), &stale, time.Second)
+
+		if _, err := manager.Load(withCookie(cookie)); err != nil {
+			t.Fatal(err)
+		}
+		stored := manager.store.(*memorySessionStore).sessions[session.Id]
+		if time.Until(stored.expiresAt) < 29*time.Minute {
+			t.Errorf("expected expiry to be extended to the idle timeout, expires in %s", time.Until(stored.expiresAt))
+		}
+	})
+
+	t.Run("Sliding expiry doesn't bring back deleted sessions", func(t *testing.T) {
+		gone, goneCookie, _ := manager.Login(&Request{Header: http.Header{}}, "user-4", nil, nil)
+		gone.LastSeenAt = time.Now().Add(-2 * time.Minute)
+		manager.store.Save(context.Background(), gone, time.Minute)
+
+		// Load read the session just before a concurrent logout deleted it.
+		loaded, _ := manager.store.Get(context.Background(), gone.Id)
+		manager.store.Delete(context.Background(), gone.Id)
+		if err := manager.store.Touch(context.Background(), loaded, time.Minute); err != ErrSessionNotFound {
+			t.Errorf("expected touch of a deleted session to fail got %v", err)
+		}
+		if _, err := manager.Load(withCookie(goneCookie)); err != ErrSessionNotFound {
+			t.Errorf("expected deleted session to stay deleted got %v", err)
+		}
+	})
+
+	t.Run("Max lifetime", func(t *testing.T) {
+		old, oldCookie, _ := manager.Login(&Request{Header: http.Header{}}, "user-3", nil, nil)
+		old.CreatedAt = time.Now().Add(-13 * time.Hour)
+		manager.store.Save(context.Background(), old, time.Minute)
+		if _, err := manager.Load(withCookie(oldCookie)); err != ErrSessionNotFound {
+			t.Errorf("expected session past its max lifetime to be gone got %v", err)
+		}
+	})
+
+	t.Run("Login rotates the id", func(t *testing.T) {
+		rotated, rotatedCookie, err := manager.Login(withCookie(viewerCookie), "user-2", []string{"admin"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rotated.Id == viewer.Id || rotated.CSRFToken == viewer.CSRFToken {
+			t.Fatal("expected a new id and csrf token")
+		}
+		if _, err := manager.Load(withCookie(viewerCookie)); err != ErrSessionNotFound {
+			t.Errorf("expected the old session to be destroyed got %v", err)
+		}
+		if loaded, err := manager.Load(withCookie(rotatedCookie)); err != nil || loaded.UserId != "user-2" {
+			t.Errorf("expected rotated session got %+v %v", loaded, err)
+		}
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		cleared, err := manager.Logout(withCookie(cookie))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cleared.MaxAge != -1 {
+			t.Errorf("expected cookie to be cleared got %+v", cleared)
+		}
+		if _, err := manager.Load(withCookie(cookie)); err != ErrSessionNotFound {
+			t.Errorf("expected session to be destroyed got %v", err)
+		}
+	})
+}
+
+func TestSessionValidatorWithoutConfig(t *testing.T) {
+	s := NewService(&Config{}, &[]App{&SessionApp{}})
+	s.initSessions()
+	w := &MockResponseWriter{}
+	s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: "/admin/me"}, Header: http.Header{"Cookie": {"session=abc.def"}}})
+	if s.Sessions() != nil || w.statusCode != 401 {
+		t.Errorf("expected sessions to stay off and the request refused got %d %s", w.statusCode, w.dataWritten)
+	}
+}
@@ -0,0 +1,328 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	defaultSignatureHeader          = "X-Signature"
+	defaultSignatureKeyIdHeader     = "X-Signature-Key-Id"
+	defaultSignatureTimestampHeader = "X-Signature-Timestamp"
+	defaultSignatureNonceHeader     = "X-Signature-Nonce"
+	defaultSignatureTolerance       = 5 * time.Minute
+	maxSignedBodyBytes              = 10 << 20
+)
+
+type SignatureConfig struct {
+	Secrets          map[string]string `json:"Secrets"`          // Key id to shared secret, the key id becomes Auth.UserId
+	Header           string            `json:"Header"`           // Defaults to X-Signature
+	KeyIdHeader      string            `json:"KeyIdHeader"`      // Defaults to X-Signature-Key-Id, every secret is tried when it's missing
+	TimestampHeader  string            `json:"TimestampHeader"`  // Unix seconds, defaults to X-Signature-Timestamp
+	NonceHeader      string            `json:"NonceHeader"`      // Defaults to X-Signature-Nonce, the signature doubles as nonce when it's missing
+	Encoding         string            `json:"Encoding"`         // hex(default) or base64
+	Prefix           string            `json:"Prefix"`           // Before the encoded signature, e.g. sha256=
+	ToleranceSeconds int               `json:"ToleranceSeconds"` // Max clock difference, defaults to 300
+}
+
+// SignedRequest is the Auth.Payload set by SignatureValidator.
+type SignedRequest struct {
+	KeyId     string
+	Timestamp time.Time
+	Nonce     string
+}
+
+func (config *SignatureConfig) withDefaults() *SignatureConfig {
+	withDefaults := SignatureConfig{}
+	if config != nil {
+		withDefaults = *config
+	}
+	defaults := []struct {
+		value    *string
+		fallback string
+	}{
+		{&withDefaults.Header, defaultSignatureHeader},
+		{&withDefaults.KeyIdHeader, defaultSignatureKeyIdHeader},
+		{&withDefaults.TimestampHeader, defaultSignatureTimestampHeader},
+		{&withDefaults.NonceHeader, defaultSignatureNonceHeader},
+		{&withDefaults.Encoding, "hex"},
+	}
+	for _, field := range defaults {
+		if !StringLenGtZero(*field.value) {
+			*field.value = field.fallback
+		}
+	}
+	return &withDefaults
+}
+
+func (config *SignatureConfig) validate() error {
+	if config == nil || len(config.Secrets) == 0 {
+		return errors.New("Signature config with secrets is required for SignatureValidator")
+	}
+	for keyId, secret := range config.Secrets {
+		if !StringLenGtZero(secret) {
+			return fmt.Errorf("Signature secret for %s is empty", keyId)
+		}
+	}
+	if encoding := config.withDefaults().Encoding; encoding != "hex" && encoding != "base64" {
+		return fmt.Errorf("unknown signature encoding %s", encoding)
+	}
+	return nil
+}
+
+func (config *SignatureConfig) tolerance() time.Duration {
+	if config.ToleranceSeconds > 0 {
+		return time.Duration(config.ToleranceSeconds) * time.Second
+	}
+	return defaultSignatureTolerance
+}
+
+// sign is HMAC-SHA256 over method, request uri, timestamp, nonce and hex SHA-256 of body, one per line.
+func (config *SignatureConfig) sign(secret string, method string, requestURI string, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{strings.ToUpper(method), requestURI, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")))
+	if config.Encoding == "base64" {
+		return config.Prefix + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return config.Prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+type SignatureValidator struct {
+	config    *SignatureConfig
+	nonces    *nonceCache
+	configErr error // Every request is refused when the config is unusable
+}
+
+// NewSignatureValidator verifies HMAC signed requests(webhooks, service to service), config nil uses Config.Signature.
+// Each signature is accepted once within the timestamp tolerance, nonces are kept in redis when configured.
+func NewSignatureValidator(config *SignatureConfig) AuthValidatorCallback {
+	var mu sync.Mutex
+	validators := make(map[*Service]*SignatureValidator)
+	return func(service *Service) AuthValidator {
+		mu.Lock()
+		defer mu.Unlock()
+		validator, found := validators[service]
+		if !found {
+			validator = service.newSignatureValidator(config)
+			validators[service] = validator
+		}
+		return validator
+	}
+}
+
+func (s *Service) newSignatureValidator(config *SignatureConfig) *SignatureValidator {
+	if config == nil {
+		config = s.Config.Signature
+	}
+	validator := &SignatureValidator{config: config.withDefaults(), nonces: s.nonceCache(), configErr: config.validate()}
+	if validator.configErr != nil {
+		s.Logger.Error("signature validator refuses every request", "error", validator.configErr)
+	}
+	return validator
+}
+
+// initSignature fails at boot on an unusable Config.Signature instead of on the first signed request.
+func (s *Service) initSignature() {
+	if s.Config.Signature == nil {
+		return
+	}
+	if err := s.Config.Signature.validate(); err != nil {
+		CheckFatal(err, err.Error())
+	}
+}
+
+func (v *SignatureValidator) SecurityScheme() (string, SecurityScheme) {
+	description := fmt.Sprintf("HMAC-SHA256 of method, path, %s, %s and SHA-256 of body", v.config.TimestampHeader, v.config.NonceHeader)
+	return "hmacSignature", SecurityScheme{Type: "apiKey", In: "header", Name: v.config.Header, Description: description}
+}
+
+func (v *SignatureValidator) Validate(req *Request) Auth {
+	if v.configErr != nil {
+		return Auth{Reason: "signature validation isn't configured"}
+	}
+	signature := req.GetHeaderVal(v.config.Header)
+	if signature == nil {
+		return Auth{}
+	}
+
+	timestampVal := req.GetHeaderVal(v.config.TimestampHeader)
+	if timestampVal == nil {
+		return Auth{Reason: "missing signature timestamp"}
+	}
+	unix, err := strconv.ParseInt(*timestampVal, 10, 64)
+	if err != nil {
+		return Auth{Reason: "invalid signature timestamp"}
+	}
+	timestamp := time.Unix(unix, 0)
+	if drift := time.Since(timestamp); drift > v.config.tolerance() || drift < -v.config.tolerance() {
+		return Auth{Reason: "signature timestamp out of tolerance"}
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		req.Log().Info("reading signed body failed", "error", err)
+		return Auth{Reason: "unreadable body"}
+	}
+
+	nonce := ""
+	if val := req.GetHeaderVal(v.config.NonceHeader); val != nil {
+		nonce = *val
+	}
+	requestURI := req.Path
+	if req.httpReq != nil && req.httpReq.URL != nil {
+		requestURI = req.httpReq.URL.RequestURI()
+	}
+
+	keyIds := []string{}
+	if val := req.GetHeaderVal(v.config.KeyIdHeader); val != nil {
+		keyIds = append(keyIds, *val)
+	} else {
+		for keyId := range v.config.Secrets {
+			keyIds = append(keyIds, keyId)
+		}
+		sort.Strings(keyIds)
+	}
+
+	for _, keyId := range keyIds {
+		secret, found := v.config.Secrets[keyId]
+		if !found {
+			continue
+		}
+		expected := v.config.sign(secret, req.Method, requestURI, *timestampVal, nonce, body)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(*signature)) != 1 {
+			continue
+		}
+
+		replayKey := nonce
+		if !StringLenGtZero(replayKey) {
+			replayKey = *signature
+		}
+		// Entries outlive the window in which the timestamp is accepted, so an old request can't come back.
+		if v.nonces.seen(req.Context(), keyId+":"+replayKey, 2*v.config.tolerance()) {
+			req.Log().Info("replayed signature", "key_id", keyId)
+			return Auth{Reason: "request was already received"}
+		}
+		return Auth{
+			IsAuthenticated: true,
+			UserId:          keyId,
+			Payload:         &SignedRequest{KeyId: keyId, Timestamp: timestamp, Nonce: nonce},
+		}
+	}
+	return Auth{Reason: "invalid signature"}
+}
+
+// readBody reads the whole body and puts it back so handlers can decode it afterwards.
+func readBody(req *Request) ([]byte, error) {
+	if req.Body == nil {
+		return []byte{}, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSignedBodyBytes+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignedBodyBytes {
+		return nil, fmt.Errorf("body over %d bytes", maxSignedBodyBytes)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// RequestSigner signs outgoing requests so a SignatureValidator with the same config and secret accepts them.
+type RequestSigner struct {
+	config *SignatureConfig
+	keyId  string
+	secret string
+}
+
+func NewRequestSigner(config *SignatureConfig, keyId string, secret string) *RequestSigner {
+	return &RequestSigner{config: config.withDefaults(), keyId: keyId, secret: secret}
+}
+
+// Sign sets signature headers on httpReq, call it once the URL and body are final.
+func (signer *RequestSigner) Sign(httpReq *http.Request) error {
+	body := []byte{}
+	if httpReq.Body != nil {
+		var err error
+		if body, err = io.ReadAll(httpReq.Body); err != nil {
+			return err
+		}
+		httpReq.Body.Close()
+		httpReq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := RandomToken(16)
+	httpReq.Header.Set(signer.config.KeyIdHeader, signer.keyId)
+	httpReq.Header.Set(signer.config.TimestampHeader, timestamp)
+	httpReq.Header.Set(signer.config.NonceHeader, nonce)
+	httpReq.Header.Set(signer.config.Header, signer.config.sign(signer.secret, httpReq.Method, httpReq.URL.RequestURI(), timestamp, nonce, body))
+	return nil
+}
+
+// PlaceGetReq is lib.PlaceGetReq with a signature instead of an Authorization token.
+func (signer *RequestSigner) PlaceGetReq(req *Request, url string, params map[string]string) (*[]byte, error) {
+	return placeGetReq(req, url, params, signer.Sign)
+}
+
+// nonceCache remembers keys for a while, in redis so every replica sees them or in memory without redis.
+type nonceCache struct {
+	redisClient *redis.Client
+
+	mu        sync.Mutex
+	seenUntil map[string]time.Time
+	lastSweep time.Time
+}
+
+func (s *Service) nonceCache() *nonceCache {
+	s.noncesOnce.Do(func() {
+		s.nonces = &nonceCache{redisClient: s.RedisClient, seenUntil: make(map[string]time.Time)}
+	})
+	return s.nonces
+}
+
+// seen records key and reports whether it was already there.
+func (cache *nonceCache) seen(ctx context.Context, key string, ttl time.Duration) bool {
+	if cache.redisClient != nil {
+		added, err := cache.redisClient.WithContext(ctx).SetNX("nonce:"+key, 1, ttl).Result()
+		if err == nil {
+			return !added
+		}
+		// Falling back keeps requests flowing, replays across replicas are possible until redis is back.
+		CaptureSentryException(fmt.Sprintf("nonce cache redis failed, using memory: %s", err))
+	}
+
+	now := time.Now()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if now.Sub(cache.lastSweep) > limiterSweepInterval {
+		cache.lastSweep = now
+		for seenKey, until := range cache.seenUntil {
+			if now.After(until) {
+				delete(cache.seenUntil, seenKey)
+			}
+		}
+	}
+	if until, found := cache.seenUntil[key]; found && now.Before(until) {
+		return true
+	}
+	cache.seenUntil[key] = now.Add(ttl)
+	return false
+}
@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type SignatureApp struct {
+	MockApp
+}
+
+func (app *SignatureApp) Title() string {
+	return "signed"
+}
+
+func (app *SignatureApp) Routes() []HttpAction {
+	handler := func(r *Request) *Response {
+		body, _ := io.ReadAll(r.Body)
+		return SuccessResponse(r.UserId + ":" + string(body))
+	}
+	return []HttpAction{
+		{Action: "hook", Method: POST, Handler: handler, AuthValidators: []AuthValidatorCallback{NewSignatureValidator(nil)}},
+		{Action: "get", Handler: handler, AuthValidators: []AuthValidatorCallback{NewSignatureValidator(nil)}},
+	}
+}
+
+func TestSignatureValidator(t *testing.T) {
+	config := &SignatureConfig{Secrets: map[string]string{"current": "secret-1", "previous": "secret-0"}, Prefix: "sha256="}
+	s := NewService(&Config{Signature: config}, &[]App{&SignatureApp{}})
+
+	signed := func(signer *RequestSigner, body string) *http.Request {
+		httpReq := httptest.NewRequest("POST", "/signed/hook?event=push", strings.NewReader(body))
+		if err := signer.Sign(httpReq); err != nil {
+			t.Fatal(err)
+		}
+		return httpReq
+	}
+	current := NewRequestSigner(config, "current", "secret-1")
+
+	type input struct {
+		title     string
+		req       func() *http.Request
+		expStatus int16
+		expBody   string
+	}
+
+	inputs := []input{
+		{title: "Valid", req: func() *http.Request { return signed(current, `{"a":1}`) }, expStatus: 200, expBody: `current:{"a":1}`},
+		{title: "Rotated key", req: func() *http.Request { return signed(NewRequestSigner(config, "previous", "secret-0"), "x") }, expStatus: 200, expBody: "previous:x"},
+		{title: "Without key id", req: func() *http.Request {
+			httpReq := signed(NewRequestSigner(config, "previous", "secret-0"), "x")
+			httpReq.Header.Del(defaultSignatureKeyIdHeader)
+			return httpReq
+		}, expStatus: 200, expBody: "previous:x"},
+		{title: "Tampered body", req: func() *http.Request {
+			httpReq := signed(current, "x")
+			httpReq.Body = io.NopCloser(bytes.NewReader([]byte("y")))
+			return httpReq
+		}, expStatus: 401, expBody: "invalid signature"},
+		{title: "Tampered path", req: func() *http.Request {
+			httpReq := signed(current, "x")
+			httpReq.URL.RawQuery = "event=delete"
+			return httpReq
+		}, expStatus: 401, expBody: "invalid signature"},
+		{title: "Wrong secret", req: func() *http.Request { return signed(NewRequestSigner(config, "current", "nope"), "x") }, expStatus: 401, expBody: "invalid signature"},
+		{title: "Unknown key id", req: func() *http.Request { return signed(NewRequestSigner(config, "other", "secret-1"), "x") }, expStatus: 401, expBody: "invalid signature"},
+		{title: "Stale timestamp", req: func() *http.Request {
+			httpReq := signed(current, "x")
+			httpReq.Header.Set(defaultSignatureTimestampHeader, strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10))
+			return httpReq
+		}, expStatus: 401, expBody: "out of tolerance"},
+		{title: "Missing timestamp", req: func() *http.Request {
+			httpReq := signed(current, "x")
+			httpReq.Header.Del(defaultSignatureTimestampHeader)
+			return httpReq
+		}, expStatus: 401, expBody: "missing signature timestamp"},
+		{title: "Unsigned", req: func() *http.Request { return httptest.NewRequest("POST", "/signed/hook", nil) }, expStatus: 401},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, input.req())
+			if w.statusCode != input.expStatus {
+				t.Fatalf("expected %d got %d %s", input.expStatus, w.statusCode, w.dataWritten)
+			}
+			if !strings.Contains(w.dataWritten, input.expBody) {
+				t.Errorf("expected %s in %s", input.expBody, w.dataWritten)
+			}
+		})
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		httpReq := signed(current, "once")
+		statuses := []int16{}
+		for i := 0; i < 2; i++ {
+			replayed := httpReq.Clone(httpReq.Context())
+			replayed.Body = io.NopCloser(strings.NewReader("once"))
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, replayed)
+			statuses = append(statuses, w.statusCode)
+		}
+		if statuses[0] != 200 || statuses[1] != 401 {
+			t.Errorf("expected 200 then 401 got %v", statuses)
+		}
+	})
+}
+
+func TestSignatureValidatorPerService(t *testing.T) {
+	callback := NewSignatureValidator(nil)
+	first := NewService(&Config{Signature: &SignatureConfig{Secrets: map[string]string{"first": "secret-1"}}}, &[]App{})
+	second := NewService(&Config{Signature: &SignatureConfig{Secrets: map[string]string{"second": "secret-2"}}}, &[]App{})
+
+	httpReq := httptest.NewRequest("POST", "/signed/hook", strings.NewReader("x"))
+	NewRequestSigner(second.Config.Signature, "second", "secret-2").Sign(httpReq)
+	callback(first)
+	if auth := callback(second).Validate(&Request{Header: httpReq.Header, Body: httpReq.Body, Method: "POST", Path: "/signed/hook", httpReq: httpReq}); auth.UserId != "second" {
+		t.Errorf("expected second service to use its own secrets got %+v", auth)
+	}
+	if callback(first) != callback(first) {
+		t.Error("expected the validator to be built once per service")
+	}
+}
+
+func TestSignatureConfig(t *testing.T) {
+	inputs := map[string]struct {
+		config *SignatureConfig
+		expErr bool
+	}{
+		"Missing":          {config: nil, expErr: true},
+		"No secrets":       {config: &SignatureConfig{}, expErr: true},
+		"Empty secret":     {config: &SignatureConfig{Secrets: map[string]string{"current": ""}}, expErr: true},
+		"Unknown encoding": {config: &SignatureConfig{Secrets: map[string]string{"current": "s"}, Encoding: "base32"}, expErr: true},
+		"Valid":            {config: &SignatureConfig{Secrets: map[string]string{"current": "s"}, Encoding: "base64"}},
+	}
+	for title, input := range inputs {
+		t.Run(title, func(t *testing.T) {
+			if err := input.config.validate(); (err != nil) != input.expErr {
+				t.Errorf("expected error %t got %v", input.expErr, err)
+			}
+		})
+	}
+
+	t.Run("Validator without secrets refuses requests", func(t *testing.T) {
+		s := NewService(&Config{}, &[]App{})
+		if auth := NewSignatureValidator(nil)(s).Validate(&Request{Header: http.Header{}}); auth.IsAuthenticated || auth.Reason == "" {
+			t.Errorf("expected request to be refused got %+v", auth)
+		}
+	})
+}
+
+func TestRequestSignerPlaceGetReq(t *testing.T) {
+	config := &SignatureConfig{Secrets: map[string]string{"caller": "shared"}, Encoding: "base64"}
+	s := NewService(&Config{Signature: config}, &[]App{&SignatureApp{}})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	req := &Request{ID: "test"}
+	body, err := NewRequestSigner(config, "caller", "shared").PlaceGetReq(req, server.URL+"/signed/get", map[string]string{"q": "a b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(*body), "caller:") {
+		t.Errorf("expected caller in %s", *body)
+	}
+
+	if _, err := NewRequestSigner(config, "caller", "wrong").PlaceGetReq(req, server.URL+"/signed/get", nil); err == nil {
+		t.Error("expected a wrong secret to fail")
+	}
+}
@@ -3,7 +3,7 @@ package lib
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"sync"
 	"time"
@@ -35,6 +35,7 @@ type ISqsManager interface {
 
 type SqsManager struct {
 	sqsConnectoin ISqsConnection
+	logger        *slog.Logger
 }
 
 type ISqsConnection interface {
@@ -112,6 +113,7 @@ func NewSqsManager(env string) (*SqsManager, error) {
 
 	sqsManager := SqsManager{
 		sqsConnectoin: connection,
+		logger:        slog.Default().With("component", "sqs"),
 	}
 
 	return &sqsManager, nil
@@ -122,10 +124,9 @@ func (sqsManager *SqsManager) getQueueURL(queueName string) (string, error) {
 }
 
 func (sqsManager *SqsManager) PublishToSQS(queueName string, messageBody string, requestId string) (string, error) {
-	log.Printf("DEBUG:%s Message body received in PublishSQS with request ID %s", messageBody, requestId)
-	log.Printf("DEBUG:%s QueueName with request ID %s", queueName, requestId)
+	logger := sqsManager.logger.With("request_id", requestId, "queue", queueName)
 	urlRes, _ := sqsManager.getQueueURL(queueName)
-	log.Printf("DEBUG: %s QueueURL with request ID %s", urlRes, requestId)
+	logger.Debug("publishing message", "queue_url", urlRes, "body_size", len(messageBody))
 	sqsClient := sqs.New(sqsManager.sqsConnectoin.GetSession())
 
 	resp, e := sqsClient.SendMessage(&sqs.SendMessageInput{
@@ -133,10 +134,10 @@ func (sqsManager *SqsManager) PublishToSQS(queueName string, messageBody string,
 		MessageBody: aws.String(messageBody),
 	})
 	if e != nil {
-		log.Printf("%s Got an error while trying to send message to queue: %v", requestId, e)
+		logger.Error("failed to send message to queue", "error", e)
 		return "", e
 	}
-	log.Printf("INFO: Message sent successfully with request ID %s", requestId)
+	logger.Info("message sent successfully", "message_id", *resp.MessageId)
 	return *resp.MessageId, nil
 }
 
@@ -153,7 +154,7 @@ func (sqsManager *SqsManager) HandleQueue(queueName *string, handler func(string
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		log.Printf("Successfully initiated queue %s", *queueName)
+		sqsManager.logger.Info("successfully initiated queue", "queue", *queueName)
 		wg.Done()
 		for { // create an infinite processing loop
 			requestId := GenerateRandomUUID()
@@ -194,7 +195,7 @@ func (sqsManager *SqsManager) HandleQueue(queueName *string, handler func(string
 
 						if _, works := handlerErr.(AllowMessageDeleteError); handlerErr != nil && !works {
 							CaptureSentryException(fmt.Sprintf("%s Failed to process message on queue(%s) with error %s", requestId, *queueName, handlerErr.Error()))
-							log.Printf("%s Skipping message delete", requestId)
+							sqsManager.logger.Warn("skipping message delete", "request_id", requestId, "queue", *queueName)
 							return
 						}
 
@@ -204,7 +205,7 @@ func (sqsManager *SqsManager) HandleQueue(queueName *string, handler func(string
 						})
 
 						if deleteErr != nil {
-							log.Printf("Error: DeleteMessage error %s for queue(%s) with request ID %s", err, *queueName, requestId)
+							sqsManager.logger.Error("failed to delete message", "error", deleteErr, "request_id", requestId, "queue", *queueName)
 						}
 
 						cleanup(requestId)
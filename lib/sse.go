@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSSEHeartbeat = 15 * time.Second
+
+// ErrInvalidEvent is returned by Send when ID or Event contain a line break, which would end the field early.
+var ErrInvalidEvent = errors.New("event id and name can't contain line breaks")
+
+// sseLineBreaks turns every line break the EventSource parser accepts into \n.
+var sseLineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// SSEHandler keeps the connection open until it returns or the client goes away(stream.Context() is done).
+type SSEHandler func(req *Request, stream *EventStream) error
+
+// Event is a single server sent event, Data is sent as is when it's a string and JSON encoded otherwise.
+type Event struct {
+	ID    string
+	Event string
+	Data  any
+	Retry time.Duration
+}
+
+// EventStream is safe for concurrent use, heartbeats are sent in the background.
+type EventStream struct {
+	ctx         context.Context
+	lastEventID string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Context is cancelled as soon as the client disconnects.
+func (stream *EventStream) Context() context.Context {
+	return stream.ctx
+}
+
+// LastEventID is the ID client last saw before reconnecting, empty on first connect.
+func (stream *EventStream) LastEventID() string {
+	return stream.lastEventID
+}
+
+func (stream *EventStream) Send(event Event) error {
+	if err := stream.ctx.Err(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(event.ID, "\r\n") || strings.ContainsAny(event.Event, "\r\n") {
+		return ErrInvalidEvent
+	}
+
+	var msg strings.Builder
+	if StringLenGtZero(event.ID) {
+		fmt.Fprintf(&msg, "id: %s\n", event.ID)
+	}
+	if StringLenGtZero(event.Event) {
+		fmt.Fprintf(&msg, "event: %s\n", event.Event)
+	}
+	if event.Retry > 0 {
+		fmt.Fprintf(&msg, "retry: %d\n", event.Retry.Milliseconds())
+	}
+
+	data, isStr := event.Data.(string)
+	if !isStr && event.Data != nil {
+		dataBytes, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		data = string(dataBytes)
+	}
+	for _, line := range strings.Split(sseLineBreaks.Replace(data), "\n") {
+		fmt.Fprintf(&msg, "data: %s\n", line)
+	}
+	msg.WriteString("\n")
+
+	return stream.write(msg.String())
+}
+
+// SetRetry tells the browser how long to wait before reconnecting.
+func (stream *EventStream) SetRetry(retry time.Duration) error {
+	return stream.write(fmt.Sprintf("retry: %d\n\n", retry.Milliseconds()))
+}
+
+func (stream *EventStream) heartbeat() error {
+	return stream.write(": heartbeat\n\n")
+}
+
+func (stream *EventStream) write(msg string) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	_, err := io.WriteString(stream.w, msg)
+	return err
+}
+
+// eventStreamResponse wraps handler in a streamed response so auth, routing and access logs work like any other route.
+func (s *Service) eventStreamResponse(req *Request, handler SSEHandler) *Response {
+	heartbeatInterval := defaultSSEHeartbeat
+	if s.Config.SSEHeartbeatSeconds > 0 {
+		heartbeatInterval = time.Duration(s.Config.SSEHeartbeatSeconds) * time.Second
+	}
+
+	lastEventID := ""
+	if val := req.GetHeaderVal("Last-Event-Id"); val != nil {
+		lastEventID = *val
+	}
+
+	resp := StreamResponse("text/event-stream", func(w io.Writer) error {
+		// HEAD is routed to GET, answer it with the headers instead of holding it open.
+		if req.Method == string(HEAD) {
+			return nil
+		}
+
+		ctx, cancel := context.WithCancel(req.Context())
+		// Heartbeats must stop before the handler returns, writes after that are invalid.
+		var heartbeats sync.WaitGroup
+		defer heartbeats.Wait()
+		defer cancel()
+
+		stream := &EventStream{
+			ctx:         ctx,
+			lastEventID: lastEventID,
+			w:           w,
+		}
+
+		heartbeats.Add(1)
+		go func() {
+			defer heartbeats.Done()
+			ticker := time.NewTicker(heartbeatInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := stream.heartbeat(); err != nil {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+
+		// Headers have to reach the client before the first event.
+		if err := stream.write(": connected\n\n"); err != nil {
+			return nil
+		}
+
+		if err := handler(req, stream); err != nil && ctx.Err() == nil {
+			req.Log().Error("event stream handler failed", "error", err)
+		}
+		return nil
+	})
+
+	resp.SetHeader("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	resp.SetHeader("X-Accel-Buffering", "no")
+
+	return resp
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type SSEApp struct {
+}
+
+func (sApp *SSEApp) Title() string {
+	return "sse-app"
+}
+
+func (sApp *SSEApp) Init(s *Service) {
+}
+
+func (sApp *SSEApp) Routes() []HttpAction {
+	return []HttpAction{
+		{
+			Action: "progress",
+			SSEHandler: func(req *Request, stream *EventStream) error {
+				if err := stream.Send(Event{ID: "1", Event: "resumed", Data: stream.LastEventID()}); err != nil {
+					return err
+				}
+				return stream.Send(Event{ID: "2", Event: "progress", Data: map[string]int{"Done": 50}})
+			},
+		},
+		{
+			Action: "lines",
+			SSEHandler: func(req *Request, stream *EventStream) error {
+				if err := stream.Send(Event{Event: "injected\nevent: admin"}); err != ErrInvalidEvent {
+					return stream.Send(Event{Data: "expected ErrInvalidEvent"})
+				}
+				return stream.Send(Event{Data: "a\r\nb\rc\nd"})
+			},
+		},
+		{
+			Action: "live",
+			SSEHandler: func(req *Request, stream *EventStream) error {
+				<-stream.Context().Done()
+				return nil
+			},
+		},
+		{
+			Action:         "private",
+			AuthValidators: []AuthValidatorCallback{NewMockAuthValidator(Auth{})},
+			SSEHandler: func(req *Request, stream *EventStream) error {
+				return nil
+			},
+		},
+	}
+}
+
+func (sApp *SSEApp) QueueHandlers() QueueRoute {
+	return QueueRoute{}
+}
+
+func TestEventStream(t *testing.T) {
+	s := NewService(&Config{}, &[]App{&SSEApp{}})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	t.Run("Events are streamed with Last-Event-ID", func(t *testing.T) {
+		httpReq, _ := http.NewRequest("GET", server.URL+"/sse-app/progress", nil)
+		httpReq.Header.Set("Last-Event-ID", "41")
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Errorf("expected text/event-stream got %s", resp.Header.Get("Content-Type"))
+		}
+
+		lines := []string{}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" && !strings.HasPrefix(line, ":") {
+				lines = append(lines, line)
+			}
+		}
+		exp := []string{"id: 1", "event: resumed", "data: 41", "id: 2", "event: progress", "data: {\"Done\":50}"}
+		if strings.Join(lines, "|") != strings.Join(exp, "|") {
+			t.Errorf("expected %v got %v", exp, lines)
+		}
+	})
+
+	t.Run("Every line break starts a data line", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/sse-app/lines")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if !strings.Contains(string(body), "data: a\ndata: b\ndata: c\ndata: d\n\n") || strings.Contains(string(body), "\r") {
+			t.Errorf("unexpected events %q", body)
+		}
+	})
+
+	t.Run("HEAD returns headers only", func(t *testing.T) {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Head(server.URL + "/sse-app/live")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Connection") != "" {
+			t.Errorf("unexpected response %d %v", resp.StatusCode, resp.Header)
+		}
+	})
+
+	t.Run("Auth validators guard event streams", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/sse-app/private")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected 401 got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StreamFunc writes the body straight to the client, every write is flushed so nothing is held in memory.
+type StreamFunc func(w io.Writer) error
+
+// fileBody is served through http.ServeContent which takes care of Range, If-Modified-Since and If-Range.
+type fileBody struct {
+	name    string
+	modTime time.Time
+	content io.ReadSeeker
+	inline  bool
+}
+
+// StreamResponse streams whatever write produces, transfer is chunked as length isn't known upfront.
+func StreamResponse(contentType string, write StreamFunc) *Response {
+	return &Response{
+		Status:      http.StatusOK,
+		Body:        write,
+		ContentType: contentType,
+	}
+}
+
+// ReaderResponse streams reader to the client and closes it if it's an io.Closer.
+func ReaderResponse(contentType string, reader io.Reader) *Response {
+	return &Response{
+		Status:      http.StatusOK,
+		Body:        reader,
+		ContentType: contentType,
+	}
+}
+
+// FileResponse sends content as a download named name, modTime drives Last-Modified and If-Modified-Since.
+func FileResponse(name string, modTime time.Time, content io.ReadSeeker) *Response {
+	return &Response{
+		Status: http.StatusOK,
+		Body: &fileBody{
+			name:    name,
+			modTime: modTime,
+			content: content,
+		},
+	}
+}
+
+// InlineFileResponse is FileResponse meant to be displayed by the browser instead of downloaded.
+func InlineFileResponse(name string, modTime time.Time, content io.ReadSeeker) *Response {
+	resp := FileResponse(name, modTime, content)
+	resp.Body.(*fileBody).inline = true
+	return resp
+}
+
+// FileResponseFromPath opens the file at path and sends it as a download.
+func FileResponseFromPath(path string) *Response {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NotFoundResponseWithMessage("file doesn't exist")
+		}
+		return ErrorResponse(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return ErrorResponse(err)
+	}
+	return FileResponse(filepath.Base(path), info.ModTime(), file)
+}
+
+// isStreamBody tells returnResp the body has to be written without buffering.
+func isStreamBody(body interface{}) bool {
+	switch body.(type) {
+	case StreamFunc, func(io.Writer) error, *fileBody, io.Reader:
+		return true
+	}
+	return false
+}
+
+func (s *Service) writeStream(w http.ResponseWriter, resp *Response, req *Request) {
+	if file, isFile := resp.Body.(*fileBody); isFile {
+		s.serveFile(w, resp, req, file)
+		return
+	}
+
+	if !StringLenGtZero(resp.ContentType) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Del("Content-Length")
+
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+
+	writer := &flushWriter{w: w}
+	writer.flusher, _ = w.(http.Flusher)
+
+	var err error
+	switch body := resp.Body.(type) {
+	case StreamFunc:
+		err = body(writer)
+	case func(io.Writer) error:
+		err = body(writer)
+	case io.Reader:
+		if closer, isCloser := body.(io.Closer); isCloser {
+			defer closer.Close()
+		}
+		_, err = io.Copy(writer, body)
+	}
+
+	if err != nil {
+		// Status is already out, aborting is the only way to tell client the body is incomplete.
+		req.Log().Error("failed to stream response", "error", err)
+		abortResponse(w)
+	}
+}
+
+// abortResponse drops the connection so the client sees a truncated body instead of a complete one.
+// Closing a hijacked connection doesn't rely on the panic getting past middleware which recovers(sentry),
+// http/2 can't be hijacked so it falls back to http.ErrAbortHandler which resets the stream.
+func abortResponse(w http.ResponseWriter) {
+	if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+		conn.Close()
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func (s *Service) serveFile(w http.ResponseWriter, resp *Response, req *Request, file *fileBody) {
+	if closer, isCloser := file.content.(io.Closer); isCloser {
+		defer closer.Close()
+	}
+
+	// Let ServeContent sniff from file name unless handler was explicit.
+	if !StringLenGtZero(resp.ContentType) {
+		w.Header().Del("Content-Type")
+	}
+
+	disposition := "attachment"
+	if file.inline {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": file.name}))
+
+	if req.httpReq == nil {
+		// Requests built outside ServeHTTP have no conditional or range headers to honour.
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, file.content)
+		return
+	}
+
+	http.ServeContent(w, req.httpReq, file.name, file.modTime, file.content)
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (fw *flushWriter) Write(data []byte) (int, error) {
+	n, err := fw.w.Write(data)
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sentryhttp "github.com/getsentry/sentry-go/http"
+)
+
+var streamModTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type StreamApp struct {
+}
+
+func (sApp *StreamApp) Title() string {
+	return "stream-app"
+}
+
+func (sApp *StreamApp) Init(s *Service) {
+}
+
+func (sApp *StreamApp) Routes() []HttpAction {
+	return []HttpAction{
+		{
+			Action: "export",
+			Handler: func(*Request) *Response {
+				return StreamResponse("text/csv", func(w io.Writer) error {
+					for i := 0; i < 3; i++ {
+						fmt.Fprintf(w, "%d\n", i)
+					}
+					return nil
+				})
+			},
+		},
+		{
+			Action: "broken",
+			Handler: func(*Request) *Response {
+				return StreamResponse("text/csv", func(w io.Writer) error {
+					fmt.Fprintf(w, "0\n")
+					return errors.New("database went away")
+				})
+			},
+		},
+		{
+			Action: "download",
+			Handler: func(*Request) *Response {
+				return FileResponse("report.txt", streamModTime, bytes.NewReader([]byte("0123456789")))
+			},
+		},
+	}
+}
+
+func (sApp *StreamApp) QueueHandlers() QueueRoute {
+	return QueueRoute{}
+}
+
+func TestStreamingResponses(t *testing.T) {
+	s := NewService(&Config{}, &[]App{&StreamApp{}})
+
+	type input struct {
+		title         string
+		path          string
+		header        map[string]string
+		expStatusCode int
+		expResp       string
+		expHeader     map[string]string
+	}
+
+	inputs := []input{
+		{
+			title:         "Stream func is written as is",
+			path:          "/stream-app/export",
+			expStatusCode: http.StatusOK,
+			expResp:       "0\n1\n2\n",
+			expHeader:     map[string]string{"Content-Type": "text/csv"},
+		},
+		{
+			title:         "File download sets disposition",
+			path:          "/stream-app/download",
+			expStatusCode: http.StatusOK,
+			expResp:       "0123456789",
+			expHeader: map[string]string{
+				"Content-Disposition": "attachment; filename=report.txt",
+				"Content-Type":        "text/plain; charset=utf-8",
+			},
+		},
+		{
+			title:         "Range request returns partial content",
+			path:          "/stream-app/download",
+			header:        map[string]string{"Range": "bytes=2-4"},
+			expStatusCode: http.StatusPartialContent,
+			expResp:       "234",
+			expHeader:     map[string]string{"Content-Range": "bytes 2-4/10"},
+		},
+		{
+			title:         "Unmodified file returns 304",
+			path:          "/stream-app/download",
+			header:        map[string]string{"If-Modified-Since": streamModTime.Add(time.Hour).Format(http.TimeFormat)},
+			expStatusCode: http.StatusNotModified,
+			expResp:       "",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			httpReq := httptest.NewRequest("GET", input.path, nil)
+			for key, value := range input.header {
+				httpReq.Header.Set(key, value)
+			}
+			recorder := httptest.NewRecorder()
+			s.ServeHTTP(recorder, httpReq)
+
+			if recorder.Code != input.expStatusCode {
+				t.Errorf("expected %d got %d", input.expStatusCode, recorder.Code)
+			}
+			if recorder.Body.String() != input.expResp {
+				t.Errorf("expected %q got %q", input.expResp, recorder.Body.String())
+			}
+			for key, exp := range input.expHeader {
+				if got := recorder.Header().Get(key); got != exp {
+					t.Errorf("expected header %s to be %s got %s", key, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamAbort(t *testing.T) {
+	s := NewService(&Config{}, &[]App{&StreamApp{}})
+	server := httptest.NewServer(sentryhttp.New(sentryhttp.Options{Repanic: true}).Handle(s))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream-app/broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF got %v", err)
+	}
+	if string(body) != "0\n" {
+		t.Errorf("expected what was streamed before the error got %q", body)
+	}
+}
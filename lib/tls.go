@@ -0,0 +1,293 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultTLSReloadInterval = time.Minute
+
+type TLSConfig struct {
+	CertFile      string `json:"CertFile"`      // PEM certificate chain, served instead of plain http when set
+	KeyFile       string `json:"KeyFile"`       // PEM private key
+	MinVersion    string `json:"MinVersion"`    // 1.2(default) or 1.3
+	ClientCAFile  string `json:"ClientCAFile"`  // PEM CAs client certificates must chain to, enables mTLS
+	ClientAuth    string `json:"ClientAuth"`    // require(default with ClientCAFile) or optional, optional lets routes without ClientCertValidator serve anyone
+	ReloadSeconds int    `json:"ReloadSeconds"` // How often files are checked for changes, defaults to 60
+
+	// Client certificate identity(CN:<common name>, DNS:<name>, URI:<uri>, EMAIL:<address> or SHA256:<fingerprint>) to user id,
+	// used by NewClientCertValidator. Verified certificates that aren't listed are rejected.
+	ClientIdentities map[string]string `json:"ClientIdentities"`
+}
+
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version %s, use 1.2 or 1.3", version)
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// tlsReloader serves the certificate and client CAs from disk, picking up renewed files without a restart.
+// Files are checked on handshakes at most once per interval, a broken file keeps the previous config.
+type tlsReloader struct {
+	config     *TLSConfig
+	minVersion uint16
+	interval   time.Duration
+
+	mu        sync.Mutex
+	current   *tls.Config
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+func newTLSReloader(config *TLSConfig) (*tlsReloader, error) {
+	minVersion, err := tlsVersion(config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	if config.ClientAuth != "" && config.ClientAuth != "require" && config.ClientAuth != "optional" {
+		return nil, fmt.Errorf("unsupported client auth %s, use require or optional", config.ClientAuth)
+	}
+	reloader := &tlsReloader{config: config, minVersion: minVersion, interval: defaultTLSReloadInterval}
+	if config.ReloadSeconds > 0 {
+		reloader.interval = time.Duration(config.ReloadSeconds) * time.Second
+	}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *tlsReloader) files() []string {
+	files := []string{reloader.config.CertFile, reloader.config.KeyFile}
+	if StringLenGtZero(reloader.config.ClientCAFile) {
+		files = append(files, reloader.config.ClientCAFile)
+	}
+	return files
+}
+
+func (reloader *tlsReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.config.CertFile, reloader.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	// Replaces the server's config for the handshake, without NextProtos http/2 would never be negotiated.
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: reloader.minVersion, NextProtos: []string{"h2", "http/1.1"}}
+	if StringLenGtZero(reloader.config.ClientCAFile) {
+		if config.ClientCAs, err = loadCertPool(reloader.config.ClientCAFile); err != nil {
+			return err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if reloader.config.ClientAuth == "optional" {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.current = config
+	reloader.modTimes = modTimes
+	return nil
+}
+
+func (reloader *tlsReloader) changed() bool {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	if time.Since(reloader.lastCheck) < reloader.interval {
+		return false
+	}
+	reloader.lastCheck = time.Now()
+	for file, modTime := range reloader.modTimes {
+		if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (reloader *tlsReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if reloader.changed() {
+		if err := reloader.load(); err != nil {
+			CaptureSentryException(fmt.Sprintf("reloading tls files failed, serving previous ones: %s", err))
+		}
+	}
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	return reloader.current, nil
+}
+
+// serverTLSConfig is what Server.TLSConfig gets set to, every handshake asks the reloader for the latest files.
+func (reloader *tlsReloader) serverTLSConfig() *tls.Config {
+	return &tls.Config{MinVersion: reloader.minVersion, GetConfigForClient: reloader.configForClient}
+}
+
+// ListenAndServe serves https when Config.TLS is set and plain http otherwise.
+func (s *Service) ListenAndServe() error {
+	if s.Server.TLSConfig != nil {
+		return s.Server.ListenAndServeTLS("", "")
+	}
+	return s.Server.ListenAndServe()
+}
+
+func (s *Service) initTLS() {
+	config := s.Config.TLS
+	if config == nil {
+		return
+	}
+	if !StringLenGtZero(config.CertFile) || !StringLenGtZero(config.KeyFile) {
+		errTxt := "TLS.CertFile and TLS.KeyFile are required to serve tls"
+		CheckFatal(errors.New(errTxt), errTxt)
+	}
+	reloader, err := newTLSReloader(config)
+	CheckFatal(err, "unable to load tls files")
+	s.Server.TLSConfig = reloader.serverTLSConfig()
+}
+
+// redisTLSConfig verifies redis against system roots, plus RedisCreds.CAFile when set.
+func redisTLSConfig(creds *RedisCreds) (*tls.Config, error) {
+	if creds.DisableTLS {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: creds.ServerName}
+	if creds.InsecureSkipVerify {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+	if StringLenGtZero(creds.CAFile) {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(creds.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", creds.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// ClientCertificate is the Auth.Payload set by ClientCertValidator.
+type ClientCertificate struct {
+	CommonName  string
+	DNSNames    []string
+	URIs        []string
+	Emails      []string
+	Fingerprint string // Hex SHA-256 of the DER certificate
+	NotAfter    time.Time
+}
+
+// identities lists the keys cert can be matched on in TLSConfig.ClientIdentities.
+func (cert *ClientCertificate) identities() []string {
+	identities := []string{"SHA256:" + cert.Fingerprint}
+	for _, uri := range cert.URIs {
+		identities = append(identities, "URI:"+uri)
+	}
+	for _, name := range cert.DNSNames {
+		identities = append(identities, "DNS:"+name)
+	}
+	for _, email := range cert.Emails {
+		identities = append(identities, "EMAIL:"+email)
+	}
+	if StringLenGtZero(cert.CommonName) {
+		identities = append(identities, "CN:"+cert.CommonName)
+	}
+	return identities
+}
+
+func newClientCertificate(cert *x509.Certificate) *ClientCertificate {
+	fingerprint := sha256.Sum256(cert.Raw)
+	clientCert := &ClientCertificate{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		Emails:      cert.EmailAddresses,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		NotAfter:    cert.NotAfter,
+	}
+	for _, uri := range cert.URIs {
+		clientCert.URIs = append(clientCert.URIs, uri.String())
+	}
+	return clientCert
+}
+
+type ClientCertValidator struct {
+	identities map[string]string
+}
+
+// NewClientCertValidator authenticates callers by a client certificate verified against TLS.ClientCAFile,
+// mapped to a user id through TLS.ClientIdentities. Only works when this service terminates tls.
+func NewClientCertValidator() AuthValidatorCallback {
+	return func(service *Service) AuthValidator {
+		validator := &ClientCertValidator{identities: map[string]string{}}
+		if service.Config.TLS != nil {
+			validator.identities = service.Config.TLS.ClientIdentities
+		}
+		return validator
+	}
+}
+
+func (v *ClientCertValidator) SecurityScheme() (string, SecurityScheme) {
+	return "clientCert", SecurityScheme{Type: "mutualTLS", Description: "Client certificate issued by TLS.ClientCAFile"}
+}
+
+func (v *ClientCertValidator) Validate(req *Request) Auth {
+	if req.httpReq == nil {
+		return Auth{}
+	}
+	cert := ClientCertFromRequest(req.httpReq)
+	if cert == nil {
+		return Auth{}
+	}
+
+	for _, identity := range cert.identities() {
+		if userId, found := v.identities[identity]; found {
+			return Auth{IsAuthenticated: true, UserId: userId, Payload: cert}
+		}
+	}
+	req.Log().Info("unknown client certificate", "fingerprint", cert.Fingerprint, "common_name", cert.CommonName)
+	return Auth{Reason: "unknown client certificate"}
+}
+
+// ClientCertFromRequest returns the verified client certificate of req, nil without one.
+// VerifiedChains is only set for certificates that chained to ClientCAs, PeerCertificates alone proves nothing.
+func ClientCertFromRequest(req *http.Request) *ClientCertificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return newClientCertificate(req.TLS.VerifiedChains[0][0])
+}
@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issueCert signs template with parent, self signed when parent is nil.
+func issueCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key}
+}
+
+func (cert *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	keyDer, _ := x509.MarshalECPrivateKey(cert.key)
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (cert *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}
+}
+
+type ClientCertApp struct {
+	MockApp
+}
+
+func (app *ClientCertApp) Title() string {
+	return "mtls"
+}
+
+func (app *ClientCertApp) Routes() []HttpAction {
+	return []HttpAction{
+		{Action: "whoami", Handler: func(r *Request) *Response { return SuccessResponse(r.UserId) }, AuthValidators: []AuthValidatorCallback{NewClientCertValidator()}},
+	}
+}
+
+func TestClientCertValidator(t *testing.T) {
+	ca := issueCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test ca"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	client := func(template *x509.Certificate) *testCert {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		return issueCert(t, template, ca)
+	}
+	spiffe, _ := url.Parse("spiffe://example.com/billing")
+	byName := client(&x509.Certificate{Subject: pkix.Name{CommonName: "orders"}})
+	byURI := client(&x509.Certificate{Subject: pkix.Name{CommonName: "ignored"}, URIs: []*url.URL{spiffe}})
+	unknown := client(&x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}})
+	byFingerprint := client(&x509.Certificate{Subject: pkix.Name{CommonName: "pinned"}})
+
+	fingerprint := newClientCertificate(byFingerprint.cert).Fingerprint
+
+	config := &Config{TLS: &TLSConfig{ClientIdentities: map[string]string{
+		"CN:orders":                        "orders-service",
+		"URI:spiffe://example.com/billing": "billing-service",
+		"SHA256:" + fingerprint:            "pinned-service",
+	}}}
+	s := NewService(config, &[]App{&ClientCertApp{}})
+
+	verified := func(cert *testCert) *tls.ConnectionState {
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.cert}, VerifiedChains: [][]*x509.Certificate{{cert.cert, ca.cert}}}
+	}
+
+	type input struct {
+		title     string
+		state     *tls.ConnectionState
+		expStatus int16
+		expBody   string
+	}
+
+	inputs := []input{
+		{title: "Common name", state: verified(byName), expStatus: 200, expBody: "orders-service"},
+		{title: "URI SAN", state: verified(byURI), expStatus: 200, expBody: "billing-service"},
+		{title: "Fingerprint", state: verified(byFingerprint), expStatus: 200, expBody: "pinned-service"},
+		{title: "Unknown identity", state: verified(unknown), expStatus: 401, expBody: "unknown client certificate"},
+		{title: "Unverified certificate", state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{byName.cert}}, expStatus: 401},
+		{title: "Plain http", expStatus: 401},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			w := &MockResponseWriter{}
+			s.ServeHTTP(w, &http.Request{Method: "GET", URL: &url.URL{Path: "/mtls/whoami"}, Header: http.Header{}, TLS: input.state})
+			if w.statusCode != input.expStatus {
+				t.Fatalf("expected %d got %d %s", input.expStatus, w.statusCode, w.dataWritten)
+			}
+			if !strings.Contains(w.dataWritten, input.expBody) {
+				t.Errorf("expected %s in %s", input.expBody, w.dataWritten)
+			}
+		})
+	}
+
+	t.Run("Handshake", func(t *testing.T) {
+		dir := t.TempDir()
+		server := issueCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca)
+		certFile, keyFile := server.write(t, dir, "server")
+		caFile, _ := ca.write(t, dir, "ca")
+
+		reloader, err := newTLSReloader(&TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, MinVersion: "1.3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpServer := httptest.NewUnstartedServer(s)
+		httpServer.EnableHTTP2 = true
+		httpServer.TLS = reloader.serverTLSConfig()
+		httpServer.StartTLS()
+		defer httpServer.Close()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		call := func(certs []tls.Certificate) (string, error) {
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+			resp, err := httpClient.Get(httpServer.URL + "/mtls/whoami")
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return string(body), nil
+		}
+
+		if body, err := call([]tls.Certificate{byName.tlsCert()}); err != nil || !strings.Contains(body, "orders-service") {
+			t.Errorf("expected orders-service got %s %v", body, err)
+		}
+		if _, err := call(nil); err == nil {
+			t.Error("expected handshake without a client certificate to fail")
+		}
+
+		conn, err := tls.Dial("tcp", httpServer.Listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{byName.tlsCert()}, NextProtos: []string{"h2", "http/1.1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+			t.Errorf("expected h2 to be negotiated got %q", protocol)
+		}
+	})
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	first := issueCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "first"}}, nil)
+	certFile, keyFile := first.write(t, dir, "server")
+
+	reloader, err := newTLSReloader(&TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		config, _ := reloader.configForClient(nil)
+		cert, _ := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		return cert.Subject.CommonName
+	}
+	if served() != "first" {
+		t.Fatalf("expected first got %s", served())
+	}
+
+	second := issueCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "second"}}, nil)
+	second.write(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if served() != "first" {
+		t.Error("expected files to be checked once per interval")
+	}
+
+	reloader.lastCheck = time.Time{}
+	if served() != "second" {
+		t.Errorf("expected renewed certificate got %s", served())
+	}
+
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	evenLater := later.Add(time.Minute)
+	os.Chtimes(keyFile, evenLater, evenLater)
+	reloader.lastCheck = time.Time{}
+	if served() != "second" {
+		t.Errorf("expected broken files to keep the previous certificate got %s", served())
+	}
+
+	if _, err := newTLSReloader(&TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.0"}); err == nil {
+		t.Error("expected tls 1.0 to be refused")
+	}
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	ca := issueCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "redis ca"}, IsCA: true, BasicConstraintsValid: true}, nil)
+	caFile, _ := ca.write(t, t.TempDir(), "ca")
+
+	type input struct {
+		title       string
+		creds       RedisCreds
+		expNil      bool
+		expInsecure bool
+		expRoots    bool
+		expErr      bool
+	}
+
+	inputs := []input{
+		{title: "Verifies by default", creds: RedisCreds{}},
+		{title: "Custom CA", creds: RedisCreds{CAFile: caFile}, expRoots: true},
+		{title: "Missing CA file", creds: RedisCreds{CAFile: caFile + ".missing"}, expErr: true},
+		{title: "Insecure opt in", creds: RedisCreds{InsecureSkipVerify: true}, expInsecure: true},
+		{title: "Without tls", creds: RedisCreds{DisableTLS: true}, expNil: true},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			config, err := redisTLSConfig(&input.creds)
+			if (err != nil) != input.expErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if input.expErr {
+				return
+			}
+			if (config == nil) != input.expNil {
+				t.Fatalf("unexpected config %+v", config)
+			}
+			if config == nil {
+				return
+			}
+			if config.InsecureSkipVerify != input.expInsecure || (config.RootCAs != nil) != input.expRoots {
+				t.Errorf("unexpected config insecure %t roots %t", config.InsecureSkipVerify, config.RootCAs != nil)
+			}
+		})
+	}
+}
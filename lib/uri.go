@@ -5,17 +5,22 @@ import (
 	"strings"
 )
 
-// decodeURL parses the URL path to extract app name and action.
-func decodeURI(req *http.Request) (string, string) {
+// decodeURL parses the URL path to extract version, app name and action. Version is 0 unless versionedPath is set and path starts with /v{n}/.
+func decodeURI(req *http.Request, versionedPath bool) (int, string, string) {
 	pathTokens := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
 
+	version := 0
+	if versionedPath {
+		version, pathTokens = splitVersion(pathTokens)
+	}
+
 	switch len(pathTokens) {
 	case 1:
-		return pathTokens[0], ""
+		return version, pathTokens[0], ""
 	case 2:
-		return pathTokens[0], pathTokens[1]
+		return version, pathTokens[0], pathTokens[1]
 	default:
-		return "", ""
+		return version, "", ""
 	}
 }
 
@@ -1,12 +1,14 @@
 package lib
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"runtime/debug"
 	"strings"
 )
 
@@ -26,13 +28,6 @@ func ChunkArray[T any](array []T, size int) [][]T {
 	return finalArray
 }
 
-func Handlepanic(errorContext string) {
-	if a := recover(); a != nil {
-		stck := debug.Stack()
-		CaptureSentryException(fmt.Sprintf("RECOVER from error at %s:  %s", errorContext, stck))
-	}
-}
-
 func GenerateRandomUUID() string {
 	// Create a buffer to hold the random bytes
 	buf := make([]byte, 16)
@@ -60,6 +55,14 @@ func StringLenGtZero(str string) bool {
 }
 
 func PlaceGetReq(req *Request, url string, params map[string]string, token string) (*[]byte, error) {
+	return placeGetReq(req, url, params, func(httpReq *http.Request) error {
+		httpReq.Header.Set("Authorization", token)
+		return nil
+	})
+}
+
+// placeGetReq places a GET with params, prepare runs on the final request to add credentials.
+func placeGetReq(req *Request, url string, params map[string]string, prepare func(*http.Request) error) (*[]byte, error) {
 
 	httpReq, httpErr := http.NewRequest("GET", url, nil)
 	if httpErr != nil {
@@ -67,25 +70,33 @@ func PlaceGetReq(req *Request, url string, params map[string]string, token strin
 		return nil, errors.New("Something went wrong")
 	}
 
-	httpReq.Header.Set("Authorization", token)
-
 	q := httpReq.URL.Query()
 	for key, value := range params {
 		q.Add(key, value)
 	}
 	httpReq.URL.RawQuery = q.Encode()
 
+	if prepareErr := prepare(httpReq); prepareErr != nil {
+		CaptureSentryException(fmt.Sprintf("ERR: %s preparing URL %s failed with error %s", req.ID, url, prepareErr))
+		return nil, errors.New("Something went wrong")
+	}
+
 	client := &http.Client{}
 	resp, doErr := client.Do(httpReq)
 
-	if doErr != nil || resp.StatusCode != 200 {
+	if doErr != nil {
 		CaptureSentryException(fmt.Sprintf("%s Error: Portfolio service could be down", req.ID))
-		CaptureSentryException(fmt.Sprintf("%s Error: client.do failed on url %s with status.code %d with error %s", req.ID, url, resp.StatusCode, doErr))
+		CaptureSentryException(fmt.Sprintf("%s Error: client.do failed on url %s with error %s", req.ID, url, doErr))
 		return nil, errors.New("Something went wrong")
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode != 200 {
+		CaptureSentryException(fmt.Sprintf("%s Error: client.do failed on url %s with status.code %d", req.ID, url, resp.StatusCode))
+		return nil, errors.New("Something went wrong")
+	}
+
 	body, readErr := io.ReadAll(resp.Body)
 	if readErr != nil {
 		CaptureSentryException(fmt.Sprintf("%s ioutil.ReadAll failed with error %s", req.ID, readErr))
@@ -95,13 +106,6 @@ func PlaceGetReq(req *Request, url string, params map[string]string, token strin
 	return &body, nil
 }
 
-func GoFuncWrapper(title string, callback func()) {
-	go func() {
-		Handlepanic(title)
-		callback()
-	}()
-}
-
 func SnakeToUpperCamel(input string) string {
 	words := strings.Split(input, "_")
 
@@ -113,3 +117,32 @@ func SnakeToUpperCamel(input string) string {
 
 	return result
 }
+
+// RandomToken returns n random bytes, base64url encoded. Used for state, nonces, session ids etc.
+func RandomToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		CaptureSentryException(fmt.Sprintf("Error reading from buffer %s", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// SignValue appends an HMAC so value can be handed to clients(cookies, query params) and trusted when it comes back.
+func SignValue(key string, value string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignedValue returns the original value when signature matches.
+func VerifySignedValue(key string, signed string) (string, bool) {
+	idx := strings.LastIndex(signed, ".")
+	if idx < 0 {
+		return "", false
+	}
+	value := signed[:idx]
+	if !hmac.Equal([]byte(SignValue(key, value)), []byte(signed)) {
+		return "", false
+	}
+	return value, true
+}
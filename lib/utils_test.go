@@ -145,3 +145,35 @@ func TestChunkArray(t *testing.T) {
 		})
 	}
 }
+
+func TestSignedValue(t *testing.T) {
+	signed := SignValue("key", "state.nonce")
+
+	type TestCase struct {
+		Title  string
+		Key    string
+		Signed string
+		Exp    string
+		Valid  bool
+	}
+
+	testCases := []TestCase{
+		{Title: "Round trip", Key: "key", Signed: signed, Exp: "state.nonce", Valid: true},
+		{Title: "Wrong key", Key: "other", Signed: signed},
+		{Title: "Tampered value", Key: "key", Signed: "state.other" + signed[len("state.nonce"):]},
+		{Title: "Unsigned", Key: "key", Signed: "state"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Title, func(t *testing.T) {
+			got, valid := VerifySignedValue(testCase.Key, testCase.Signed)
+			if valid != testCase.Valid || got != testCase.Exp {
+				t.Errorf("expected %q %t got %q %t", testCase.Exp, testCase.Valid, got, valid)
+			}
+		})
+	}
+
+	if RandomToken(16) == RandomToken(16) {
+		t.Error("expected random tokens to differ")
+	}
+}
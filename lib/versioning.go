@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PathVersioning   = "path"   // /v2/app/action
+	HeaderVersioning = "header" // Accept-Version: 2
+
+	defaultVersionHeader = "Accept-Version"
+	latestVersion        = math.MaxInt
+)
+
+var versionPrefix = regexp.MustCompile(`^[vV]?([0-9]+)$`)
+
+type VersioningConfig struct {
+	Strategy     string                         `json:"Strategy"`     // "path" or "header"
+	Header       string                         `json:"Header"`       // Header strategy only, defaults to Accept-Version
+	Default      int                            `json:"Default"`      // Served when client doesn't ask for a version, latest when 0
+	Deprecations map[string]*VersionDeprecation `json:"Deprecations"` // Keyed on version number
+}
+
+// VersionDeprecation adds Deprecation, Sunset and Link headers to responses served by that version.
+type VersionDeprecation struct {
+	Deprecation time.Time `json:"Deprecation"`
+	Sunset      time.Time `json:"Sunset"`
+	Link        string    `json:"Link"` // Migration guide
+}
+
+// versionedActions keeps every version of an app/action/method, sorted by version.
+type versionedActions []HttpAction
+
+// resolve returns highest version not newer than requested, unversioned actions serve every version.
+func (actions versionedActions) resolve(version int) (HttpAction, bool) {
+	for i := len(actions) - 1; i >= 0; i-- {
+		if actions[i].Version <= version {
+			return actions[i], true
+		}
+	}
+	return HttpAction{}, false
+}
+
+func (actions versionedActions) add(action HttpAction) versionedActions {
+	actions = append(actions, action)
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].Version < actions[j].Version
+	})
+	return actions
+}
+
+// forVersion collapses route to the actions serving version, methods without a compatible version are left out.
+func forVersion(methods map[HttpMethod]versionedActions, version int) map[HttpMethod]HttpAction {
+	methodMap := make(map[HttpMethod]HttpAction)
+	for method, actions := range methods {
+		if action, found := actions.resolve(version); found {
+			methodMap[method] = action
+		}
+	}
+	return methodMap
+}
+
+// splitVersion strips /v2/ prefix off path based routes, returns 0 when there's none.
+func splitVersion(pathTokens []string) (int, []string) {
+	if len(pathTokens) < 2 || !strings.HasPrefix(strings.ToLower(pathTokens[0]), "v") {
+		return 0, pathTokens
+	}
+	matches := versionPrefix.FindStringSubmatch(pathTokens[0])
+	if matches == nil {
+		return 0, pathTokens
+	}
+	version, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return 0, pathTokens
+	}
+	return version, pathTokens[1:]
+}
+
+// requestedVersion reads the version from header strategy, path versions are parsed by decodeURI.
+func (s *Service) requestedVersion(httpReq *http.Request, pathVersion int) (int, error) {
+	config := s.Config.Versioning
+	if config == nil {
+		return latestVersion, nil
+	}
+
+	version := pathVersion
+	if config.Strategy == HeaderVersioning {
+		header := config.Header
+		if !StringLenGtZero(header) {
+			header = defaultVersionHeader
+		}
+		if val := strings.TrimSpace(httpReq.Header.Get(header)); StringLenGtZero(val) {
+			matches := versionPrefix.FindStringSubmatch(val)
+			if matches == nil {
+				return 0, ErrBadRequest(fmt.Sprintf("invalid %s %s", header, val))
+			}
+			version, _ = strconv.Atoi(matches[1])
+		}
+	}
+
+	if version > 0 {
+		return version, nil
+	}
+	if config.Default > 0 {
+		return config.Default, nil
+	}
+	return latestVersion, nil
+}
+
+// setVersionHeaders tells clients which version served them and whether it's on its way out.
+func (s *Service) setVersionHeaders(w http.ResponseWriter, httpAction HttpAction) {
+	if httpAction.Version == 0 {
+		return
+	}
+	w.Header().Set("Api-Version", strconv.Itoa(httpAction.Version))
+
+	if s.Config.Versioning == nil {
+		return
+	}
+	deprecation, found := s.Config.Versioning.Deprecations[strconv.Itoa(httpAction.Version)]
+	if !found || deprecation == nil {
+		return
+	}
+	if !deprecation.Deprecation.IsZero() {
+		// RFC 9745 structured date.
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecation.Deprecation.Unix()))
+	} else {
+		w.Header().Set("Deprecation", "true")
+	}
+	if !deprecation.Sunset.IsZero() {
+		w.Header().Set("Sunset", deprecation.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if StringLenGtZero(deprecation.Link) {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"", deprecation.Link))
+	}
+}
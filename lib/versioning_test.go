@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type VersionedApp struct {
+	MockApp
+}
+
+func (app *VersionedApp) Title() string {
+	return "versioned-app"
+}
+
+func (app *VersionedApp) Routes() []HttpAction {
+	handler := func(r *Request) *Response {
+		return SuccessResponse(fmt.Sprintf("v%d", r.Version))
+	}
+	return []HttpAction{
+		{Action: "items", Version: 1, Handler: func(r *Request) *Response { return SuccessResponse("items v1") }},
+		{Action: "items", Version: 2, Handler: func(r *Request) *Response { return SuccessResponse("items v2") }},
+		{Action: "items", Method: POST, Version: 2, Handler: handler},
+		{Action: "unversioned", Handler: handler},
+		{Action: "new-only", Version: 3, Handler: handler},
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	sunset := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	deprecations := map[string]*VersionDeprecation{
+		"1": {Deprecation: time.Unix(1700000000, 0), Sunset: sunset, Link: "https://example.com/migrate"},
+	}
+
+	pathService := NewService(&Config{Versioning: &VersioningConfig{Strategy: PathVersioning, Deprecations: deprecations}}, &[]App{&VersionedApp{}})
+	headerService := NewService(&Config{Versioning: &VersioningConfig{Strategy: HeaderVersioning, Default: 1, Deprecations: deprecations}}, &[]App{&VersionedApp{}})
+
+	type input struct {
+		title         string
+		s             *Service
+		method        string
+		path          string
+		header        http.Header
+		expStatusCode int16
+		expResp       string
+		expHeader     map[string]string
+	}
+
+	inputs := []input{
+		{
+			title:         "Path version",
+			s:             pathService,
+			path:          "v1/versioned-app/items",
+			expStatusCode: 200,
+			expResp:       "items v1",
+			expHeader: map[string]string{
+				"Api-Version": "1",
+				"Deprecation": "@1700000000",
+				"Sunset":      "Tue, 01 Jan 2030 00:00:00 GMT",
+				"Link":        "<https://example.com/migrate>; rel=\"deprecation\"",
+			},
+		},
+		{
+			title:         "No path version serves latest",
+			s:             pathService,
+			path:          "versioned-app/items",
+			expStatusCode: 200,
+			expResp:       "items v2",
+			expHeader:     map[string]string{"Api-Version": "2", "Deprecation": "", "Sunset": ""},
+		},
+		{
+			title:         "Newer version falls back to latest compatible",
+			s:             pathService,
+			path:          "v5/versioned-app/items",
+			expStatusCode: 200,
+			expResp:       "items v2",
+		},
+		{
+			title:         "Unversioned action serves every version",
+			s:             pathService,
+			path:          "v7/versioned-app/unversioned",
+			expStatusCode: 200,
+			expResp:       "v7",
+			expHeader:     map[string]string{"Api-Version": ""},
+		},
+		{
+			title:         "Older version than any registered is not found",
+			s:             pathService,
+			path:          "v2/versioned-app/new-only",
+			expStatusCode: 404,
+			expResp:       "{\"Code\": \"not_found\", \"Msg\": \"doesn't exist\"}",
+		},
+		{
+			title:         "Methods missing in requested version aren't allowed",
+			s:             pathService,
+			method:        "POST",
+			path:          "v1/versioned-app/items",
+			expStatusCode: 405,
+			expResp:       "{\"Code\": \"method_not_allowed\", \"Msg\": \"POST not allowed on v1/versioned-app/items\"}",
+			expHeader:     map[string]string{"Allow": "GET, HEAD, OPTIONS"},
+		},
+		{
+			title:         "Header version",
+			s:             headerService,
+			path:          "versioned-app/items",
+			header:        http.Header{"Accept-Version": []string{"v2"}},
+			expStatusCode: 200,
+			expResp:       "items v2",
+		},
+		{
+			title:         "Header strategy uses default version",
+			s:             headerService,
+			path:          "versioned-app/items",
+			expStatusCode: 200,
+			expResp:       "items v1",
+			expHeader:     map[string]string{"Deprecation": "@1700000000"},
+		},
+		{
+			title:         "Header strategy ignores path prefix",
+			s:             headerService,
+			path:          "v2/versioned-app/items",
+			expStatusCode: 404,
+			expResp:       "{\"Code\": \"not_found\", \"Msg\": \"doesn't exist\"}",
+		},
+		{
+			title:         "Invalid header version",
+			s:             headerService,
+			path:          "versioned-app/items",
+			header:        http.Header{"Accept-Version": []string{"latest"}},
+			expStatusCode: 400,
+			expResp:       "{\"Code\": \"bad_request\", \"Msg\": \"invalid Accept-Version latest\"}",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.title, func(t *testing.T) {
+			method := input.method
+			if !StringLenGtZero(method) {
+				method = "GET"
+			}
+			header := input.header
+			if header == nil {
+				header = http.Header{}
+			}
+			w := &MockResponseWriter{}
+			input.s.ServeHTTP(w, &http.Request{Method: method, URL: &url.URL{Path: input.path}, Header: header})
+			if !w.GotExpResp(input.expResp) {
+				t.Errorf("expected %s got %s", input.expResp, w.dataWritten)
+			}
+			if input.expStatusCode != w.statusCode {
+				t.Errorf("expected %d got %d", input.expStatusCode, w.statusCode)
+			}
+			for key, exp := range input.expHeader {
+				if got := w.Header().Get(key); got != exp {
+					t.Errorf("expected header %s to be %q got %q", key, exp, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultWSPingInterval = 30 * time.Second
+	defaultWSPongWait     = 60 * time.Second
+	defaultWSWriteWait    = 10 * time.Second
+	defaultWSSendBuffer   = 256
+	defaultWSReadBuffer   = 256
+)
+
+var ErrWSClosed = errors.New("websocket connection closed")
+
+type WebSocketConfig struct {
+	AllowedOrigins      []string `json:"AllowedOrigins"` // Same origin only when empty, "*" allows everything
+	ReadLimit           int64    `json:"ReadLimit"`      // Max message size in bytes
+	PingIntervalSeconds int      `json:"PingIntervalSeconds"`
+	PongWaitSeconds     int      `json:"PongWaitSeconds"`
+}
+
+// WebSocketHandler owns the connection until it returns, connection is closed right after.
+type WebSocketHandler func(req *Request, conn *WSConn)
+
+// webSocketBody tells returnResp to upgrade instead of writing a response.
+type webSocketBody struct {
+	handler WebSocketHandler
+}
+
+// WSConn wraps a websocket connection, writes are queued and sent by a single writer so it's safe for concurrent use.
+// A single reader keeps answering pings and pongs whether or not the handler reads, messages wait for ReadJSON.
+type WSConn struct {
+	ID      string
+	Request *Request
+
+	conn         *websocket.Conn
+	send         chan []byte
+	received     chan []byte
+	readErr      error         // Why the reader stopped, set before readDone is closed
+	readDone     chan struct{} // Closed once the reader stopped
+	done         chan struct{}
+	pumpDone     chan struct{}
+	closeOnce    sync.Once
+	closeCode    int
+	closeReason  string
+	ctx          context.Context
+	cancel       context.CancelFunc
+	pingInterval time.Duration
+
+	hooksMu    sync.Mutex
+	closeHooks []func()
+}
+
+// Context is cancelled once the connection is closed by either side.
+func (c *WSConn) Context() context.Context {
+	return c.ctx
+}
+
+// ReadJSON blocks till the next message, messages received before the connection closed are still returned.
+func (c *WSConn) ReadJSON(v any) error {
+	select {
+	case data := <-c.received:
+		return json.Unmarshal(data, v)
+	case <-c.readDone:
+	case <-c.done:
+	}
+	select {
+	case data := <-c.received:
+		return json.Unmarshal(data, v)
+	default:
+	}
+	select {
+	case <-c.readDone:
+		return c.readErr
+	default:
+		return ErrWSClosed
+	}
+}
+
+// WriteJSON queues v, connection is dropped if client can't keep up with the queue.
+func (c *WSConn) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeRaw(data)
+}
+
+func (c *WSConn) writeRaw(data []byte) error {
+	select {
+	case <-c.done:
+		return ErrWSClosed
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return nil
+	default:
+		c.markClosed(websocket.ClosePolicyViolation, "slow consumer")
+		return ErrWSClosed
+	}
+}
+
+// Close flushes queued messages, sends close frame and waits for the writer to finish.
+func (c *WSConn) Close(code int, reason string) {
+	c.markClosed(code, reason)
+	<-c.pumpDone
+}
+
+// OnClose registers a callback invoked when connection closes, used by Hub to clean up groups.
+// Callback runs straight away if connection is already closed.
+func (c *WSConn) OnClose(hook func()) {
+	c.hooksMu.Lock()
+	c.closeHooks = append(c.closeHooks, hook)
+	c.hooksMu.Unlock()
+
+	select {
+	case <-c.done:
+		hook()
+	default:
+	}
+}
+
+func (c *WSConn) markClosed(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+		c.cancel()
+
+		c.hooksMu.Lock()
+		hooks := c.closeHooks
+		c.hooksMu.Unlock()
+		for _, hook := range hooks {
+			hook()
+		}
+	})
+}
+
+// readPump owns reads so control frames are handled even when the handler only writes.
+// Messages the handler doesn't get to in time close the connection, same as a slow consumer on the write side.
+func (c *WSConn) readPump() {
+	defer close(c.readDone)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.readErr = err
+			c.markClosed(websocket.CloseAbnormalClosure, "")
+			return
+		}
+		select {
+		case c.received <- data:
+		default:
+			c.readErr = ErrWSClosed
+			c.markClosed(websocket.ClosePolicyViolation, "unread messages")
+			return
+		}
+	}
+}
+
+func (c *WSConn) writePump() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		close(c.pumpDone)
+	}()
+
+	write := func(data []byte) bool {
+		c.conn.SetWriteDeadline(time.Now().Add(defaultWSWriteWait))
+		if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			c.markClosed(websocket.CloseAbnormalClosure, "")
+			return false
+		}
+		return true
+	}
+
+	for {
+		select {
+		case data := <-c.send:
+			if !write(data) {
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(defaultWSWriteWait)); err != nil {
+				c.markClosed(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+		drain:
+			for {
+				select {
+				case data := <-c.send:
+					if !write(data) {
+						return
+					}
+				default:
+					break drain
+				}
+			}
+			if c.closeCode != websocket.CloseAbnormalClosure {
+				c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason), time.Now().Add(defaultWSWriteWait))
+			}
+			return
+		}
+	}
+}
+
+// IsWSClosed tells whether err returned by ReadJSON/WriteJSON means the connection is gone.
+func IsWSClosed(err error) bool {
+	if errors.Is(err, ErrWSClosed) {
+		return true
+	}
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr) || errors.Is(err, net.ErrClosed)
+}
+
+func (s *Service) webSocketResponse(handler WebSocketHandler) *Response {
+	return &Response{
+		Status: http.StatusSwitchingProtocols,
+		Body:   &webSocketBody{handler: handler},
+	}
+}
+
+func (s *Service) upgrader() *websocket.Upgrader {
+	upgrader := &websocket.Upgrader{}
+	if s.Config.WebSocket == nil || len(s.Config.WebSocket.AllowedOrigins) == 0 {
+		// Upgrader falls back to same origin check.
+		return upgrader
+	}
+	allowedOrigins := s.Config.WebSocket.AllowedOrigins
+	upgrader.CheckOrigin = func(httpReq *http.Request) bool {
+		origin := httpReq.Header.Get("Origin")
+		for _, allowed := range allowedOrigins {
+			if allowed == "*" || allowed == origin {
+				return true
+			}
+		}
+		return false
+	}
+	return upgrader
+}
+
+func (s *Service) serveWebSocket(w http.ResponseWriter, req *Request, body *webSocketBody) {
+	if req.httpReq == nil {
+		s.returnResp(w, ErrorToResponse(ErrBadRequest("websocket upgrade required")), req)
+		return
+	}
+
+	// Upgrade writes its own error response on failure.
+	conn, err := s.upgrader().Upgrade(w, req.httpReq, nil)
+	if err != nil {
+		req.Log().Info("websocket upgrade failed", "error", err)
+		return
+	}
+
+	pingInterval, pongWait := defaultWSPingInterval, defaultWSPongWait
+	if wsConfig := s.Config.WebSocket; wsConfig != nil {
+		if wsConfig.ReadLimit > 0 {
+			conn.SetReadLimit(wsConfig.ReadLimit)
+		}
+		if wsConfig.PingIntervalSeconds > 0 {
+			pingInterval = time.Duration(wsConfig.PingIntervalSeconds) * time.Second
+		}
+		if wsConfig.PongWaitSeconds > 0 {
+			pongWait = time.Duration(wsConfig.PongWaitSeconds) * time.Second
+		}
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	wsConn := &WSConn{
+		ID:           GenerateRandomUUID(),
+		Request:      req,
+		conn:         conn,
+		send:         make(chan []byte, defaultWSSendBuffer),
+		received:     make(chan []byte, defaultWSReadBuffer),
+		readDone:     make(chan struct{}),
+		done:         make(chan struct{}),
+		pumpDone:     make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		pingInterval: pingInterval,
+	}
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go wsConn.writePump()
+	go wsConn.readPump()
+
+	defer wsConn.Close(websocket.CloseNormalClosure, "")
+	body.handler(req, wsConn)
+}
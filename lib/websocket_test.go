@@ -0,0 +1,330 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/websocket"
+)
+
+type WSApp struct {
+	hub        *Hub
+	feedClosed chan struct{}
+}
+
+func (wsApp *WSApp) Title() string {
+	return "ws-app"
+}
+
+func (wsApp *WSApp) Init(s *Service) {
+	wsApp.hub = s.NewHub("ws-app")
+}
+
+type chatMessage struct {
+	Room string
+	Text string
+}
+
+func (wsApp *WSApp) Routes() []HttpAction {
+	return []HttpAction{
+		{
+			Action: "echo",
+			WSHandler: func(req *Request, conn *WSConn) {
+				for {
+					var msg chatMessage
+					if err := conn.ReadJSON(&msg); err != nil {
+						return
+					}
+					conn.WriteJSON(msg)
+				}
+			},
+		},
+		{
+			Action: "chat",
+			WSHandler: func(req *Request, conn *WSConn) {
+				for {
+					var msg chatMessage
+					if err := conn.ReadJSON(&msg); err != nil {
+						return
+					}
+					if msg.Text == "join" {
+						wsApp.hub.Join(msg.Room, conn)
+						conn.WriteJSON(chatMessage{Room: msg.Room, Text: "joined"})
+						continue
+					}
+					wsApp.hub.Broadcast(msg.Room, msg)
+				}
+			},
+		},
+		{
+			Action: "feed",
+			WSHandler: func(req *Request, conn *WSConn) {
+				defer close(wsApp.feedClosed)
+				ticker := time.NewTicker(100 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-conn.Context().Done():
+						return
+					case <-ticker.C:
+						conn.WriteJSON(chatMessage{Text: "tick"})
+					}
+				}
+			},
+		},
+		{
+			Action:         "private",
+			AuthValidators: []AuthValidatorCallback{NewMockAuthValidator(Auth{})},
+			WSHandler: func(req *Request, conn *WSConn) {
+			},
+		},
+	}
+}
+
+func (wsApp *WSApp) QueueHandlers() QueueRoute {
+	return QueueRoute{}
+}
+
+func dialWS(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatalf("dial failed %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func TestWebSocket(t *testing.T) {
+	wsApp := &WSApp{}
+	s := NewService(&Config{}, &[]App{wsApp})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	t.Run("Messages are echoed", func(t *testing.T) {
+		conn := dialWS(t, server, "/ws-app/echo")
+		defer conn.Close()
+
+		conn.WriteJSON(chatMessage{Text: "hello"})
+		var reply chatMessage
+		if err := conn.ReadJSON(&reply); err != nil || reply.Text != "hello" {
+			t.Errorf("expected echo got %+v %s", reply, err)
+		}
+	})
+
+	t.Run("Hub broadcasts to group members only", func(t *testing.T) {
+		first := dialWS(t, server, "/ws-app/chat")
+		defer first.Close()
+		second := dialWS(t, server, "/ws-app/chat")
+		defer second.Close()
+
+		var reply chatMessage
+		first.WriteJSON(chatMessage{Room: "go", Text: "join"})
+		first.ReadJSON(&reply)
+		second.WriteJSON(chatMessage{Room: "rust", Text: "join"})
+		second.ReadJSON(&reply)
+
+		second.WriteJSON(chatMessage{Room: "go", Text: "hi gophers"})
+		if err := first.ReadJSON(&reply); err != nil || reply.Text != "hi gophers" {
+			t.Errorf("expected broadcast got %+v %s", reply, err)
+		}
+		if wsApp.hub.Count("go") != 1 || wsApp.hub.Count("rust") != 1 {
+			t.Errorf("expected one member per group")
+		}
+	})
+
+	t.Run("Closed connections leave their groups", func(t *testing.T) {
+		conn := dialWS(t, server, "/ws-app/chat")
+		var reply chatMessage
+		conn.WriteJSON(chatMessage{Room: "leavers", Text: "join"})
+		conn.ReadJSON(&reply)
+		conn.Close()
+
+		deadline := time.Now().Add(2 * time.Second)
+		for wsApp.hub.Count("leavers") != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if wsApp.hub.Count("leavers") != 0 {
+			t.Error("expected closed connection to leave group")
+		}
+	})
+
+	t.Run("Auth validators guard websocket routes", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws-app/private", nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected 401 got %v", resp)
+		}
+	})
+}
+
+func TestWebSocketWriteOnlyHandler(t *testing.T) {
+	wsApp := &WSApp{feedClosed: make(chan struct{})}
+	s := NewService(&Config{WebSocket: &WebSocketConfig{PingIntervalSeconds: 1, PongWaitSeconds: 2}}, &[]App{wsApp})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	conn := dialWS(t, server, "/ws-app/feed")
+	defer conn.Close()
+
+	// Pongs sent while reading have to keep the connection alive past PongWaitSeconds.
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var msg chatMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("expected a healthy client to stay connected got %s", err)
+		}
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	select {
+	case <-wsApp.feedClosed:
+	case <-time.After(2 * time.Second):
+		t.Error("expected the handler's context to be cancelled once the client closed")
+	}
+}
+
+// fakeRedis speaks just enough RESP for hub pub/sub.
+type fakeRedis struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	subscribers map[string][]net.Conn
+	published   []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed %s", err)
+	}
+	fake := &fakeRedis{listener: listener, subscribers: make(map[string][]net.Conn)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake
+}
+
+func (fake *fakeRedis) subscriberCount(channel string) int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return len(fake.subscribers[channel])
+}
+
+func (fake *fakeRedis) publishedTo(channel string) int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	count := 0
+	for _, published := range fake.published {
+		if published == channel {
+			count++
+		}
+	}
+	return count
+}
+
+func (fake *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRESPArray(reader)
+		if err != nil {
+			return
+		}
+		fake.mu.Lock()
+		switch strings.ToLower(args[0]) {
+		case "subscribe":
+			for _, channel := range args[1:] {
+				fake.subscribers[channel] = append(fake.subscribers[channel], conn)
+				fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(channel), channel)
+			}
+		case "publish":
+			channel, payload := args[1], args[2]
+			fake.published = append(fake.published, channel)
+			for _, subscriber := range fake.subscribers[channel] {
+				fmt.Fprintf(subscriber, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(payload), payload)
+			}
+			fmt.Fprintf(conn, ":%d\r\n", len(fake.subscribers[channel]))
+		case "ping":
+			fmt.Fprint(conn, "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+		default:
+			fmt.Fprint(conn, "+OK\r\n")
+		}
+		fake.mu.Unlock()
+	}
+}
+
+func readRESPArray(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func TestHubCreatedInInitUsesRedis(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.listener.Close()
+
+	// Hub is created by App.Init before redis exists, as the README shows.
+	wsApp := &WSApp{}
+	s := NewService(&Config{}, &[]App{wsApp})
+	s.RedisClient = redis.NewClient(&redis.Options{Addr: fake.listener.Addr().String()})
+	defer s.RedisClient.Close()
+	s.startHubs()
+	defer wsApp.hub.Close()
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	conn := dialWS(t, server, "/ws-app/chat")
+	defer conn.Close()
+
+	var reply chatMessage
+	conn.WriteJSON(chatMessage{Room: "go", Text: "join"})
+	conn.ReadJSON(&reply)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for fake.subscriberCount("ws-hub:ws-app") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := wsApp.hub.Broadcast("go", chatMessage{Room: "go", Text: "via redis"}); err != nil {
+		t.Fatalf("broadcast failed %s", err)
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Text != "via redis" {
+		t.Errorf("expected broadcast to be delivered got %+v %s", reply, err)
+	}
+	if fake.publishedTo("ws-hub:ws-app") == 0 {
+		t.Error("expected broadcast to be published to redis")
+	}
+}
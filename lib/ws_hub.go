@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// Hub groups websocket connections so apps can broadcast to rooms, topics, users etc.
+// With redis, broadcasts are published to a channel and every replica delivers to its own connections.
+type Hub struct {
+	name   string
+	logger *slog.Logger
+
+	mu     sync.RWMutex
+	groups map[string]map[*WSConn]bool
+
+	// Set once the service has a redis client, guarded by mu.
+	redisClient *redis.Client
+	pubSub      *redis.PubSub
+}
+
+type hubMessage struct {
+	Group   string          `json:"Group"`
+	Payload json.RawMessage `json:"Payload"`
+}
+
+// NewHub creates a hub named name, broadcasts fan out across replicas when service has a redis client.
+// Safe to call from App.Init, the hub starts using redis once Service.Init has connected it.
+func (s *Service) NewHub(name string) *Hub {
+	hub := &Hub{
+		name:   name,
+		logger: s.Logger.With("component", "ws-hub", "hub", name),
+		groups: make(map[string]map[*WSConn]bool),
+	}
+
+	s.hubsMu.Lock()
+	s.hubs = append(s.hubs, hub)
+	redisClient := s.RedisClient
+	s.hubsMu.Unlock()
+
+	if redisClient != nil {
+		hub.useRedis(redisClient)
+	}
+
+	return hub
+}
+
+// startHubs connects hubs created before redis was set up, called from Init.
+func (s *Service) startHubs() {
+	if s.RedisClient == nil {
+		return
+	}
+	s.hubsMu.Lock()
+	hubs := append([]*Hub{}, s.hubs...)
+	s.hubsMu.Unlock()
+
+	for _, hub := range hubs {
+		hub.useRedis(s.RedisClient)
+	}
+}
+
+func (hub *Hub) useRedis(client *redis.Client) {
+	hub.mu.Lock()
+	if hub.redisClient != nil {
+		hub.mu.Unlock()
+		return
+	}
+	hub.redisClient = client
+	hub.pubSub = client.Subscribe(hub.channel())
+	pubSub := hub.pubSub
+	hub.mu.Unlock()
+
+	GoFuncWrapper("ws hub "+hub.name+" subscription", func() {
+		hub.listen(pubSub)
+	})
+}
+
+func (hub *Hub) channel() string {
+	return "ws-hub:" + hub.name
+}
+
+// Join adds conn to group, conn leaves every group automatically once closed.
+func (hub *Hub) Join(group string, conn *WSConn) {
+	hub.mu.Lock()
+	if _, found := hub.groups[group]; !found {
+		hub.groups[group] = make(map[*WSConn]bool)
+	}
+	alreadyJoined := len(hub.connGroups(conn)) > 0
+	hub.groups[group][conn] = true
+	hub.mu.Unlock()
+
+	if !alreadyJoined {
+		conn.OnClose(func() {
+			hub.LeaveAll(conn)
+		})
+	}
+}
+
+func (hub *Hub) Leave(group string, conn *WSConn) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.leave(group, conn)
+}
+
+func (hub *Hub) LeaveAll(conn *WSConn) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, group := range hub.connGroups(conn) {
+		hub.leave(group, conn)
+	}
+}
+
+// Count returns number of local connections in group.
+func (hub *Hub) Count(group string) int {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	return len(hub.groups[group])
+}
+
+// Broadcast sends msg to every connection in group across all replicas.
+func (hub *Hub) Broadcast(group string, msg any) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	hub.mu.RLock()
+	redisClient := hub.redisClient
+	hub.mu.RUnlock()
+
+	if redisClient == nil {
+		hub.deliver(group, payload)
+		return nil
+	}
+
+	data, err := json.Marshal(hubMessage{Group: group, Payload: payload})
+	if err != nil {
+		return err
+	}
+	if err := redisClient.Publish(hub.channel(), data).Err(); err != nil {
+		// Local connections shouldn't miss out because redis is down.
+		hub.deliver(group, payload)
+		return err
+	}
+	return nil
+}
+
+// Close stops listening to redis, connections are left untouched.
+func (hub *Hub) Close() error {
+	hub.mu.RLock()
+	pubSub := hub.pubSub
+	hub.mu.RUnlock()
+
+	if pubSub != nil {
+		return pubSub.Close()
+	}
+	return nil
+}
+
+func (hub *Hub) listen(pubSub *redis.PubSub) {
+	for msg := range pubSub.Channel() {
+		var hubMsg hubMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &hubMsg); err != nil {
+			hub.logger.Error("invalid hub message", "error", err)
+			continue
+		}
+		hub.deliver(hubMsg.Group, hubMsg.Payload)
+	}
+}
+
+func (hub *Hub) deliver(group string, payload []byte) {
+	// Copy so slow consumers dropping out (which leaves the group) don't deadlock on the lock.
+	hub.mu.RLock()
+	conns := make([]*WSConn, 0, len(hub.groups[group]))
+	for conn := range hub.groups[group] {
+		conns = append(conns, conn)
+	}
+	hub.mu.RUnlock()
+
+	for _, conn := range conns {
+		if err := conn.writeRaw(payload); err != nil {
+			hub.logger.Debug("dropping message for closed connection", "conn_id", conn.ID, "group", group)
+		}
+	}
+}
+
+// connGroups expects the lock to be held.
+func (hub *Hub) connGroups(conn *WSConn) []string {
+	groups := []string{}
+	for group, conns := range hub.groups {
+		if conns[conn] {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// leave expects the lock to be held.
+func (hub *Hub) leave(group string, conn *WSConn) {
+	delete(hub.groups[group], conn)
+	if len(hub.groups[group]) == 0 {
+		delete(hub.groups, group)
+	}
+}
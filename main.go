@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	sentryhttp "github.com/getsentry/sentry-go/http"
 	"github.com/udayRedI/go-starter-kit/apps/health"
@@ -15,13 +23,38 @@ func main() {
 		health.New(),
 	}
 
+	openAPIFile := flag.String("openapi", "", "write OpenAPI spec to this file and exit")
+
 	config := lib.GetSecretConfig()
 	s := lib.NewService(config, &apps)
+	// Routes stdlib log and package level helpers through the same handler.
+	slog.SetDefault(s.Logger)
+
+	if *openAPIFile != "" {
+		if err := s.WriteOpenAPISpec(*openAPIFile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	startPort := s.Init()
 
-	log.Println("INFO: Server started on localhost" + startPort)
-	handler := sentryhttp.New(sentryhttp.Options{}).Handle(s.Server.Handler)
+	s.Server.Handler = sentryhttp.New(sentryhttp.Options{Repanic: true}).Handle(s.Server.Handler)
+
+	go func() {
+		s.Logger.Info("server started", "addr", "localhost"+startPort, "tls", s.Server.TLSConfig != nil)
+		if err := s.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 
-	log.Fatal(http.ListenAndServe(startPort, handler))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		log.Fatal(err)
+	}
 }